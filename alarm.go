@@ -0,0 +1,271 @@
+package gb28181
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/gb28181/v4/manscdp"
+)
+
+// 报警方式
+const (
+	AlarmMethodPhone  = 1 // 电话报警
+	AlarmMethodDevice = 2 // 设备报警
+	AlarmMethodSMS    = 3 // 短信报警
+	AlarmMethodGPS    = 4 // GPS报警
+	AlarmMethodVideo  = 5 // 视频报警
+	AlarmMethodFault  = 6 // 设备故障报警
+	AlarmMethodOther  = 7 // 其他报警
+)
+
+// Alarm 报警信息
+type Alarm struct {
+	DeviceID         string    // 上报报警的设备编号
+	ChannelID        string    // 报警通道编号
+	SN               int       // 报警通知的序列号
+	AlarmPriority    int       // 报警级别，1为一级警情，2为二级警情，3为三级警情，4为四级警情
+	AlarmMethod      int       // 报警方式，见 AlarmMethodXXX
+	AlarmType        int       // 报警类型，含义由报警方式决定
+	AlarmTime        time.Time // 设备上报的报警时间
+	AlarmDescription string
+	Longitude        string
+	Latitude         string
+	EventType        int       // 报警类型扩展参数，视频报警中的入侵检测等
+	ReceiveTime      time.Time // 服务器收到报警的时间
+	Reset            bool      // 是否已复位
+}
+
+// AlarmEvent 收到报警时发出的事件
+type AlarmEvent struct {
+	Device *Device
+	Alarm  *Alarm
+}
+
+type alarmHistory struct {
+	sync.RWMutex
+	list []*Alarm
+}
+
+// alarmInt 解析报警通知中的数值，为空或无法解析时为 0
+func alarmInt(s string) int {
+	v, _ := strconv.Atoi(strings.TrimSpace(s))
+	return v
+}
+
+func parseAlarm(d *Device, body string) (*Alarm, error) {
+	msg := &manscdp.AlarmNotify{}
+	if err := manscdp.Decode([]byte(body), msg); err != nil {
+		return nil, err
+	}
+	a := &Alarm{
+		DeviceID:         d.ID,
+		ChannelID:        msg.DeviceID,
+		SN:               msg.SN,
+		AlarmPriority:    alarmInt(msg.AlarmPriority),
+		AlarmMethod:      alarmInt(msg.AlarmMethod),
+		AlarmDescription: msg.AlarmDescription,
+		Longitude:        msg.Longitude,
+		Latitude:         msg.Latitude,
+		ReceiveTime:      time.Now(),
+	}
+	if msg.Info != nil {
+		a.AlarmType = alarmInt(msg.Info.AlarmType)
+		a.EventType = alarmInt(msg.Info.AlarmTypeParam.EventType)
+	}
+	if t, err := time.ParseInLocation(TIME_LAYOUT, msg.AlarmTime, time.Local); err == nil {
+		a.AlarmTime = t
+	} else {
+		a.AlarmTime = a.ReceiveTime
+	}
+	return a, nil
+}
+
+// onAlarm 处理设备上报的报警，记录到报警历史中并发出 AlarmEvent
+func (d *Device) onAlarm(body string) *Alarm {
+	a, err := parseAlarm(d, body)
+	if err != nil {
+		d.Error("decode alarm err", zap.Error(err))
+		return nil
+	}
+	d.Status = DeviceAlarmedStatus
+	d.alarms.Lock()
+	d.alarms.list = append(d.alarms.list, a)
+	if size := conf.Alarm.HistorySize; size > 0 && len(d.alarms.list) > size {
+		d.alarms.list = d.alarms.list[len(d.alarms.list)-size:]
+	}
+	d.alarms.Unlock()
+	d.Info("receive alarm", zap.String("channel", a.ChannelID), zap.Int("priority", a.AlarmPriority), zap.Int("method", a.AlarmMethod), zap.Int("type", a.AlarmType))
+	EmitEvent(AlarmEvent{Device: d, Alarm: a})
+	hook(WebhookAlarm, d.ID, a.ChannelID, a)
+	return a
+}
+
+// AlarmFilter 报警历史查询条件，零值表示不过滤
+type AlarmFilter struct {
+	ChannelID   string
+	StartTime   time.Time
+	EndTime     time.Time
+	MinPriority int
+	MaxPriority int
+	Method      int
+}
+
+func (f *AlarmFilter) match(a *Alarm) bool {
+	return (f.ChannelID == "" || f.ChannelID == a.ChannelID) &&
+		(f.StartTime.IsZero() || !a.AlarmTime.Before(f.StartTime)) &&
+		(f.EndTime.IsZero() || !a.AlarmTime.After(f.EndTime)) &&
+		(f.MinPriority == 0 || a.AlarmPriority >= f.MinPriority) &&
+		(f.MaxPriority == 0 || a.AlarmPriority <= f.MaxPriority) &&
+		(f.Method == 0 || f.Method == a.AlarmMethod)
+}
+
+// QueryAlarms 查询报警历史，按时间倒序
+func (d *Device) QueryAlarms(filter AlarmFilter) (list []*Alarm) {
+	d.alarms.RLock()
+	defer d.alarms.RUnlock()
+	list = make([]*Alarm, 0)
+	for i := len(d.alarms.list) - 1; i >= 0; i-- {
+		if a := d.alarms.list[i]; filter.match(a) {
+			list = append(list, a)
+		}
+	}
+	return
+}
+
+// AlarmSubscribe 报警订阅，priority 为 0 时订阅全部级别，method 为 0 时订阅全部报警方式
+func (d *Device) AlarmSubscribe(expires time.Duration, startPriority, endPriority, method int) int {
+	request := d.CreateRequest(sip.SUBSCRIBE)
+	if d.alarmSubscriber.CallID != "" {
+		// 续订使用原订阅的 Call-ID
+		callId := sip.CallID(d.alarmSubscriber.CallID)
+		request.ReplaceHeaders(callId.Name(), []sip.Header{&callId})
+	}
+	expiresHeader := sip.Expires(expires / time.Second)
+	contentType := sip.ContentType("Application/MANSCDP+xml")
+	event := sip.GenericHeader{HeaderName: "Event", Contents: "presence"}
+	request.AppendHeader(&contentType)
+	request.AppendHeader(&expiresHeader)
+	request.AppendHeader(&event)
+	request.SetBody(BuildAlarmSubscribeXML(requestSN(request), d.ID, startPriority, endPriority, method), true)
+
+	response, err := d.SipRequestForResponse(request)
+	if err == nil && response != nil {
+		if response.StatusCode() == http.StatusOK {
+			callId, _ := request.CallID()
+			d.alarmSubscriber.CallID = callId.Value()
+			d.alarmSubscriber.Timeout = time.Now().Add(expires)
+		} else {
+			d.alarmSubscriber.CallID = ""
+		}
+		return int(response.StatusCode())
+	}
+	d.alarmSubscriber.CallID = ""
+	return http.StatusRequestTimeout
+}
+
+// autoAlarmSubscribe 开启自动订阅报警时，在订阅即将过期前续订
+func (d *Device) autoAlarmSubscribe() {
+	if !conf.Alarm.AutosubAlarm || d.Status == DeviceOfflineStatus {
+		return
+	}
+	if d.alarmSubscriber.CallID == "" || time.Until(d.alarmSubscriber.Timeout) < conf.HeartbeatInterval {
+		d.Debug("Alarm Subscribe", zap.Int("code", d.AlarmSubscribe(conf.Alarm.Expires, 0, 0, 0)))
+	}
+}
+
+// ResetAlarm 报警复位，复位成功后设备状态恢复为在线
+func (d *Device) ResetAlarm(channelId string, method, alarmType int) (int, error) {
+	if channelId == "" {
+		channelId = d.ID
+	}
+	code, err := d.DeviceControl(channelId, &manscdp.DeviceControl{
+		AlarmCmd: manscdp.ResetAlarm,
+		Info:     &manscdp.AlarmCmdInfo{AlarmMethod: method, AlarmType: alarmType},
+	}, true)
+	if err != nil {
+		return code, err
+	}
+	alarmed := false
+	d.alarms.Lock()
+	for _, a := range d.alarms.list {
+		if (channelId == d.ID || a.ChannelID == channelId) && (method == 0 || a.AlarmMethod == method) {
+			a.Reset = true
+		}
+		alarmed = alarmed || !a.Reset
+	}
+	d.alarms.Unlock()
+	// 其他通道或其他报警方式还有未复位的报警时保持报警状态
+	if !alarmed && d.Status == DeviceAlarmedStatus {
+		d.Status = DeviceOnlineStatus
+	}
+	return code, nil
+}
+
+func parseUnixTime(s string) (t time.Time) {
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		t = intTotime(v)
+	}
+	return
+}
+
+func (c *GB28181Config) API_alarm_list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	filter := AlarmFilter{
+		ChannelID: query.Get("channel"),
+		StartTime: parseUnixTime(query.Get("startTime")),
+		EndTime:   parseUnixTime(query.Get("endTime")),
+	}
+	filter.MinPriority, _ = strconv.Atoi(query.Get("minPriority"))
+	filter.MaxPriority, _ = strconv.Atoi(query.Get("maxPriority"))
+	if p := query.Get("priority"); p != "" {
+		filter.MinPriority, _ = strconv.Atoi(p)
+		filter.MaxPriority = filter.MinPriority
+	}
+	filter.Method, _ = strconv.Atoi(query.Get("method"))
+	if v, ok := Devices.Load(id); ok {
+		util.ReturnValue(v.(*Device).QueryAlarms(filter), w, r)
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q  not found", id), w, r)
+	}
+}
+
+func (c *GB28181Config) API_alarm_subscribe(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	expires, err := time.ParseDuration(query.Get("expires"))
+	if err != nil {
+		expires = c.Alarm.Expires
+	}
+	startPriority, _ := strconv.Atoi(query.Get("startPriority"))
+	endPriority, _ := strconv.Atoi(query.Get("endPriority"))
+	method, _ := strconv.Atoi(query.Get("method"))
+	if v, ok := Devices.Load(id); ok {
+		d := v.(*Device)
+		util.ReturnError(0, fmt.Sprintf("alarm subscribe code:%d", d.AlarmSubscribe(expires, startPriority, endPriority, method)), w, r)
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q  not found", id), w, r)
+	}
+}
+
+func (c *GB28181Config) API_alarm_reset(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	channel := query.Get("channel")
+	method, _ := strconv.Atoi(query.Get("method"))
+	alarmType, _ := strconv.Atoi(query.Get("type"))
+	if v, ok := Devices.Load(id); ok {
+		code, err := v.(*Device).ResetAlarm(channel, method, alarmType)
+		returnControlResult(code, err, w, r)
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q  not found", id), w, r)
+	}
+}
@@ -0,0 +1,214 @@
+package gb28181
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"go.uber.org/zap"
+	"m7s.live/plugin/gb28181/v4/utils"
+)
+
+// 摘要认证算法，RFC 7616
+const (
+	DigestMD5        = "MD5"
+	DigestMD5Sess    = "MD5-sess"
+	DigestSHA256     = "SHA-256"
+	DigestSHA256Sess = "SHA-256-sess"
+)
+
+// realmCredential 设备所属域的认证信息
+type realmCredential struct {
+	Realm      string
+	Username   string
+	Password   string
+	Algorithms []string // 下发的认证算法，优先使用的在前
+}
+
+// needAuth 是否需要校验设备的用户名和密码
+func (r *realmCredential) needAuth() bool {
+	return r.Username != "" || r.Password != ""
+}
+
+// deviceRealm 按设备 ID 的前缀匹配认证域，匹配不到时使用全局的 Realm、Username、Password
+func (c *GB28181Config) deviceRealm(id string) *realmCredential {
+	r := &realmCredential{Realm: c.Realm, Username: c.Username, Password: c.Password}
+	algorithm := c.Auth.Algorithm
+	matched := ""
+	for _, cfg := range c.Auth.Realms {
+		if cfg.Realm != "" && strings.HasPrefix(id, cfg.Realm) && len(cfg.Realm) > len(matched) {
+			matched = cfg.Realm
+			r.Realm, r.Username, r.Password = cfg.Realm, cfg.Username, cfg.Password
+			if cfg.Algorithm != "" {
+				algorithm = cfg.Algorithm
+			}
+		}
+	}
+	for _, a := range strings.Split(algorithm, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			r.Algorithms = append(r.Algorithms, a)
+		}
+	}
+	if len(r.Algorithms) == 0 {
+		r.Algorithms = []string{DigestMD5}
+	}
+	return r
+}
+
+// digestNonce 下发给设备的 nonce，保存在 DeviceNonce 中
+type digestNonce struct {
+	Value      string
+	Realm      string
+	CreateTime time.Time
+	nc         uint64 // 设备已使用的最大 nonce count，用于防止重放
+	sync.Mutex
+}
+
+func newDigestNonce(realm string) *digestNonce {
+	return &digestNonce{Value: utils.RandNumString(32), Realm: realm, CreateTime: time.Now()}
+}
+
+// Expired nonce 超过有效期后需要设备使用新的 nonce 重新计算（stale=true）
+func (n *digestNonce) Expired() bool {
+	return conf.Auth.NonceExpires > 0 && time.Since(n.CreateTime) > conf.Auth.NonceExpires
+}
+
+// use 校验并记录 nonce count，同一个 nonce 的 nc 必须递增
+func (n *digestNonce) use(nc string) bool {
+	if nc == "" {
+		return true
+	}
+	v, err := strconv.ParseUint(nc, 16, 64)
+	if err != nil {
+		return false
+	}
+	n.Lock()
+	defer n.Unlock()
+	if v <= n.nc {
+		return false
+	}
+	n.nc = v
+	return true
+}
+
+// challengeNonce 返回设备当前有效的 nonce，不存在、已过期或认证域变化时重新生成
+func challengeNonce(id, realm string) *digestNonce {
+	if v, ok := DeviceNonce.Load(id); ok {
+		if n := v.(*digestNonce); n.Realm == realm && !n.Expired() {
+			return n
+		}
+	}
+	n := newDigestNonce(realm)
+	DeviceNonce.Store(id, n)
+	return n
+}
+
+// appendChallenge 添加 WWW-Authenticate 头，每种算法一个，stale 表示设备的认证信息正确但 nonce 已过期
+func appendChallenge(resp sip.Response, r *realmCredential, nonce string, stale bool) {
+	for _, algorithm := range r.Algorithms {
+		auth := fmt.Sprintf(`Digest realm="%s",algorithm=%s,nonce="%s"`, r.Realm, algorithm, nonce)
+		if conf.Auth.Qop != "" {
+			auth += fmt.Sprintf(`,qop="%s"`, conf.Auth.Qop)
+		}
+		if stale {
+			auth += ",stale=true"
+		}
+		resp.AppendHeader(&sip.GenericHeader{
+			HeaderName: "WWW-Authenticate",
+			Contents:   auth,
+		})
+	}
+}
+
+type Authorization struct {
+	*sip.Authorization
+}
+
+// Verify 按 RFC 2617/7616 校验设备的摘要认证，method 为请求方法，只接受认证域下发的算法和 qop
+func (a *Authorization) Verify(method, username string, r *realmCredential, nonce string) bool {
+	realm, passwd := r.Realm, r.Password
+	if a.Realm() != realm || a.Nonce() != nonce {
+		return false
+	}
+	h := a.newHash(r.Algorithms)
+	if h == nil {
+		GB28181Plugin.Error("Authorization algorithm wrong", zap.String("algorithm", a.Algorithm()))
+		return false
+	}
+	// QopStrict 为 true 时不允许设备降级为 RFC 2069 方式
+	if !a.qopAllowed() {
+		GB28181Plugin.Error("Authorization qop wrong", zap.String("qop", a.Qop()))
+		return false
+	}
+	//1、将 username,realm,password 依次组合并用算法加密得到 HA1，-sess 算法再与 nonce、cnonce 组合加密
+	ha1 := digest(h, username, realm, passwd)
+	if strings.HasSuffix(strings.ToLower(a.Algorithm()), "-sess") {
+		ha1 = digest(h, ha1, nonce, a.CNonce())
+	}
+	//2、将请求方法和 uri 组合并加密得到 HA2
+	ha2 := digest(h, method, a.Uri())
+	//3、qop=auth 时 Response 为 HA1:nonce:nc:cnonce:qop:HA2 的摘要，否则为 HA1:nonce:HA2 的摘要
+	var response string
+	if a.Qop() != "" {
+		response = digest(h, ha1, nonce, a.Nc(), a.CNonce(), a.Qop(), ha2)
+	} else {
+		response = digest(h, ha1, nonce, ha2)
+	}
+	//4、计算服务端和客户端上报的是否相等
+	return subtle.ConstantTimeCompare([]byte(response), []byte(strings.ToLower(a.Response()))) == 1
+}
+
+// qopAllowed 未配置 qop 时设备不能使用 qop；配置了 qop 时设备使用的 qop 必须是其中之一，
+// 不带 qop 的 RFC 2069 方式只在 QopStrict 为 false 时接受，兼容大多数 2011/2016 版本的设备
+func (a *Authorization) qopAllowed() bool {
+	if conf.Auth.Qop == "" {
+		return a.Qop() == ""
+	}
+	if a.Qop() == "" {
+		return !conf.Auth.QopStrict
+	}
+	for _, qop := range strings.Split(conf.Auth.Qop, ",") {
+		if strings.TrimSpace(qop) == a.Qop() {
+			return true
+		}
+	}
+	return false
+}
+
+// newHash 设备使用的算法不在 algorithms 中时返回 nil
+func (a *Authorization) newHash(algorithms []string) hash.Hash {
+	algorithm := a.Algorithm()
+	if algorithm == "" {
+		algorithm = DigestMD5 //如果没有算法，默认使用MD5
+	}
+	allowed := false
+	for _, v := range algorithms {
+		if strings.EqualFold(v, algorithm) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil
+	}
+	switch strings.ToUpper(algorithm) {
+	case "MD5", "MD5-SESS":
+		return md5.New()
+	case "SHA-256", "SHA-256-SESS":
+		return sha256.New()
+	}
+	return nil
+}
+
+func digest(h hash.Hash, parts ...string) string {
+	h.Reset()
+	h.Write([]byte(strings.Join(parts, ":")))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
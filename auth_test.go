@@ -0,0 +1,129 @@
+package gb28181
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+func hexHash(algorithm, s string) string {
+	if algorithm == DigestSHA256 || algorithm == DigestSHA256Sess {
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+	}
+	return fmt.Sprintf("%x", md5.Sum([]byte(s)))
+}
+
+// digestHeader 按 RFC 2617/7616 计算设备应携带的 Authorization 头
+func digestHeader(algorithm, qop, username, realm, password, nonce string) string {
+	const uri, nc, cnonce = "sip:34020000002000000001@3402000000", "00000001", "0a4f113b"
+	ha1 := hexHash(algorithm, username+":"+realm+":"+password)
+	if algorithm == DigestMD5Sess || algorithm == DigestSHA256Sess {
+		ha1 = hexHash(algorithm, ha1+":"+nonce+":"+cnonce)
+	}
+	ha2 := hexHash(algorithm, "REGISTER:"+uri)
+	h := fmt.Sprintf(`Digest username="%s",realm="%s",nonce="%s",uri="%s"`, username, realm, nonce, uri)
+	if algorithm != "" {
+		h += ",algorithm=" + algorithm
+	}
+	if qop != "" {
+		h += fmt.Sprintf(`,qop=%s,nc=%s,cnonce="%s",response="%s"`, qop, nc, cnonce, hexHash(algorithm, ha1+":"+nonce+":"+nc+":"+cnonce+":"+qop+":"+ha2))
+	} else {
+		h += fmt.Sprintf(`,response="%s"`, hexHash(algorithm, ha1+":"+nonce+":"+ha2))
+	}
+	return h
+}
+
+func TestAuthorizationVerify(t *testing.T) {
+	const username, realm, password, nonce = "34020000001320000001", "3402000000", "12345678", "9bd055f4cf1e8e5d"
+	saved := conf.Auth
+	defer func() { conf.Auth = saved }()
+	for _, tt := range []struct {
+		name       string
+		algorithm  string // 设备使用的算法
+		qop        string // 设备使用的 qop
+		allowed    []string
+		confQop    string
+		strict     bool
+		password   string
+		wantResult bool
+	}{
+		{"md5 with qop", DigestMD5, "auth", []string{DigestMD5}, "auth", false, password, true},
+		{"md5 without algorithm", "", "auth", []string{DigestMD5}, "auth", false, password, true},
+		{"md5 rfc2069", DigestMD5, "", []string{DigestMD5}, "", false, password, true},
+		{"rfc2069 when qop offered", DigestMD5, "", []string{DigestMD5}, "auth", false, password, true},
+		{"rfc2069 when qop strict", DigestMD5, "", []string{DigestMD5}, "auth", true, password, false},
+		{"qop not offered", DigestMD5, "auth", []string{DigestMD5}, "", false, password, false},
+		{"qop not in list", DigestMD5, "auth-int", []string{DigestMD5}, "auth", false, password, false},
+		{"md5-sess", DigestMD5Sess, "auth", []string{DigestMD5Sess}, "auth", false, password, true},
+		{"sha-256", DigestSHA256, "auth", []string{DigestSHA256, DigestMD5}, "auth", false, password, true},
+		{"sha-256-sess", DigestSHA256Sess, "auth", []string{DigestSHA256Sess}, "auth", false, password, true},
+		{"sha-256 not offered", DigestSHA256, "auth", []string{DigestMD5}, "auth", false, password, false},
+		{"md5 not offered", DigestMD5, "auth", []string{DigestSHA256}, "auth", false, password, false},
+		{"wrong password", DigestMD5, "auth", []string{DigestMD5}, "auth", false, "87654321", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conf.Auth.Qop, conf.Auth.QopStrict = tt.confQop, tt.strict
+			a := &Authorization{sip.AuthFromValue(digestHeader(tt.algorithm, tt.qop, username, realm, tt.password, nonce))}
+			r := &realmCredential{Realm: realm, Username: username, Password: password, Algorithms: tt.allowed}
+			if got := a.Verify("REGISTER", username, r, nonce); got != tt.wantResult {
+				t.Errorf("Verify() = %v, want %v", got, tt.wantResult)
+			}
+		})
+	}
+}
+
+func TestAuthorizationVerifyMismatch(t *testing.T) {
+	const username, realm, password, nonce = "34020000001320000001", "3402000000", "12345678", "9bd055f4cf1e8e5d"
+	a := &Authorization{sip.AuthFromValue(digestHeader(DigestMD5, "", username, realm, password, nonce))}
+	r := &realmCredential{Realm: realm, Password: password, Algorithms: []string{DigestMD5}}
+	if a.Verify("REGISTER", username, r, "other-nonce") {
+		t.Error("Verify() accepted a different nonce")
+	}
+	if a.Verify("REGISTER", username, &realmCredential{Realm: "4401000000", Password: password, Algorithms: []string{DigestMD5}}, nonce) {
+		t.Error("Verify() accepted a different realm")
+	}
+}
+
+func TestDigestNonceUse(t *testing.T) {
+	n := newDigestNonce("3402000000")
+	for _, tt := range []struct {
+		nc   string
+		want bool
+	}{
+		{"", true}, // RFC 2069 方式不带 nc
+		{"00000001", true},
+		{"00000001", false}, // 重放
+		{"00000003", true},
+		{"00000002", false}, // nc 回退
+		{"zz", false},
+	} {
+		if got := n.use(tt.nc); got != tt.want {
+			t.Errorf("use(%q) = %v, want %v", tt.nc, got, tt.want)
+		}
+	}
+}
+
+func TestDigestNonceExpired(t *testing.T) {
+	saved := conf.Auth.NonceExpires
+	defer func() { conf.Auth.NonceExpires = saved }()
+	for _, tt := range []struct {
+		expires time.Duration
+		age     time.Duration
+		want    bool
+	}{
+		{0, time.Hour, false}, // 0 表示不过期
+		{time.Minute * 5, time.Minute, false},
+		{time.Minute * 5, time.Minute * 6, true},
+	} {
+		conf.Auth.NonceExpires = tt.expires
+		n := newDigestNonce("3402000000")
+		n.CreateTime = time.Now().Add(-tt.age)
+		if got := n.Expired(); got != tt.want {
+			t.Errorf("expires %s age %s: Expired() = %v, want %v", tt.expires, tt.age, got, tt.want)
+		}
+	}
+}
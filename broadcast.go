@@ -0,0 +1,465 @@
+package gb28181
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/goccy/go-json"
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/gb28181/v4/utils"
+	"m7s.live/plugin/ps/v4"
+)
+
+const (
+	AudioModeBroadcast = "Broadcast" // 语音广播，设备收到广播通知后主动 INVITE 服务器
+	AudioModeTalk      = "Talk"      // 语音对讲，服务器 INVITE 设备，双向音频
+)
+
+var (
+	AudioSessions             sync.Map // 语音广播/对讲会话，key 为 deviceId/channelId
+	BROADCAST_INVITE_TIMEOUT  = time.Second * 10
+	ErrAudioCodecNotSupported = errors.New("audio codec not supported, only G.711 is allowed")
+)
+
+// AudioSession 一路语音广播或对讲，从 m7s 中订阅音频，以 PS 或 G.711 over RTP 发送给设备
+type AudioSession struct {
+	Subscriber
+	Mode       string
+	SourcePath string // 音频来源流
+	StreamPath string // 对讲时设备上行音频的流
+	StartTime  time.Time
+	channel    *Channel
+	ready      chan error
+	waiting    atomic.Bool // 广播通知后等待设备的 INVITE
+	remoteSDP  *SDPInfo
+	inviteReq  sip.Request  // 广播时为设备发来的 INVITE，对讲时为服务器发出的 INVITE
+	inviteResp sip.Response // 广播时为服务器的应答，对讲时为设备的应答
+	opt        InviteOptions
+	sender     *utils.RTPSender
+	muxer      utils.PSMuxer
+	rawCodec   string // 设备只支持 G.711 负载时为协商的编码，如 PCMA/8000，为空时以 PS 封装发送
+	frames     int
+	byeByPeer  bool
+	stopOnce   sync.Once
+}
+
+func (s *AudioSession) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"DeviceID":   s.channel.Device.ID,
+		"ChannelID":  s.channel.DeviceID,
+		"Mode":       s.Mode,
+		"SourcePath": s.SourcePath,
+		"StreamPath": s.StreamPath,
+		"StartTime":  s.StartTime,
+	})
+}
+
+func audioSessionKey(c *Channel) string {
+	return fmt.Sprintf("%s/%s", c.Device.ID, c.DeviceID)
+}
+
+// StartAudio 开始语音广播或对讲，sourcePath 为 m7s 中的音频来源流，音频须为 G.711
+func (channel *Channel) StartAudio(mode, sourcePath string) (*AudioSession, error) {
+	s := &AudioSession{
+		Mode:       mode,
+		SourcePath: sourcePath,
+		StartTime:  time.Now(),
+		channel:    channel,
+		ready:      make(chan error, 1),
+	}
+	if _, loaded := AudioSessions.LoadOrStore(audioSessionKey(channel), s); loaded {
+		return nil, errors.New("audio session already exists")
+	}
+	var err error
+	if mode == AudioModeTalk {
+		err = s.inviteTalk()
+	} else {
+		err = s.notifyBroadcast()
+	}
+	if err != nil {
+		// 对讲在收流失败前可能已经应答并发送 ACK，Hangup 在建立会话后会发送 BYE
+		s.Hangup()
+		return nil, err
+	}
+	go s.play()
+	return s, nil
+}
+
+// StopAudio 结束语音广播或对讲
+func (channel *Channel) StopAudio() int {
+	if v, ok := AudioSessions.Load(audioSessionKey(channel)); ok {
+		v.(*AudioSession).Hangup()
+		return http.StatusOK
+	}
+	return http.StatusNotFound
+}
+
+// notifyBroadcast 发送广播通知，并等待设备发起 INVITE
+func (s *AudioSession) notifyBroadcast() error {
+	d := s.channel.Device
+	request := d.CreateRequest(sip.MESSAGE)
+	contentType := sip.ContentType("Application/MANSCDP+xml")
+	request.AppendHeader(&contentType)
+	request.SetBody(BuildBroadcastXML(requestSN(request), conf.Serial, s.channel.DeviceID), true)
+	s.waiting.Store(true)
+	defer s.waiting.Store(false)
+	resp, err := d.SipRequestForResponse(request)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("broadcast error, status=%d", resp.StatusCode())
+	}
+	select {
+	case err = <-s.ready:
+		return err
+	case <-time.After(BROADCAST_INVITE_TIMEOUT):
+		if s.waiting.CompareAndSwap(true, false) {
+			return errors.New("wait for device invite timeout")
+		}
+		// 超时的同时设备的 INVITE 已经在处理，OnInvite 一定会发送结果
+		return <-s.ready
+	}
+}
+
+// onBroadcastResult 设备对广播通知的应答
+func (s *AudioSession) onBroadcastResult(result string) {
+	if strings.ToUpper(result) == "ERROR" {
+		s.setReady(errors.New("device refused broadcast"))
+	}
+}
+
+// setReady 通知等待中的 notifyBroadcast，已有结果时丢弃，避免阻塞 SIP 处理协程
+func (s *AudioSession) setReady(err error) {
+	select {
+	case s.ready <- err:
+	default:
+	}
+}
+
+// findBroadcastSession 根据设备 INVITE 的发起方查找等待中的广播
+func findBroadcastSession(id string) (session *AudioSession) {
+	AudioSessions.Range(func(key, value any) bool {
+		s := value.(*AudioSession)
+		if s.Mode == AudioModeBroadcast && s.waiting.Load() && (s.channel.DeviceID == id || s.channel.Device.ID == id) {
+			session = s
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// OnInvite 设备收到广播通知后发起的 INVITE
+func (s *AudioSession) OnInvite(req sip.Request, tx sip.ServerTransaction) {
+	// 只接受第一个 INVITE，等待已超时或已收到 INVITE 时拒绝
+	if !s.waiting.CompareAndSwap(true, false) {
+		tx.Respond(sip.NewResponseFromRequest("", req, 481, "Call/Transaction Does Not Exist", ""))
+		return
+	}
+	sdp := ParseSDP(req.Body())
+	if sdp.IP == "" || sdp.MediaPort == 0 {
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusBadRequest, "Bad Request", ""))
+		s.setReady(errors.New("bad sdp from device"))
+		return
+	}
+	s.remoteSDP = sdp
+	s.inviteReq = req
+	d := s.channel.Device
+	payloadType, rtpmap := audioPayload(sdp)
+	protocol := ""
+	if sdp.TCP {
+		protocol = "TCP/"
+	}
+	sdpInfo := []string{
+		"v=0",
+		fmt.Sprintf("o=%s 0 0 IN IP4 %s", conf.Serial, d.MediaIP),
+		"s=Play",
+		"c=IN IP4 " + d.MediaIP,
+		"t=0 0",
+		fmt.Sprintf("m=audio %d %sRTP/AVP %s", conf.MediaPort, protocol, payloadType),
+		"a=sendonly",
+		"a=rtpmap:" + payloadType + " " + rtpmap,
+	}
+	if sdp.TCP {
+		sdpInfo = append(sdpInfo, "a=setup:active", "a=connection:new")
+	}
+	sdpInfo = append(sdpInfo, "y="+sdp.SSRC, "f=v/////a/1/8/1")
+	resp := sip.NewResponseFromRequest("", req, http.StatusOK, "OK", strings.Join(sdpInfo, "\r\n")+"\r\n")
+	to, _ := resp.To()
+	resp.ReplaceHeaders("To", []sip.Header{&sip.ToHeader{Address: to.Address, Params: sip.NewParams().Add("tag", sip.String{Str: utils.RandNumString(9)})}})
+	contentType := sip.ContentType("application/sdp")
+	resp.AppendHeader(&contentType)
+	port := conf.sipPort(req.Transport())
+	resp.AppendHeader(&sip.ContactHeader{Address: &sip.SipUri{FUser: sip.String{Str: conf.Serial}, FHost: d.SipIP, FPort: &port}})
+	s.inviteResp = resp
+	if err := tx.Respond(resp); err != nil {
+		s.setReady(err)
+		return
+	}
+	s.setReady(nil)
+}
+
+// audioPayload 选择发送给设备的负载类型，优先使用设备支持的 PS，否则发送不封装的 G.711
+func audioPayload(sdp *SDPInfo) (payloadType string, rtpmap string) {
+	for _, pt := range sdp.PayloadType {
+		if strings.HasPrefix(strings.ToUpper(sdp.Rtpmap[pt]), "PS/") {
+			return pt, "PS/90000"
+		}
+	}
+	for _, pt := range sdp.PayloadType {
+		switch pt {
+		case "8":
+			return pt, "PCMA/8000"
+		case "0":
+			return pt, "PCMU/8000"
+		}
+	}
+	return "96", "PS/90000"
+}
+
+// inviteTalk 以 s=Talk 邀请设备，设备上行音频发布为 [设备编号]/[通道编号]/talk
+func (s *AudioSession) inviteTalk() (err error) {
+	channel := s.channel
+	d := channel.Device
+	s.opt.CreateSSRC()
+	networkType := "udp"
+	protocol := ""
+	reusePort := conf.Port.Fdm
+	if conf.IsMediaNetworkTCP() {
+		networkType = "tcp"
+		protocol = "TCP/"
+		if conf.tcpPorts.Valid {
+			s.opt.MediaPort, err = conf.tcpPorts.GetPort()
+			s.opt.recyclePort = conf.tcpPorts.Recycle
+		}
+	} else if conf.udpPorts.Valid {
+		s.opt.MediaPort, err = conf.udpPorts.GetPort()
+		s.opt.recyclePort = conf.udpPorts.Recycle
+	}
+	if err != nil {
+		return
+	}
+	if s.opt.MediaPort == 0 {
+		s.opt.MediaPort = conf.MediaPort
+		reusePort = true
+	}
+	sdpInfo := []string{
+		"v=0",
+		fmt.Sprintf("o=%s 0 0 IN IP4 %s", channel.DeviceID, d.MediaIP),
+		"s=Talk",
+		"c=IN IP4 " + d.MediaIP,
+		"t=0 0",
+		fmt.Sprintf("m=audio %d %sRTP/AVP 8 96", s.opt.MediaPort, protocol),
+		"a=sendrecv",
+		"a=rtpmap:8 PCMA/8000",
+		"a=rtpmap:96 PS/90000",
+	}
+	if conf.IsMediaNetworkTCP() {
+		sdpInfo = append(sdpInfo, "a=setup:passive", "a=connection:new")
+	}
+	sdpInfo = append(sdpInfo, "y="+s.opt.ssrc, "f=v/////a/1/8/1")
+	invite := channel.CreateRequst(sip.INVITE)
+	contentType := sip.ContentType("application/sdp")
+	invite.AppendHeader(&contentType)
+	invite.SetBody(strings.Join(sdpInfo, "\r\n")+"\r\n", true)
+	subject := sip.GenericHeader{
+		HeaderName: "Subject", Contents: fmt.Sprintf("%s:%s,%s:0", channel.DeviceID, s.opt.ssrc, conf.Serial),
+	}
+	invite.AppendHeader(&subject)
+	inviteRes, err := d.SipRequestForResponse(invite)
+	if err != nil {
+		return
+	}
+	if inviteRes.StatusCode() != http.StatusOK {
+		return fmt.Errorf("talk invite error, status=%d", inviteRes.StatusCode())
+	}
+	s.inviteReq = invite
+	s.inviteResp = inviteRes
+	s.remoteSDP = ParseSDP(inviteRes.Body())
+	if err = srv.Send(sip.NewAckRequest("", invite, inviteRes, "", nil)); err != nil {
+		return
+	}
+	s.StreamPath = fmt.Sprintf("%s/%s/talk", d.ID, channel.DeviceID)
+	if !s.remoteSDP.TCP {
+		networkType = "udp"
+	}
+	ssrc := s.opt.SSRC
+	if s.remoteSDP.SSRC != "" {
+		ssrc = s.remoteSDP.SSRCValue()
+	}
+	var psPuber ps.PSPublisher
+	return psPuber.Receive(s.StreamPath, conf.DumpPath, fmt.Sprintf("%s:%d", networkType, s.opt.MediaPort), ssrc, reusePort)
+}
+
+// play 连接设备的媒体地址，订阅音频来源并发送
+func (s *AudioSession) play() {
+	defer s.Hangup()
+	remote := net.JoinHostPort(s.remoteSDP.IP, strconv.Itoa(int(s.remoteSDP.MediaPort)))
+	network := "udp"
+	if s.remoteSDP.TCP {
+		network = "tcp"
+	}
+	conn, err := net.DialTimeout(network, remote, 10*time.Second)
+	if err != nil {
+		s.channel.Error("audio connect failed", zap.String("remote", remote), zap.Error(err))
+		return
+	}
+	pt, rtpmap := audioPayload(s.remoteSDP)
+	payloadType, _ := strconv.ParseUint(pt, 10, 8)
+	if !strings.HasPrefix(rtpmap, "PS/") {
+		s.rawCodec = rtpmap
+	}
+	s.sender = utils.NewRTPSender(conn, s.remoteSDP.TCP, s.remoteSDP.SSRCValue(), uint8(payloadType))
+	if err = GB28181Plugin.Subscribe(s.SourcePath, s); err != nil {
+		s.channel.Error("audio subscribe failed", zap.String("source", s.SourcePath), zap.Error(err))
+		return
+	}
+	s.channel.Info("audio session start", zap.String("mode", s.Mode), zap.String("source", s.SourcePath))
+	s.PlayRaw()
+}
+
+func (s *AudioSession) OnEvent(event any) {
+	switch v := event.(type) {
+	case VideoFrame:
+	case AudioFrame:
+		rtpmap := ""
+		switch v.CodecID {
+		case codec.CodecID_PCMA:
+			s.muxer.AudioType = utils.PSStreamTypeG711A
+			rtpmap = "PCMA/8000"
+		case codec.CodecID_PCMU:
+			s.muxer.AudioType = utils.PSStreamTypeG711U
+			rtpmap = "PCMU/8000"
+		}
+		if rtpmap == "" || (s.rawCodec != "" && s.rawCodec != rtpmap) {
+			s.channel.Error("audio session stop", zap.Error(ErrAudioCodecNotSupported), zap.String("negotiated", s.rawCodec))
+			s.Subscriber.Stop()
+			return
+		}
+		if s.rawCodec != "" {
+			// 设备协商的是 G.711 负载，直接发送音频数据，时间戳为 8000Hz
+			if err := s.sender.Send(v.AUList.ToBytes(), uint32(uint64(v.PTS)*8/90)); err != nil {
+				s.Subscriber.Stop()
+			}
+			return
+		}
+		// 每秒左右重复一次 PSM，便于设备中途解析
+		withPSM := s.frames%50 == 0
+		s.frames++
+		if err := s.sender.Send(s.muxer.MuxAudio(v.AUList.ToBytes(), v.PTS, withPSM), v.PTS); err != nil {
+			s.Subscriber.Stop()
+		}
+	default:
+		s.Subscriber.OnEvent(event)
+	}
+}
+
+// Hangup 结束会话，非设备主动挂断时向设备发送 BYE
+func (s *AudioSession) Hangup() {
+	s.stopOnce.Do(func() {
+		AudioSessions.Delete(audioSessionKey(s.channel))
+		if !s.byeByPeer && s.inviteResp != nil {
+			s.bye()
+		}
+		s.close()
+		s.channel.Info("audio session closed", zap.String("mode", s.Mode))
+	})
+}
+
+func (s *AudioSession) bye() {
+	d := s.channel.Device
+	var req sip.Request
+	if s.Mode == AudioModeTalk {
+		req = (&PullStream{channel: s.channel, inviteRes: s.inviteResp}).CreateRequest(sip.BYE)
+	} else {
+		req = CreateByeRequest(s.inviteReq, s.inviteResp, d.nextSN())
+	}
+	if _, err := d.SipRequestForResponse(req); err != nil {
+		s.channel.Warn("audio session bye failed", zap.Error(err))
+	}
+}
+
+func (s *AudioSession) close() {
+	if s.sender != nil {
+		s.sender.Close()
+	}
+	if s.Subscriber.Stream != nil {
+		s.Subscriber.Stop()
+	}
+	if s.StreamPath != "" {
+		if stream := Streams.Get(s.StreamPath); stream != nil {
+			stream.Close()
+		}
+	}
+	if s.opt.recyclePort != nil {
+		s.opt.recyclePort(s.opt.MediaPort)
+	}
+}
+
+// findAudioSessionByCallID BYE 时根据 Call-ID 查找会话
+func findAudioSessionByCallID(callID string) (session *AudioSession) {
+	AudioSessions.Range(func(key, value any) bool {
+		s := value.(*AudioSession)
+		if s.inviteReq != nil {
+			if id, ok := s.inviteReq.CallID(); ok && id.Value() == callID {
+				session = s
+				return false
+			}
+		}
+		return true
+	})
+	return
+}
+
+func (c *GB28181Config) API_broadcast_start(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	channel := query.Get("channel")
+	streamPath := query.Get("streamPath") // 音频来源流
+	mode := AudioModeBroadcast
+	if strings.EqualFold(query.Get("mode"), AudioModeTalk) {
+		mode = AudioModeTalk
+	}
+	if streamPath == "" {
+		util.ReturnError(util.APIErrorQueryParse, "streamPath parameter is required", w, r)
+		return
+	}
+	if c := FindChannel(id, channel); c == nil {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q channel %q not found", id, channel), w, r)
+	} else if s, err := c.StartAudio(mode, streamPath); err != nil {
+		util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+	} else {
+		util.ReturnValue(s, w, r)
+	}
+}
+
+func (c *GB28181Config) API_broadcast_stop(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	channel := r.URL.Query().Get("channel")
+	if c := FindChannel(id, channel); c != nil {
+		util.ReturnError(0, fmt.Sprintf("stop code:%d", c.StopAudio()), w, r)
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q channel %q not found", id, channel), w, r)
+	}
+}
+
+func (c *GB28181Config) API_broadcast_list(w http.ResponseWriter, r *http.Request) {
+	list := make([]*AudioSession, 0)
+	AudioSessions.Range(func(key, value any) bool {
+		list = append(list, value.(*AudioSession))
+		return true
+	})
+	util.ReturnValue(list, w, r)
+}
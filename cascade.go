@@ -0,0 +1,656 @@
+package gb28181
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/goccy/go-json"
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/log"
+	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/gb28181/v4/manscdp"
+	"m7s.live/plugin/gb28181/v4/utils"
+)
+
+const (
+	PlatformRegisteredStatus   = "REGISTERED"
+	PlatformUnregisteredStatus = "UNREGISTERED"
+)
+
+var (
+	Platforms       sync.Map // 上级平台，key 为上级平台 ServerID
+	CascadeSessions sync.Map // 上级平台的点播会话，key 为 Call-ID
+)
+
+// Platform 上级平台，本服务以下级平台身份向其注册，并响应其目录查询和点播
+type Platform struct {
+	GB28181CascadeConfig
+	Status          string
+	RegisterTime    time.Time
+	LastKeepaliveAt time.Time
+	LocalIP         string        //与上级平台通信的本地ip
+	sn              atomic.Uint32 //请求序号，注册、心跳、应答和 BYE 在不同协程中发送
+	registerCallID  sip.CallID
+	keepaliveFailed int
+	*log.Logger     `json:"-" yaml:"-"`
+}
+
+func (p *Platform) MarshalJSON() ([]byte, error) {
+	m := map[string]any{
+		"ServerID":        p.ServerID,
+		"Realm":           p.Realm,
+		"ServerAddr":      p.ServerAddr,
+		"Transport":       p.Transport,
+		"Status":          p.Status,
+		"RegisterTime":    p.RegisterTime,
+		"LastKeepaliveAt": p.LastKeepaliveAt,
+		"LocalIP":         p.LocalIP,
+	}
+	return json.Marshal(m)
+}
+
+func (c *GB28181Config) startCascade() {
+	for _, cfg := range c.Cascades {
+		if cfg.Disabled || cfg.ServerID == "" || cfg.ServerAddr == "" {
+			continue
+		}
+		if cfg.Transport == "" {
+			cfg.Transport = c.SipNetwork
+		}
+		if cfg.Expires == 0 {
+			cfg.Expires = time.Hour
+		}
+		if cfg.Keepalive == 0 {
+			cfg.Keepalive = time.Minute
+		}
+		if len(cfg.ServerID) < 10 {
+			// 认证域取 ServerID 的前 10 位
+			GB28181Plugin.Error("invalid cascade server id", zap.String("serverId", cfg.ServerID))
+			continue
+		}
+		if cfg.Realm == "" {
+			cfg.Realm = cfg.ServerID[0:10]
+		}
+		p := &Platform{
+			GB28181CascadeConfig: cfg,
+			Status:               PlatformUnregisteredStatus,
+			registerCallID:       sip.CallID(utils.RandNumString(10)),
+			Logger:               GB28181Plugin.With(zap.String("platform", cfg.ServerID)),
+		}
+		p.LocalIP = c.SipIP
+		if p.LocalIP == "" {
+			p.LocalIP = localIPFor(cfg.ServerAddr)
+		}
+		Platforms.Store(cfg.ServerID, p)
+		go p.run()
+	}
+}
+
+// localIPFor 获取访问目标地址时使用的本地ip
+func localIPFor(addr string) string {
+	if conn, err := net.Dial("udp", addr); err == nil {
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).IP.String()
+	}
+	ip, _ := utils.ResolveSelfIP()
+	return ip.String()
+}
+
+// run 维持注册和心跳，心跳连续失败 3 次后重新注册
+func (p *Platform) run() {
+	for {
+		if err := p.Register(p.Expires); err != nil {
+			p.Error("register to platform failed", zap.Error(err))
+			select {
+			case <-GB28181Plugin.Done():
+				return
+			case <-time.After(p.Keepalive):
+				continue
+			}
+		}
+		keepaliveTick := time.NewTicker(p.Keepalive)
+		refresh := time.NewTimer(p.Expires * 9 / 10)
+	loop:
+		for {
+			select {
+			case <-GB28181Plugin.Done():
+				keepaliveTick.Stop()
+				p.Register(0)
+				return
+			case <-refresh.C:
+				break loop
+			case <-keepaliveTick.C:
+				if p.Keepalive2Platform() {
+					p.keepaliveFailed = 0
+				} else if p.keepaliveFailed++; p.keepaliveFailed >= 3 {
+					p.Status = PlatformUnregisteredStatus
+					break loop
+				}
+			}
+		}
+		keepaliveTick.Stop()
+		refresh.Stop()
+	}
+}
+
+// nextSN 下一个请求序号，同时用作 CSeq 和消息体的 SN
+func (p *Platform) nextSN() uint32 {
+	return p.sn.Add(1)
+}
+
+func (p *Platform) CreateRequest(method sip.RequestMethod) (req sip.Request) {
+	sn := p.nextSN()
+
+	callId := sip.CallID(utils.RandNumString(10))
+	userAgent := sip.UserAgentHeader("Monibuca")
+	maxForwards := sip.MaxForwards(70)
+	cseq := sip.CSeq{
+		SeqNo:      sn,
+		MethodName: method,
+	}
+	port := conf.sipPort(p.Transport)
+	localAddr := sip.Address{
+		Uri: &sip.SipUri{
+			FUser: sip.String{Str: conf.Serial},
+			FHost: p.LocalIP,
+			FPort: &port,
+		},
+		Params: sip.NewParams().Add("tag", sip.String{Str: utils.RandNumString(9)}),
+	}
+	platformAddr := sip.Address{
+		Uri: &sip.SipUri{FUser: sip.String{Str: p.ServerID}, FHost: p.ServerAddr},
+	}
+	if host, portStr, err := net.SplitHostPort(p.ServerAddr); err == nil {
+		n, _ := strconv.Atoi(portStr)
+		platformPort := sip.Port(n)
+		platformAddr.Uri = &sip.SipUri{FUser: sip.String{Str: p.ServerID}, FHost: host, FPort: &platformPort}
+	}
+	to := platformAddr.AsToHeader()
+	if method == sip.REGISTER {
+		// 注册时 To 为自身地址
+		to = &sip.ToHeader{Address: localAddr.Uri}
+	}
+	req = sip.NewRequest(
+		"",
+		method,
+		platformAddr.Uri,
+		"SIP/2.0",
+		[]sip.Header{
+			localAddr.AsFromHeader(),
+			to,
+			&callId,
+			&userAgent,
+			&cseq,
+			&maxForwards,
+			localAddr.AsContactHeader(),
+		},
+		"",
+		nil,
+	)
+	if method == sip.REGISTER && conf.Version == "2022" {
+		req.AppendHeader(&sip.GenericHeader{HeaderName: HeaderGBVer, Contents: GBVersion2022})
+	}
+	req.SetTransport(p.Transport)
+	req.SetDestination(p.ServerAddr)
+	return
+}
+
+func (p *Platform) SipRequestForResponse(request sip.Request) (resp sip.Response, err error) {
+	start := time.Now()
+	defer func() { observeTransaction(request, resp, err, start) }()
+	username := p.Username
+	if username == "" {
+		username = conf.Serial
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err = GetSipServer(p.Transport).RequestWithContext(ctx, request, gosip.WithAuthorizer(&sip.DefaultAuthorizer{
+		User:     sip.String{Str: username},
+		Password: sip.String{Str: p.Password},
+	}))
+	return
+}
+
+// Register 向上级平台注册，expires 为 0 时注销
+func (p *Platform) Register(expires time.Duration) error {
+	request := p.CreateRequest(sip.REGISTER)
+	request.ReplaceHeaders(p.registerCallID.Name(), []sip.Header{&p.registerCallID})
+	expiresHeader := sip.Expires(expires / time.Second)
+	request.AppendHeader(&expiresHeader)
+	resp, err := p.SipRequestForResponse(request)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("register error, status=%d", resp.StatusCode())
+	}
+	if expires == 0 {
+		p.Status = PlatformUnregisteredStatus
+		p.Info("unregister from platform")
+	} else {
+		p.Status = PlatformRegisteredStatus
+		p.RegisterTime = time.Now()
+		p.keepaliveFailed = 0
+		p.Info("register to platform success")
+	}
+	return nil
+}
+
+func (p *Platform) Keepalive2Platform() bool {
+	request := p.CreateRequest(sip.MESSAGE)
+	contentType := sip.ContentType("Application/MANSCDP+xml")
+	request.AppendHeader(&contentType)
+	cseq, _ := request.CSeq()
+	request.SetBody(BuildKeepaliveXML(int(cseq.SeqNo), conf.Serial), true)
+	resp, err := p.SipRequestForResponse(request)
+	if err != nil || resp.StatusCode() != http.StatusOK {
+		p.Warn("keepalive to platform failed", zap.Error(err))
+		return false
+	}
+	p.LastKeepaliveAt = time.Now()
+	return true
+}
+
+// OnMessage 处理上级平台发来的查询
+func (p *Platform) OnMessage(req sip.Request, tx sip.ServerTransaction) {
+	temp, err := manscdp.Peek([]byte(req.Body()))
+	if err != nil {
+		p.Error("decode platform message err", zap.Error(err))
+	}
+	var body string
+	switch temp.CmdType {
+	case "Catalog":
+		go p.responseCatalog(temp.SN)
+	case "DeviceInfo":
+		body = encodeXML(&manscdp.DeviceInfoResponse{
+			Header:       manscdp.Header{CmdType: manscdp.CmdDeviceInfo, SN: temp.SN, DeviceID: conf.Serial},
+			DeviceName:   "Monibuca",
+			Result:       manscdp.ResultOK,
+			Manufacturer: "Monibuca",
+			Model:        "gb28181",
+			Firmware:     "v4",
+		})
+	case "DeviceStatus":
+		body = encodeXML(&manscdp.DeviceStatusResponse{
+			Header: manscdp.Header{CmdType: manscdp.CmdDeviceStatus, SN: temp.SN, DeviceID: conf.Serial},
+			Result: manscdp.ResultOK,
+			Online: "ONLINE",
+			Status: manscdp.ResultOK,
+		})
+	default:
+		p.Warn("Not supported CmdType", zap.String("CmdType", temp.CmdType), zap.String("body", req.Body()))
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusBadRequest, "", ""))
+		return
+	}
+	tx.Respond(sip.NewResponseFromRequest("", req, http.StatusOK, "OK", ""))
+	if body != "" {
+		go p.sendMessage(body)
+	}
+}
+
+func (p *Platform) sendMessage(body string) error {
+	request := p.CreateRequest(sip.MESSAGE)
+	contentType := sip.ContentType("Application/MANSCDP+xml")
+	request.AppendHeader(&contentType)
+	request.SetBody(body, true)
+	_, err := p.SipRequestForResponse(request)
+	if err != nil {
+		p.Warn("send message to platform failed", zap.Error(err))
+	}
+	return err
+}
+
+// responseCatalog 将所有设备的通道作为本平台的目录分批上报，UDP 下每条消息只携带一个通道以免超出 MTU
+func (p *Platform) responseCatalog(sn int) {
+	var items []manscdp.CatalogItem
+	Devices.Range(func(key, value any) bool {
+		value.(*Device).channelMap.Range(func(key, value any) bool {
+			c := value.(*Channel)
+			item := manscdp.CatalogItem{
+				DeviceID:     c.DeviceID,
+				Name:         c.Name,
+				Manufacturer: c.Manufacturer,
+				Model:        c.Model,
+				Owner:        c.Owner,
+				CivilCode:    c.CivilCode,
+				Address:      c.Address,
+				Parental:     c.Parental,
+				ParentID:     c.ParentID,
+				SafetyWay:    c.SafetyWay,
+				RegisterWay:  c.RegisterWay,
+				Secrecy:      c.Secrecy,
+				Port:         c.Port,
+				Status:       string(c.Status),
+				Longitude:    c.Longitude,
+				Latitude:     c.Latitude,
+			}
+			if conf.Version == "2022" {
+				item.BusinessGroupID = c.BusinessGroupID
+				item.SecurityLevelCode = c.SecurityLevelCode
+				item.Info = c.CatalogInfo
+			}
+			if item.ParentID == "" {
+				item.ParentID = conf.Serial
+			}
+			if item.Status == "" {
+				item.Status = ChannelOnStatus
+			}
+			items = append(items, item)
+			return true
+		})
+		return true
+	})
+	batch := 1
+	if strings.ToLower(p.Transport) != "udp" {
+		batch = 20
+	}
+	for start := 0; start < len(items) || start == 0; start += batch {
+		end := start + batch
+		if end > len(items) {
+			end = len(items)
+		}
+		resp := manscdp.CatalogResponse{Header: manscdp.Header{CmdType: manscdp.CmdCatalog, SN: sn, DeviceID: conf.Serial}, SumNum: len(items)}
+		resp.DeviceList.Items = items[start:end]
+		resp.DeviceList.Num = len(resp.DeviceList.Items)
+		body, err := manscdp.Encode(&resp)
+		if err != nil {
+			p.Error("encode catalog error", zap.Error(err))
+			return
+		}
+		if p.sendMessage(body) != nil {
+			return
+		}
+		if len(items) == 0 {
+			return
+		}
+	}
+}
+
+// findChannelByID 在所有设备中查找通道，上级平台点播时只携带通道 id
+func findChannelByID(channelId string) (c *Channel) {
+	Devices.Range(func(key, value any) bool {
+		if v, ok := value.(*Device).channelMap.Load(channelId); ok {
+			c = v.(*Channel)
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// CascadeSession 上级平台的一路点播，将本地流重新封装为 PS 推送到上级平台 SDP 中的地址
+type CascadeSession struct {
+	Subscriber
+	platform   *Platform
+	channel    *Channel
+	callID     string
+	streamPath string
+	remoteSDP  *SDPInfo
+	inviteOpt  *InviteOptions
+	inviteReq  sip.Request
+	inviteResp sip.Response
+	listener   net.Listener
+	conn       net.Conn // 应答前绑定的 UDP 发送端口
+	localPort  int      // 应答中的本地媒体端口，TCP 主动连接时作为源端口
+	sender     *utils.RTPSender
+	muxer      utils.PSMuxer
+	started    bool
+	byeByPeer  bool
+	stopOnce   sync.Once
+}
+
+// OnInvite 上级平台点播通道
+func (p *Platform) OnInvite(req sip.Request, tx sip.ServerTransaction) {
+	channelId := req.Recipient().User().String()
+	channel := findChannelByID(channelId)
+	if channel == nil {
+		p.Warn("platform invite channel not found", zap.String("channel", channelId))
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusNotFound, "Not Found", ""))
+		return
+	}
+	sdp := ParseSDP(req.Body())
+	if sdp.IP == "" || sdp.MediaPort == 0 {
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusBadRequest, "Bad Request", ""))
+		return
+	}
+	tx.Respond(sip.NewResponseFromRequest("", req, 100, "Trying", ""))
+
+	opt := &InviteOptions{}
+	if sdp.SessionName == "Playback" {
+		opt.Start, opt.End = int(sdp.Start), int(sdp.End)
+	}
+	streamPath := fmt.Sprintf("%s/%s", channel.Device.ID, channel.DeviceID)
+	if opt.IsLive() && channel.State.Load() == 2 {
+		// 已经在拉流，直接订阅
+	} else if code, err := channel.Invite(opt); err != nil || (code != http.StatusOK && code != 304) {
+		p.Error("invite channel for platform failed", zap.String("channel", channelId), zap.Int("code", code), zap.Error(err))
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusServiceUnavailable, "Service Unavailable", ""))
+		return
+	} else if opt.StreamPath != "" {
+		streamPath = opt.StreamPath
+	}
+
+	callID, _ := req.CallID()
+	session := &CascadeSession{
+		platform:   p,
+		channel:    channel,
+		callID:     callID.Value(),
+		streamPath: streamPath,
+		remoteSDP:  sdp,
+		inviteOpt:  opt,
+		inviteReq:  req,
+	}
+	// 应答前先确定本地端口，端口为 0 表示拒绝该媒体流（RFC 3264）
+	var err error
+	switch {
+	case sdp.TCP && sdp.Setup == "active":
+		// 上级主动连接，本地监听
+		if session.listener, err = net.Listen("tcp", ":0"); err == nil {
+			session.localPort = session.listener.Addr().(*net.TCPAddr).Port
+		}
+	case sdp.TCP:
+		// 本地主动连接，先占用一个端口，ACK 后以该端口作为源端口连接
+		var l net.Listener
+		if l, err = net.Listen("tcp", ":0"); err == nil {
+			session.localPort = l.Addr().(*net.TCPAddr).Port
+			l.Close()
+		}
+	default:
+		if session.conn, err = net.Dial("udp", net.JoinHostPort(sdp.IP, strconv.Itoa(int(sdp.MediaPort)))); err == nil {
+			session.localPort = session.conn.LocalAddr().(*net.UDPAddr).Port
+		}
+	}
+	if err != nil {
+		p.Error("bind media port for platform failed", zap.String("channel", channelId), zap.Error(err))
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusInternalServerError, "Server Internal Error", ""))
+		// 回放是为本次 INVITE 单独建立的会话，需要挂断，避免占用设备的会话和媒体端口
+		if !opt.IsLive() && opt.StreamPath != "" {
+			channel.Bye(opt.StreamPath)
+		}
+		return
+	}
+
+	mediaIP := conf.MediaIP
+	if mediaIP == "" {
+		mediaIP = p.LocalIP
+	}
+	protocol := ""
+	if sdp.TCP {
+		protocol = "TCP/"
+	}
+	sdpInfo := []string{
+		"v=0",
+		fmt.Sprintf("o=%s 0 0 IN IP4 %s", channelId, mediaIP),
+		"s=" + sdp.SessionName,
+		"c=IN IP4 " + mediaIP,
+		fmt.Sprintf("t=%d %d", sdp.Start, sdp.End),
+		fmt.Sprintf("m=video %d %sRTP/AVP 96", session.localPort, protocol),
+		"a=sendonly",
+		"a=rtpmap:96 PS/90000",
+	}
+	if sdp.TCP {
+		if sdp.Setup == "active" {
+			sdpInfo = append(sdpInfo, "a=setup:passive")
+		} else {
+			sdpInfo = append(sdpInfo, "a=setup:active")
+		}
+		sdpInfo = append(sdpInfo, "a=connection:new")
+	}
+	sdpInfo = append(sdpInfo, "y="+sdp.SSRC)
+	resp := sip.NewResponseFromRequest("", req, http.StatusOK, "OK", strings.Join(sdpInfo, "\r\n")+"\r\n")
+	to, _ := resp.To()
+	resp.ReplaceHeaders("To", []sip.Header{&sip.ToHeader{Address: to.Address, Params: sip.NewParams().Add("tag", sip.String{Str: utils.RandNumString(9)})}})
+	contentType := sip.ContentType("application/sdp")
+	resp.AppendHeader(&contentType)
+	port := conf.sipPort(req.Transport())
+	resp.AppendHeader(&sip.ContactHeader{Address: &sip.SipUri{FUser: sip.String{Str: conf.Serial}, FHost: p.LocalIP, FPort: &port}})
+	session.inviteResp = resp
+	CascadeSessions.Store(session.callID, session)
+	if err := tx.Respond(resp); err != nil {
+		CascadeSessions.Delete(session.callID)
+		session.close()
+	}
+}
+
+// OnAck 上级平台确认后开始推流
+func (s *CascadeSession) OnAck() {
+	if s.started {
+		return
+	}
+	s.started = true
+	go func() {
+		if err := s.connect(); err != nil {
+			s.platform.Error("cascade media connect failed", zap.String("stream", s.streamPath), zap.Error(err))
+			s.Hangup()
+			return
+		}
+		if err := GB28181Plugin.Subscribe(s.streamPath, s); err != nil {
+			s.platform.Error("cascade subscribe failed", zap.String("stream", s.streamPath), zap.Error(err))
+			s.Hangup()
+			return
+		}
+		s.PlayRaw()
+		s.Hangup()
+	}()
+}
+
+func (s *CascadeSession) connect() (err error) {
+	var conn net.Conn
+	remote := net.JoinHostPort(s.remoteSDP.IP, strconv.Itoa(int(s.remoteSDP.MediaPort)))
+	switch {
+	case s.listener != nil:
+		s.listener.(*net.TCPListener).SetDeadline(time.Now().Add(10 * time.Second))
+		conn, err = s.listener.Accept()
+		s.listener.Close()
+	case s.remoteSDP.TCP:
+		dialer := net.Dialer{Timeout: 10 * time.Second, LocalAddr: &net.TCPAddr{Port: s.localPort}}
+		conn, err = dialer.Dial("tcp", remote)
+	default:
+		conn = s.conn
+	}
+	if err != nil {
+		return
+	}
+	s.sender = utils.NewRTPSender(conn, s.remoteSDP.TCP, s.remoteSDP.SSRCValue(), 96)
+	return
+}
+
+func (s *CascadeSession) OnEvent(event any) {
+	switch v := event.(type) {
+	case VideoFrame:
+		if s.muxer.VideoType == 0 {
+			if v.CodecID == codec.CodecID_H265 {
+				s.muxer.VideoType = utils.PSStreamTypeH265
+			} else {
+				s.muxer.VideoType = utils.PSStreamTypeH264
+			}
+		}
+		var frame []byte
+		for _, b := range v.GetAnnexB() {
+			frame = append(frame, b...)
+		}
+		if err := s.sender.Send(s.muxer.MuxVideo(frame, v.IFrame, v.PTS, v.DTS), v.PTS); err != nil {
+			s.Subscriber.Stop()
+		}
+	case AudioFrame:
+		switch v.CodecID {
+		case codec.CodecID_PCMA:
+			s.muxer.AudioType = utils.PSStreamTypeG711A
+		case codec.CodecID_PCMU:
+			s.muxer.AudioType = utils.PSStreamTypeG711U
+		default:
+			return
+		}
+		if s.muxer.VideoType == 0 {
+			return
+		}
+		if err := s.sender.Send(s.muxer.MuxAudio(v.AUList.ToBytes(), v.PTS, false), v.PTS); err != nil {
+			s.Subscriber.Stop()
+		}
+	default:
+		s.Subscriber.OnEvent(event)
+	}
+}
+
+// Hangup 结束会话，非上级平台主动挂断时向其发送 BYE
+func (s *CascadeSession) Hangup() {
+	s.stopOnce.Do(func() {
+		CascadeSessions.Delete(s.callID)
+		if !s.byeByPeer {
+			s.bye()
+		}
+		s.close()
+	})
+}
+
+func (s *CascadeSession) close() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.sender != nil {
+		s.sender.Close()
+	} else if s.conn != nil {
+		s.conn.Close()
+	}
+	if s.Subscriber.Stream != nil {
+		s.Subscriber.Stop()
+	}
+	// 回放流只为上级点播而拉取，需一并结束
+	if !s.inviteOpt.IsLive() && s.inviteOpt.StreamPath != "" {
+		s.channel.Bye(s.inviteOpt.StreamPath)
+	}
+	s.platform.Info("cascade session closed", zap.String("stream", s.streamPath))
+}
+
+func (s *CascadeSession) bye() {
+	req := CreateByeRequest(s.inviteReq, s.inviteResp, s.platform.nextSN())
+	if _, err := s.platform.SipRequestForResponse(req); err != nil {
+		s.platform.Warn("bye to platform failed", zap.Error(err))
+	}
+}
+
+func (c *GB28181Config) API_cascade_list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("interval") == "" {
+		query.Set("interval", "5s")
+	}
+	util.ReturnFetchValue(func() (list []*Platform) {
+		list = make([]*Platform, 0)
+		Platforms.Range(func(key, value any) bool {
+			list = append(list, value.(*Platform))
+			return true
+		})
+		return
+	}, w, r)
+}
@@ -0,0 +1,193 @@
+package gb28181
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+var CATALOG_SYNC_TIMEOUT = time.Minute
+
+// 目录同步的状态
+const (
+	CatalogSyncing  = "SYNCING"
+	CatalogComplete = "COMPLETE"
+	CatalogTimeout  = "TIMEOUT" // 超时未收齐 SumNum 条目，不删除通道
+	CatalogFailed   = "FAILED"  // Catalog 查询发送失败
+)
+
+// CatalogSync 一次目录查询，设备按 SumNum 分多条 MESSAGE 返回
+type CatalogSync struct {
+	SN         int
+	Status     string
+	SumNum     int
+	Received   int // 已收到的不重复条目数
+	Pruned     int // 同步完成后删除的通道数
+	StartTime  time.Time
+	FinishTime time.Time `json:",omitempty"`
+	Error      string    `json:",omitempty"`
+	seen       map[string]struct{}
+	timer      *time.Timer
+}
+
+type catalogSyncState struct {
+	job *CatalogSync
+	sync.Mutex
+}
+
+// startCatalogSync 发送 Catalog 查询前调用，新的查询会替代未完成的查询
+func (d *Device) startCatalogSync(sn int) *CatalogSync {
+	d.catalogSync.Lock()
+	defer d.catalogSync.Unlock()
+	if old := d.catalogSync.job; old != nil && old.timer != nil {
+		old.timer.Stop()
+	}
+	job := &CatalogSync{SN: sn, Status: CatalogSyncing, StartTime: time.Now(), seen: make(map[string]struct{})}
+	job.timer = time.AfterFunc(CATALOG_SYNC_TIMEOUT, func() {
+		d.finishCatalogSync(job, CatalogTimeout, nil)
+	})
+	d.catalogSync.job = job
+	return job
+}
+
+// finishCatalogSync 结束一次同步，状态已结束时不再改变
+func (d *Device) finishCatalogSync(job *CatalogSync, status string, err error) {
+	d.catalogSync.Lock()
+	defer d.catalogSync.Unlock()
+	if job.Status != CatalogSyncing {
+		return
+	}
+	job.Status = status
+	job.FinishTime = time.Now()
+	job.timer.Stop()
+	if err != nil {
+		job.Error = err.Error()
+	}
+	if status == CatalogTimeout {
+		d.Warn("catalog sync timeout", zap.Int("sumNum", job.SumNum), zap.Int("received", job.Received))
+	}
+}
+
+// onCatalog 处理设备返回的一条目录消息，收齐 SumNum 条目后删除本次同步中未出现的通道
+func (d *Device) onCatalog(sn, sumNum int, list []ChannelInfo) {
+	d.UpdateChannels(list...)
+	d.catalogSync.Lock()
+	job := d.catalogSync.job
+	if job == nil || job.Status != CatalogSyncing || job.SN != sn {
+		// 设备主动上报或已结束的同步，只更新通道
+		d.catalogSync.Unlock()
+		return
+	}
+	job.SumNum = sumNum
+	for _, c := range list {
+		job.seen[c.DeviceID] = struct{}{}
+	}
+	job.Received = len(job.seen)
+	complete := job.Received >= job.SumNum
+	if complete {
+		job.Status = CatalogComplete
+		job.FinishTime = time.Now()
+		job.timer.Stop()
+	}
+	d.catalogSync.Unlock()
+	if !complete || sumNum == 0 {
+		// SumNum 为 0 时可能是设备异常，不删除通道
+		return
+	}
+	var stale []string
+	d.channelMap.Range(func(key, value any) bool {
+		// 其他设备挂到本设备下的通道不在本设备的目录中，不能删除；从存储恢复后未再上报的通道视为本设备的
+		if r := value.(*Channel).reporter; r != "" && r != d.ID {
+			return true
+		}
+		if _, ok := job.seen[key.(string)]; !ok {
+			// 正在拉流、语音或下载的通道删除后无法再挂断，等会话结束后的下一次同步再删除
+			if value.(*Channel).hasActiveSession() {
+				d.Info("catalog sync skip active channel", zap.String("channel", key.(string)))
+				return true
+			}
+			stale = append(stale, key.(string))
+		}
+		return true
+	})
+	for _, id := range stale {
+		d.deleteChannel(id)
+	}
+	d.catalogSync.Lock()
+	job.Pruned = len(stale)
+	d.catalogSync.Unlock()
+	d.Info("catalog sync complete", zap.Int("sumNum", sumNum), zap.Int("pruned", len(stale)), zap.Duration("cost", job.FinishTime.Sub(job.StartTime)))
+}
+
+// hasActiveSession 通道是否有进行中的实时流、回放、录像下载或语音会话
+func (channel *Channel) hasActiveSession() bool {
+	if channel.State.Load() != 0 {
+		return true
+	}
+	if _, ok := AudioSessions.Load(audioSessionKey(channel)); ok {
+		return true
+	}
+	// 回放和录像下载都保存在 PullStreams 中
+	active := false
+	PullStreams.Range(func(key, value any) bool {
+		active = value.(*PullStream).channel == channel
+		return !active
+	})
+	return active
+}
+
+// CatalogSyncStatus 最近一次目录同步的状态，从未同步时返回 nil
+func (d *Device) CatalogSyncStatus() *CatalogSync {
+	d.catalogSync.Lock()
+	defer d.catalogSync.Unlock()
+	if d.catalogSync.job == nil {
+		return nil
+	}
+	copied := *d.catalogSync.job
+	return &copied
+}
+
+func (c *GB28181Config) API_catalog_refresh(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if v, ok := Devices.Load(id); ok {
+		d := v.(*Device)
+		if code := d.Catalog(); code != http.StatusOK {
+			util.ReturnError(util.APIErrorInternal, fmt.Sprintf("catalog query failed, status=%d", code), w, r)
+			return
+		}
+		util.ReturnValue(d.CatalogSyncStatus(), w, r)
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q  not found", id), w, r)
+	}
+}
+
+func (c *GB28181Config) API_catalog_status(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id != "" {
+		if v, ok := Devices.Load(id); ok {
+			util.ReturnValue(v.(*Device).CatalogSyncStatus(), w, r)
+		} else {
+			util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q  not found", id), w, r)
+		}
+		return
+	}
+	type deviceCatalogSync struct {
+		DeviceID string
+		*CatalogSync
+	}
+	list := make([]deviceCatalogSync, 0)
+	Devices.Range(func(key, value any) bool {
+		d := value.(*Device)
+		list = append(list, deviceCatalogSync{d.ID, d.CatalogSyncStatus()})
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].DeviceID < list[j].DeviceID
+	})
+	util.ReturnValue(list, w, r)
+}
@@ -2,6 +2,7 @@ package gb28181
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -14,6 +15,7 @@ import (
 	"go.uber.org/zap"
 	. "m7s.live/engine/v4"
 	"m7s.live/engine/v4/log"
+	"m7s.live/plugin/gb28181/v4/manscdp"
 	"m7s.live/plugin/gb28181/v4/utils"
 	"m7s.live/plugin/ps/v4"
 )
@@ -24,6 +26,7 @@ type PullStream struct {
 	opt       *InviteOptions
 	channel   *Channel
 	inviteRes sip.Response
+	relay     *tcpActiveRelay // TCP 主动模式下连接设备的媒体连接
 }
 
 func (p *PullStream) CreateRequest(method sip.RequestMethod) (req sip.Request) {
@@ -42,12 +45,16 @@ func (p *PullStream) CreateRequest(method sip.RequestMethod) (req sip.Request) {
 func (p *PullStream) Bye() int {
 	req := p.CreateRequest(sip.BYE)
 	resp, err := p.channel.Device.SipRequestForResponse(req)
+	if p.relay != nil {
+		p.relay.Close()
+	}
 	if p.opt.IsLive() {
 		p.channel.State.Store(0)
 	}
 	if p.opt.recyclePort != nil {
 		p.opt.recyclePort(p.opt.MediaPort)
 	}
+	hook(WebhookStreamBye, p.channel.Device.ID, p.channel.DeviceID, &webhookInvite{StreamPath: p.opt.StreamPath, Transport: p.opt.MediaTransport()})
 	if err != nil {
 		return http.StatusInternalServerError
 	}
@@ -74,7 +81,7 @@ func (p *PullStream) Pause() int {
 	body := fmt.Sprintf(`PAUSE RTSP/1.0
 CSeq: %d
 PauseTime: now
-`, p.channel.Device.SN)
+`, p.channel.Device.nextSN())
 	return p.info(body)
 }
 
@@ -84,7 +91,7 @@ func (p *PullStream) Resume() int {
 	body := fmt.Sprintf(`PLAY RTSP/1.0
 CSeq: %d
 Range: npt=now-
-`, d.SN)
+`, d.nextSN())
 	return p.info(body)
 }
 
@@ -95,7 +102,7 @@ func (p *PullStream) PlayAt(second uint) int {
 	body := fmt.Sprintf(`PLAY RTSP/1.0
 CSeq: %d
 Range: npt=%d-
-`, d.SN, second)
+`, d.nextSN(), second)
 	return p.info(body)
 }
 
@@ -106,26 +113,27 @@ func (p *PullStream) PlayForward(speed float32) int {
 	body := fmt.Sprintf(`PLAY RTSP/1.0
 CSeq: %d
 Scale: %0.6f
-`, d.SN, speed)
+`, d.nextSN(), speed)
 	return p.info(body)
 }
 
 type Channel struct {
-	Device      *Device      `json:"-" yaml:"-"` // 所属设备
-	State       atomic.Int32 `json:"-" yaml:"-"` // 通道状态,0:空闲,1:正在invite,2:正在播放/对讲
-	LiveSubSP   string       // 实时子码流，通过rtsp
-	GpsTime     time.Time    // gps时间
-	Longitude   string       // 经度
-	Latitude    string       // 纬度
-	*log.Logger `json:"-" yaml:"-"`
+	Device        *Device      `json:"-" yaml:"-"` // 所属设备
+	State         atomic.Int32 `json:"-" yaml:"-"` // 通道状态,0:空闲,1:正在invite,2:正在播放/对讲
+	LiveSubSP     string       // 实时子码流，通过rtsp
+	Faulty        bool         // 2022 版设备在心跳中上报该通道故障
+	GpsTime       time.Time    // gps时间
+	Longitude     string       // 经度
+	Latitude      string       // 纬度
+	PTZPosition   *PTZPosition // 最近一次查询或订阅上报的 PTZ 精准状态
+	*log.Logger   `json:"-" yaml:"-"`
+	presets       presetCache     // 最近一次查询到的预置位列表
+	ptzSubscriber ptzSubscription // PTZ 精准状态订阅
+	ptzLock       ptzLock         // WebSocket 云台控制的操作员
+	reporter      string          // 上报该通道的设备，下级设备挂到本设备的通道为下级设备的 ID
 	ChannelInfo
 }
 
-type PresetInfo struct {
-	PresetID   int    `json:"-" yaml:"-"` //
-	PresetName string `json:"-" yaml:"-"` //
-}
-
 func (c *Channel) MarshalJSON() ([]byte, error) {
 	m := map[string]any{
 		"DeviceID":     c.DeviceID,
@@ -147,6 +155,19 @@ func (c *Channel) MarshalJSON() ([]byte, error) {
 		"GpsTime":      c.GpsTime,
 		"LiveSubSP":    c.LiveSubSP,
 		"LiveStatus":   c.State.Load(),
+		"Faulty":       c.Faulty,
+	}
+	if c.BusinessGroupID != "" {
+		m["BusinessGroupID"] = c.BusinessGroupID
+	}
+	if c.SecurityLevelCode != "" {
+		m["SecurityLevelCode"] = c.SecurityLevelCode
+	}
+	if c.CatalogInfo != nil {
+		m["CatalogInfo"] = c.CatalogInfo
+	}
+	if c.PTZPosition != nil {
+		m["PTZPosition"] = c.PTZPosition
 	}
 	return json.Marshal(m)
 }
@@ -167,6 +188,10 @@ type ChannelInfo struct {
 	RegisterWay  int
 	Secrecy      int
 	Status       ChannelStatus
+	// 2022 新增
+	BusinessGroupID   string               `json:",omitempty"`
+	SecurityLevelCode string               `json:",omitempty"`
+	CatalogInfo       *manscdp.CatalogInfo `xml:"Info" json:",omitempty"` // 目录项的扩展信息
 }
 
 type ChannelStatus string
@@ -178,16 +203,16 @@ const (
 
 func (channel *Channel) CreateRequst(Method sip.RequestMethod) (req sip.Request) {
 	d := channel.Device
-	d.SN++
+	sn := d.nextSN()
 
 	callId := sip.CallID(utils.RandNumString(10))
 	userAgent := sip.UserAgentHeader("Monibuca")
 	maxForwards := sip.MaxForwards(70) //增加max-forwards为默认值 70
 	cseq := sip.CSeq{
-		SeqNo:      uint32(d.SN),
+		SeqNo:      sn,
 		MethodName: Method,
 	}
-	port := sip.Port(conf.SipPort)
+	port := conf.sipPort(d.transport())
 	serverAddr := sip.Address{
 		//DisplayName: sip.String{Str: d.serverConfig.Serial},
 		Uri: &sip.SipUri{
@@ -231,64 +256,12 @@ func (channel *Channel) CreateRequst(Method sip.RequestMethod) (req sip.Request)
 		nil,
 	)
 
-	req.SetTransport(conf.SipNetwork)
+	d.appendGBVer(req)
+	req.SetTransport(d.transport())
 	req.SetDestination(d.NetAddr)
 	return req
 }
 
-func (channel *Channel) QueryRecord(startTime, endTime string) ([]*Record, error) {
-	d := channel.Device
-	request := d.CreateRequest(sip.MESSAGE)
-	contentType := sip.ContentType("Application/MANSCDP+xml")
-	request.AppendHeader(&contentType)
-	// body := fmt.Sprintf(`<?xml version="1.0"?>
-	// 	<Query>
-	// 	<CmdType>RecordInfo</CmdType>
-	// 	<SN>%d</SN>
-	// 	<DeviceID>%s</DeviceID>
-	// 	<StartTime>%s</StartTime>
-	// 	<EndTime>%s</EndTime>
-	// 	<Secrecy>0</Secrecy>
-	// 	<Type>all</Type>
-	// 	</Query>`, d.sn, channel.DeviceID, startTime, endTime)
-	start, _ := strconv.ParseInt(startTime, 10, 0)
-	end, _ := strconv.ParseInt(endTime, 10, 0)
-	body := BuildRecordInfoXML(d.SN, channel.DeviceID, start, end)
-	request.SetBody(body, true)
-
-	resultCh := RecordQueryLink.WaitResult(d.ID, channel.DeviceID, d.SN, QUERY_RECORD_TIMEOUT)
-	resp, err := d.SipRequestForResponse(request)
-	if err != nil {
-		return nil, fmt.Errorf("query error: %s", err)
-	}
-	if resp.StatusCode() != http.StatusOK {
-		return nil, fmt.Errorf("query error, status=%d", resp.StatusCode())
-	}
-	// RecordQueryLink 中加了超时机制，该结果一定会返回
-	// 所以此处不用再增加超时等保护机制
-	r := <-resultCh
-	return r.list, r.err
-}
-
-func (channel *Channel) QueryPresetList() (sip.Response, error) {
-	d := channel.Device
-	request := d.CreateRequest(sip.MESSAGE)
-	contentType := sip.ContentType("Application/MANSCDP+xml")
-	request.AppendHeader(&contentType)
-
-	body := BuildPresetListXML(100, channel.DeviceID)
-	request.SetBody(body, true)
-
-	resp, err := d.SipRequestForResponse(request)
-	if err != nil {
-		return nil, fmt.Errorf("query error: %s", err)
-	}
-	if resp.StatusCode() != http.StatusOK {
-		return nil, fmt.Errorf("query error, status=%d", resp.StatusCode())
-	}
-	return resp, nil
-}
-
 func (channel *Channel) PresetControl(ptzCode int, point byte) int {
 	cmd := byte(PresetSet)
 	switch ptzCode {
@@ -302,27 +275,16 @@ func (channel *Channel) PresetControl(ptzCode int, point byte) int {
 
 	}
 	PTZCmd := Pack(cmd, point)
+	if cmd != PresetCall {
+		// 新增、删除预置位后缓存的列表不再准确
+		defer channel.presets.invalidate()
+	}
 	return channel.Control(PTZCmd)
 }
 
 func (channel *Channel) Control(PTZCmd string) int {
-	d := channel.Device
-	request := d.CreateRequest(sip.MESSAGE)
-	contentType := sip.ContentType("Application/MANSCDP+xml")
-	request.AppendHeader(&contentType)
-	body := fmt.Sprintf(`<?xml version="1.0"?>
-		<Control>
-		<CmdType>DeviceControl</CmdType>
-		<SN>%d</SN>
-		<DeviceID>%s</DeviceID>
-		<PTZCmd>%s</PTZCmd>
-		</Control>`, d.SN, channel.DeviceID, PTZCmd)
-	request.SetBody(body, true)
-	resp, err := d.SipRequestForResponse(request)
-	if err != nil {
-		return http.StatusRequestTimeout
-	}
-	return int(resp.StatusCode())
+	code, _ := channel.Device.DeviceControl(channel.DeviceID, &manscdp.DeviceControl{PTZCmd: PTZCmd}, false)
+	return code
 }
 
 // Invite 发送Invite报文 invites a channel to play
@@ -373,6 +335,22 @@ f字段中视、音频参数段之间不需空格分割。
 */
 
 func (channel *Channel) Invite(opt *InviteOptions) (code int, err error) {
+	defer func() {
+		if code == 304 {
+			return
+		}
+		info := &webhookInvite{StreamPath: opt.StreamPath, Transport: opt.MediaTransport(), Code: code}
+		if err == nil && code == http.StatusOK {
+			metrics.invites.Inc("success")
+			hook(WebhookInviteSuccess, channel.Device.ID, channel.DeviceID, info)
+		} else {
+			metrics.invites.Inc("failure")
+			if err != nil {
+				info.Error = err.Error()
+			}
+			hook(WebhookInviteFailure, channel.Device.ID, channel.DeviceID, info)
+		}
+	}()
 	if opt.IsLive() {
 		if !channel.State.CompareAndSwap(0, 1) {
 			return 304, nil
@@ -395,10 +373,11 @@ func (channel *Channel) Invite(opt *InviteOptions) (code int, err error) {
 
 	d := channel.Device
 	streamPath := fmt.Sprintf("%s/%s", d.ID, channel.DeviceID)
-	s := "Play"
+	s := opt.SessionName()
 	opt.CreateSSRC()
-	if opt.Record() {
-		s = "Playback"
+	if opt.Download {
+		streamPath = fmt.Sprintf("%s/%s/download/%d-%d", d.ID, channel.DeviceID, opt.Start, opt.End)
+	} else if opt.Record() {
 		streamPath = fmt.Sprintf("%s/%s/%d-%d", d.ID, channel.DeviceID, opt.Start, opt.End)
 	}
 	if opt.StreamPath != "" {
@@ -413,11 +392,12 @@ func (channel *Channel) Invite(opt *InviteOptions) (code int, err error) {
 	}
 	protocol := ""
 	networkType := "udp"
+	transport := opt.MediaTransport()
 
 	// 根据配置文件判断是否多路复用
 	reusePort := conf.Port.Fdm
 
-	if conf.IsMediaNetworkTCP() {
+	if transport != MediaTransportUDP {
 		networkType = "tcp"
 		protocol = "TCP/"
 		if conf.tcpPorts.Valid {
@@ -450,8 +430,14 @@ func (channel *Channel) Invite(opt *InviteOptions) (code int, err error) {
 		"a=recvonly",
 		"a=rtpmap:96 PS/90000",
 	}
-	if conf.IsMediaNetworkTCP() {
+	if opt.Download && opt.DownloadSpeed > 0 {
+		sdpInfo = append(sdpInfo, fmt.Sprintf("a=downloadspeed:%d", opt.DownloadSpeed))
+	}
+	switch transport {
+	case MediaTransportTCPPassive:
 		sdpInfo = append(sdpInfo, "a=setup:passive", "a=connection:new")
+	case MediaTransportTCPActive:
+		sdpInfo = append(sdpInfo, "a=setup:active", "a=connection:new")
 	}
 	sdpInfo = append(sdpInfo, "y="+opt.ssrc)
 	invite := channel.CreateRequst(sip.INVITE)
@@ -517,12 +503,28 @@ func (channel *Channel) Invite(opt *InviteOptions) (code int, err error) {
 				psPuber.Stream.IdleTimeout = time.Second * 10
 			}
 		}
-		PullStreams.Store(streamPath, &PullStream{
+		pull := &PullStream{
 			opt:       opt,
 			channel:   channel,
 			inviteRes: inviteRes,
-		})
+		}
+		PullStreams.Store(streamPath, pull)
 		err = srv.Send(sip.NewAckRequest("", invite, inviteRes, "", nil))
+		if err == nil && transport == MediaTransportTCPActive && networkType == "tcp" {
+			// 设备作为 TCP 服务端，由本服务连接应答中的媒体地址
+			answer := ParseSDP(inviteRes.Body())
+			host := answer.IP
+			if host == "" {
+				host = d.NetAddr[:strings.LastIndex(d.NetAddr, ":")]
+			}
+			remote := net.JoinHostPort(host, strconv.Itoa(int(answer.MediaPort)))
+			if pull.relay, err = dialTCPActive(remote, opt.MediaPort); err != nil {
+				channel.Error("tcp active connect failed", zap.String("remote", remote), zap.Error(err))
+				PullStreams.Delete(streamPath)
+				pull.Bye()
+				return http.StatusInternalServerError, err
+			}
+		}
 	} else {
 		if opt.recyclePort != nil {
 			opt.recyclePort(opt.MediaPort)
@@ -598,7 +600,7 @@ func (channel *Channel) TryAutoInvite(opt *InviteOptions) {
 }
 
 func (channel *Channel) CanInvite() bool {
-	if channel.State.Load() != 0 || len(channel.DeviceID) != 20 || channel.Status == ChannelOffStatus {
+	if channel.State.Load() != 0 || len(channel.DeviceID) != 20 || channel.Status == ChannelOffStatus || channel.IsDirectory() {
 		return false
 	}
 
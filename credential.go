@@ -0,0 +1,240 @@
+package gb28181
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+var ErrDeviceDisabled = errors.New("device disabled")
+
+// DeviceCredential 设备注册使用的账号密码
+type DeviceCredential struct {
+	DeviceID   string
+	Username   string // 设备以自身 ID 作为用户名时也能通过认证
+	Password   string
+	Disabled   bool // 禁止该设备注册
+	UpdateTime time.Time
+}
+
+// DeviceAuthenticator 设备注册认证器，可由其他插件注册，例如从自有数据库中查询设备的账号密码
+// Credential 返回 nil, nil 时交由下一个认证器处理，返回 ErrDeviceDisabled 或 Disabled 的认证信息时拒绝注册
+type DeviceAuthenticator interface {
+	Credential(deviceId, realm string) (*DeviceCredential, error)
+}
+
+// AuthenticatorFunc 以函数实现 DeviceAuthenticator
+type AuthenticatorFunc func(deviceId, realm string) (*DeviceCredential, error)
+
+func (f AuthenticatorFunc) Credential(deviceId, realm string) (*DeviceCredential, error) {
+	return f(deviceId, realm)
+}
+
+var authenticators struct {
+	list []DeviceAuthenticator
+	sync.RWMutex
+}
+
+// RegisterAuthenticator 注册设备认证器，按注册顺序在内置的设备账号之前查询
+func RegisterAuthenticator(a DeviceAuthenticator) {
+	authenticators.Lock()
+	defer authenticators.Unlock()
+	authenticators.list = append(authenticators.list, a)
+}
+
+// deviceCredential 依次查询注册的认证器、内置的设备账号，都没有时使用认证域的账号密码
+func (c *GB28181Config) deviceCredential(id string) (*realmCredential, error) {
+	realm := c.deviceRealm(id)
+	authenticators.RLock()
+	list := append(append([]DeviceAuthenticator{}, authenticators.list...), &Credentials)
+	authenticators.RUnlock()
+	for _, a := range list {
+		cred, err := a.Credential(id, realm.Realm)
+		if err != nil {
+			return nil, err
+		}
+		if cred != nil {
+			if cred.Disabled {
+				return nil, ErrDeviceDisabled
+			}
+			// 只设置了启用状态的账号使用认证域的用户名和密码，不能因此跳过认证
+			if cred.Username != "" {
+				realm.Username = cred.Username
+			}
+			if cred.Password != "" {
+				realm.Password = cred.Password
+			}
+			break
+		}
+	}
+	return realm, nil
+}
+
+// Credentials 内置的设备账号，通过 API 管理并保存在 Auth.CredentialPath 文件中
+var Credentials credentialStore
+
+type credentialStore struct {
+	path string
+	m    map[string]*DeviceCredential
+	sync.RWMutex
+}
+
+func (s *credentialStore) Credential(deviceId, realm string) (*DeviceCredential, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if cred, ok := s.m[deviceId]; ok {
+		copied := *cred
+		return &copied, nil
+	}
+	return nil, nil
+}
+
+// load 读取保存的设备账号
+func (s *credentialStore) load(path string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.path = path
+	s.m = make(map[string]*DeviceCredential)
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var list []*DeviceCredential
+	if err = json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	for _, cred := range list {
+		s.m[cred.DeviceID] = cred
+	}
+	return nil
+}
+
+func (s *credentialStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.list(false), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// list 按设备 ID 排序，mask 为 true 时隐藏密码
+func (s *credentialStore) list(mask bool) []*DeviceCredential {
+	list := make([]*DeviceCredential, 0, len(s.m))
+	for _, cred := range s.m {
+		copied := *cred
+		if mask && copied.Password != "" {
+			copied.Password = "******"
+		}
+		list = append(list, &copied)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].DeviceID < list[j].DeviceID
+	})
+	return list
+}
+
+// Set 添加或修改设备账号
+func (s *credentialStore) Set(cred DeviceCredential) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.m == nil {
+		s.m = make(map[string]*DeviceCredential)
+	}
+	cred.UpdateTime = time.Now()
+	s.m[cred.DeviceID] = &cred
+	return s.save()
+}
+
+// Get 查询设备账号
+func (s *credentialStore) Get(deviceId string) (cred DeviceCredential, ok bool) {
+	s.RLock()
+	defer s.RUnlock()
+	if v, found := s.m[deviceId]; found {
+		return *v, true
+	}
+	return
+}
+
+// Delete 删除设备账号，之后该设备使用认证域的账号密码
+func (s *credentialStore) Delete(deviceId string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.m[deviceId]; !ok {
+		return false, nil
+	}
+	delete(s.m, deviceId)
+	return true, s.save()
+}
+
+// kickDevice 设备被禁用后立即移除，设备重新注册时将被拒绝
+func kickDevice(id string) {
+	DeviceNonce.Delete(id)
+	if _, ok := Devices.LoadAndDelete(id); ok {
+		saver.markDeleted(id)
+		GB28181Plugin.Info("Device disabled", zap.String("id", id))
+	}
+}
+
+func (c *GB28181Config) API_credential_list(w http.ResponseWriter, r *http.Request) {
+	Credentials.RLock()
+	defer Credentials.RUnlock()
+	util.ReturnValue(Credentials.list(true), w, r)
+}
+
+func (c *GB28181Config) API_credential_set(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	if len(id) != 20 {
+		util.ReturnError(util.APIErrorQueryParse, fmt.Sprintf("wrong device id %q", id), w, r)
+		return
+	}
+	// 只修改传入的参数
+	cred, _ := Credentials.Get(id)
+	cred.DeviceID = id
+	if query.Has("username") {
+		cred.Username = query.Get("username")
+	}
+	if query.Has("password") {
+		cred.Password = query.Get("password")
+	}
+	if query.Has("disabled") {
+		cred.Disabled = query.Get("disabled") == "1" || query.Get("disabled") == "true"
+	}
+	if err := Credentials.Set(cred); err != nil {
+		util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+		return
+	}
+	if cred.Disabled {
+		kickDevice(id)
+	}
+	DeviceRegisterCount.Delete(id)
+	util.ReturnOK(w, r)
+}
+
+func (c *GB28181Config) API_credential_delete(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if ok, err := Credentials.Delete(id); err != nil {
+		util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+	} else if !ok {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("credential %q not found", id), w, r)
+	} else {
+		util.ReturnOK(w, r)
+	}
+}
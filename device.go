@@ -5,14 +5,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
+	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
 	"m7s.live/engine/v4"
 	"m7s.live/engine/v4/log"
+	"m7s.live/plugin/gb28181/v4/manscdp"
 	"m7s.live/plugin/gb28181/v4/utils"
 
 	"github.com/ghettovoice/gosip/sip"
@@ -21,6 +23,8 @@ import (
 
 const TIME_LAYOUT = "2006-01-02T15:04:05"
 
+var QUERY_DEVICE_INFO_TIMEOUT = time.Second * 10
+
 // Record 录像
 type Record struct {
 	DeviceID  string
@@ -31,6 +35,9 @@ type Record struct {
 	EndTime   string
 	Secrecy   int
 	Type      string
+	// 录像触发者 ID 和文件大小，部分设备会返回
+	RecorderID string `json:",omitempty"`
+	FileSize   string `json:",omitempty"`
 }
 
 func (r *Record) GetPublishStreamPath() string {
@@ -63,29 +70,41 @@ type Device struct {
 	UpdateTime      time.Time
 	LastKeepaliveAt time.Time
 	Status          DeviceStatus
-	SN              int
-	Addr            sip.Address `json:"-" yaml:"-"`
-	SipIP           string      //设备对应网卡的服务器ip
-	MediaIP         string      //设备对应网卡的服务器ip
+	sn              atomic.Uint32 //请求序号，查询、控制和订阅可能在不同协程中同时发送
+	Addr            sip.Address   `json:"-" yaml:"-"`
+	SipIP           string        //设备对应网卡的服务器ip
+	MediaIP         string        //设备对应网卡的服务器ip
 	NetAddr         string
+	Transport       string //设备注册时使用的信令传输协议，UDP、TCP、TLS
+	GBVersion       string //协商的协议版本（X-GB-Ver），2.0 为 2016 版，3.0 为 2022 版
 	channelMap      sync.Map
 	subscriber      struct {
 		CallID  string
 		Timeout time.Time
 	}
-	lastSyncTime time.Time
-	GpsTime      time.Time //gps时间
-	Longitude    string    //经度
-	Latitude     string    //纬度
-	*log.Logger  `json:"-" yaml:"-"`
+	alarmSubscriber struct {
+		CallID  string
+		Timeout time.Time
+	}
+	alarms          alarmHistory
+	catalogSync     catalogSyncState  //最近一次目录同步
+	StatusInfo      *DeviceStatusInfo //最近一次的设备状态查询结果
+	lastStatusQuery time.Time
+	lastSyncTime    time.Time
+	GpsTime         time.Time //gps时间
+	Longitude       string    //经度
+	Latitude        string    //纬度
+	*log.Logger     `json:"-" yaml:"-"`
 }
 
 func (d *Device) MarshalJSON() ([]byte, error) {
 	type Alias Device
 	data := &struct {
 		Channels []*Channel
+		SN       uint32
 		*Alias
 	}{
+		SN:    d.sn.Load(),
 		Alias: (*Alias)(d),
 	}
 	d.channelMap.Range(func(key, value interface{}) bool {
@@ -125,7 +144,10 @@ func (c *GB28181Config) RecoverDevice(d *Device, req sip.Request) {
 	d.SipIP = sipIP
 	d.MediaIP = mediaIp
 	d.NetAddr = deviceIp
+	d.Transport = strings.ToUpper(req.Transport())
+	d.GBVersion = c.negotiateVersion(req)
 	d.UpdateTime = time.Now()
+	d.save()
 }
 
 func (c *GB28181Config) StoreDevice(id string, req sip.Request) (d *Device) {
@@ -139,8 +161,11 @@ func (c *GB28181Config) StoreDevice(id string, req sip.Request) (d *Device) {
 		d = _d.(*Device)
 		d.UpdateTime = time.Now()
 		d.NetAddr = deviceIp
+		d.Transport = strings.ToUpper(req.Transport())
+		d.GBVersion = c.negotiateVersion(req)
 		d.Addr = deviceAddr
 		d.Debug("UpdateDevice", zap.String("netaddr", d.NetAddr))
+		d.save()
 	} else {
 		servIp := req.Recipient().Host()
 		//根据网卡ip获取对应的公网ip
@@ -170,52 +195,92 @@ func (c *GB28181Config) StoreDevice(id string, req sip.Request) (d *Device) {
 			SipIP:        sipIP,
 			MediaIP:      mediaIp,
 			NetAddr:      deviceIp,
+			Transport:    strings.ToUpper(req.Transport()),
+			GBVersion:    c.negotiateVersion(req),
 			Logger:       GB28181Plugin.With(zap.String("id", id)),
 		}
 		d.Info("StoreDevice", zap.String("deviceIp", deviceIp), zap.String("servIp", servIp), zap.String("sipIP", sipIP), zap.String("mediaIp", mediaIp))
 		Devices.Store(id, d)
-		c.SaveDevices()
+		d.save()
 	}
 	return
 }
+
+// ReadDevices 打开设备存储并恢复注册有效期内的设备及其通道
 func (c *GB28181Config) ReadDevices() {
-	if f, err := os.OpenFile("devices.json", os.O_RDONLY, 0644); err == nil {
-		defer f.Close()
-		var items []*Device
-		if err = json.NewDecoder(f).Decode(&items); err == nil {
-			for _, item := range items {
-				if time.Since(item.UpdateTime) < conf.RegisterValidity {
-					item.Status = "RECOVER"
-					item.Logger = GB28181Plugin.With(zap.String("id", item.ID))
-					Devices.Store(item.ID, item)
-				}
+	path := c.Storage.Path
+	if c.Storage.Type == StorageTypeBolt && path == "devices.json" {
+		path = "devices.db"
+	}
+	storage, err := newDeviceStorage(c.Storage.Type, path)
+	if err != nil {
+		GB28181Plugin.Error("open device storage", zap.String("path", path), zap.Error(err))
+		return
+	}
+	saver = deviceSaver{
+		storage: storage,
+		delay:   c.Storage.SaveDelay,
+		changed: make(map[string]struct{}),
+		deleted: make(map[string]struct{}),
+	}
+	if storage == nil {
+		return
+	}
+	go func() {
+		<-GB28181Plugin.Done()
+		saver.close()
+	}()
+	items, err := storage.Load()
+	if err != nil {
+		GB28181Plugin.Error("load devices", zap.String("path", path), zap.Error(err))
+		return
+	}
+	for _, item := range items {
+		d := item.Device
+		if time.Since(d.UpdateTime) < conf.RegisterValidity {
+			d.Status = DeviceRecoverStatus
+			d.Logger = GB28181Plugin.With(zap.String("id", d.ID))
+			for _, info := range item.Channels {
+				d.addOrUpdateChannel(info, "")
 			}
+			Devices.Store(d.ID, d)
+		} else {
+			saver.markDeleted(d.ID)
 		}
 	}
 }
+
+// SaveDevices 保存所有设备，写入会延迟合并
 func (c *GB28181Config) SaveDevices() {
-	var item []any
 	Devices.Range(func(key, value any) bool {
-		item = append(item, value)
+		saver.markChanged(key.(string))
 		return true
 	})
-	if f, err := os.OpenFile("devices.json", os.O_WRONLY|os.O_CREATE, 0644); err == nil {
-		defer f.Close()
-		encoder := json.NewEncoder(f)
-		encoder.SetIndent("", " ")
-		encoder.Encode(item)
-	}
 }
 
-func (d *Device) addOrUpdateChannel(info ChannelInfo) (c *Channel) {
+// save 设备或通道变化后保存，写入会延迟合并
+func (d *Device) save() {
+	saver.markChanged(d.ID)
+}
+
+// addOrUpdateChannel reporter 为上报该通道的设备，从存储恢复时为空
+func (d *Device) addOrUpdateChannel(info ChannelInfo, reporter string) (c *Channel) {
 	if old, ok := d.channelMap.Load(info.DeviceID); ok {
 		c = old.(*Channel)
+		prev := c.ChannelInfo
 		c.ChannelInfo = info
+		c.reporter = reporter
+		if prev.Status != info.Status {
+			c.hook(WebhookChannelStatus)
+		} else if !reflect.DeepEqual(prev, info) {
+			c.hook(WebhookChannelUpdate)
+		}
 	} else {
 		c = &Channel{
 			Device:      d,
 			ChannelInfo: info,
 			Logger:      d.Logger.With(zap.String("channel", info.DeviceID)),
+			reporter:    reporter,
 		}
 		if s := engine.Streams.Get(fmt.Sprintf("%s/%s/rtsp", c.Device.ID, c.DeviceID)); s != nil {
 			c.LiveSubSP = s.Path
@@ -223,12 +288,16 @@ func (d *Device) addOrUpdateChannel(info ChannelInfo) (c *Channel) {
 			c.LiveSubSP = ""
 		}
 		d.channelMap.Store(info.DeviceID, c)
+		c.hook(WebhookChannelAdd)
 	}
 	return
 }
 
 func (d *Device) deleteChannel(DeviceID string) {
-	d.channelMap.Delete(DeviceID)
+	if v, ok := d.channelMap.LoadAndDelete(DeviceID); ok {
+		v.(*Channel).hook(WebhookChannelDelete)
+	}
+	d.save()
 }
 
 func (d *Device) UpdateChannels(list ...ChannelInfo) {
@@ -240,21 +309,18 @@ func (d *Device) UpdateChannels(list ...ChannelInfo) {
 		if c.ParentID != "" {
 			path := strings.Split(c.ParentID, "/")
 			parentId := path[len(path)-1]
-			//如果父ID并非本身所属设备，一般情况下这是因为下级设备上传了目录信息，该信息通常不需要处理。
-			// 暂时不考虑级联目录的实现
+			//如果父ID是另一个已注册的设备，则加入该设备的通道中
+			//否则父ID为本设备上报的行政区划、业务分组、虚拟组织等目录项，由目录树处理层级关系
 			if d.ID != parentId {
 				if v, ok := Devices.Load(parentId); ok {
 					parent := v.(*Device)
-					parent.addOrUpdateChannel(c)
+					parent.addOrUpdateChannel(c, d.ID)
 					continue
-				} else {
-					c.Model = "Directory " + c.Model
-					c.Status = "NoParent"
 				}
 			}
 		}
 		//本设备增加通道
-		channel := d.addOrUpdateChannel(c)
+		channel := d.addOrUpdateChannel(c, d.ID)
 
 		if conf.InviteMode == INVIDE_MODE_AUTO {
 			channel.TryAutoInvite(&InviteOptions{})
@@ -265,19 +331,31 @@ func (d *Device) UpdateChannels(list ...ChannelInfo) {
 			channel.LiveSubSP = ""
 		}
 	}
+	d.save()
+}
+
+// nextSN 下一个请求序号，同时用作 CSeq 和消息体的 SN，并发的请求不会使用相同的序号
+func (d *Device) nextSN() uint32 {
+	return d.sn.Add(1)
+}
+
+// requestSN 请求的 CSeq 序号，消息体的 SN 与其一致
+func requestSN(req sip.Request) int {
+	cseq, _ := req.CSeq()
+	return int(cseq.SeqNo)
 }
 
 func (d *Device) CreateRequest(Method sip.RequestMethod) (req sip.Request) {
-	d.SN++
+	sn := d.nextSN()
 
 	callId := sip.CallID(utils.RandNumString(10))
 	userAgent := sip.UserAgentHeader("Monibuca")
 	maxForwards := sip.MaxForwards(70) //增加max-forwards为默认值 70
 	cseq := sip.CSeq{
-		SeqNo:      uint32(d.SN),
+		SeqNo:      sn,
 		MethodName: Method,
 	}
-	port := sip.Port(conf.SipPort)
+	port := conf.sipPort(d.transport())
 	serverAddr := sip.Address{
 		//DisplayName: sip.String{Str: d.config.Serial},
 		Uri: &sip.SipUri{
@@ -305,7 +383,8 @@ func (d *Device) CreateRequest(Method sip.RequestMethod) (req sip.Request) {
 		nil,
 	)
 
-	req.SetTransport(conf.SipNetwork)
+	d.appendGBVer(req)
+	req.SetTransport(d.transport())
 	req.SetDestination(d.NetAddr)
 	//fmt.Printf("构建请求参数:%s", *&req)
 	// requestMsg.DestAdd, err2 = d.ResolveAddress(requestMsg)
@@ -345,7 +424,7 @@ func (d *Device) Subscribe() int {
 	request.AppendHeader(&contentType)
 	request.AppendHeader(&expires)
 
-	request.SetBody(BuildCatalogXML(d.SN, d.ID), true)
+	request.SetBody(BuildCatalogXML(requestSN(request), d.ID), true)
 
 	response, err := d.SipRequestForResponse(request)
 	if err == nil && response != nil {
@@ -369,46 +448,117 @@ func (d *Device) Catalog() int {
 
 	request.AppendHeader(&contentType)
 	request.AppendHeader(&expires)
-	request.SetBody(BuildCatalogXML(d.SN, d.ID), true)
+	sn := requestSN(request)
+	request.SetBody(BuildCatalogXML(sn, d.ID), true)
+	job := d.startCatalogSync(sn)
 	// 输出Sip请求设备通道信息信令
 	GB28181Plugin.Sugar().Debugf("SIP->Catalog:%s", request)
 	resp, err := d.SipRequestForResponse(request)
 	if err == nil && resp != nil {
 		GB28181Plugin.Sugar().Debugf("SIP<-Catalog Response: %s", resp.String())
+		if resp.StatusCode() != http.StatusOK {
+			d.finishCatalogSync(job, CatalogFailed, fmt.Errorf("status=%d", resp.StatusCode()))
+		}
 		return int(resp.StatusCode())
 	} else if err != nil {
 		GB28181Plugin.Error("SIP<-Catalog error:", zap.Error(err))
+		d.finishCatalogSync(job, CatalogFailed, err)
 	}
 	return http.StatusRequestTimeout
 }
 
+// QueryDeviceInfo 设备注册后查询设备信息，失败时逐渐延长间隔重试
 func (d *Device) QueryDeviceInfo() {
 	for i := time.Duration(5); i < 100; i++ {
-
 		time.Sleep(time.Second * i)
-		request := d.CreateRequest(sip.MESSAGE)
-		contentType := sip.ContentType("Application/MANSCDP+xml")
-		request.AppendHeader(&contentType)
-		request.SetBody(BuildDeviceInfoXML(d.SN, d.ID), true)
-
-		response, _ := d.SipRequestForResponse(request)
-		if response != nil {
-			// via, _ := response.ViaHop()
-
-			// if via != nil && via.Params.Has("received") {
-			// 	received, _ := via.Params.Get("received")
-			// 	d.SipIP = received.String()
-			// }
-			d.Info("QueryDeviceInfo", zap.Uint16("status code", uint16(response.StatusCode())))
-			if response.StatusCode() == http.StatusOK {
-				break
-			}
+		info, err := d.DeviceInfo()
+		if err == nil {
+			d.Info("QueryDeviceInfo", zap.String("name", info.DeviceName), zap.String("manufacturer", info.Manufacturer), zap.String("model", info.Model))
+			break
+		}
+		d.Info("QueryDeviceInfo", zap.Error(err))
+	}
+}
+
+// DeviceInfo 查询设备信息，收到应答时同时更新设备的名称、厂商和型号
+func (d *Device) DeviceInfo() (*manscdp.DeviceInfoResponse, error) {
+	parts, err := d.QueryForResponse("", manscdp.CmdDeviceInfo, QUERY_DEVICE_INFO_TIMEOUT, func(sn int) string {
+		return BuildDeviceInfoXML(sn, d.ID)
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parts[0].(*manscdp.DeviceInfoResponse), nil
+}
+
+// onDeviceInfo 收到设备信息应答
+func (d *Device) onDeviceInfo(body string) {
+	info := &manscdp.DeviceInfoResponse{}
+	if err := manscdp.Decode([]byte(body), info); err != nil {
+		d.Error("decode device info err", zap.Error(err))
+		return
+	}
+	// 主设备信息
+	d.Name = info.DeviceName
+	d.Manufacturer = info.Manufacturer
+	d.Model = info.Model
+	d.save()
+	ResponseBroker.Put(d.ID, info.DeviceID, manscdp.CmdDeviceInfo, info.SN, 0, 1, info)
+}
+
+// onPresetQuery 收到预置位查询应答
+func (d *Device) onPresetQuery(body string) {
+	resp := &manscdp.PresetQueryResponse{}
+	if err := manscdp.Decode([]byte(body), resp); err != nil {
+		d.Error("decode preset query err", zap.Error(err))
+		return
+	}
+	ResponseBroker.Put(d.ID, resp.DeviceID, manscdp.CmdPresetQuery, resp.SN, resp.SumNum, len(resp.PresetList), resp)
+}
+
+func (d *Device) SipRequestForResponse(request sip.Request) (resp sip.Response, err error) {
+	start := time.Now()
+	defer func() { observeTransaction(request, resp, err, start) }()
+	// 超过 MTU 的 UDP 消息会被分片甚至丢弃，按 RFC3261 18.1.1 改用 TCP 发送，设备不支持 TCP 时仍使用 UDP
+	if strings.EqualFold(request.Transport(), "UDP") && conf.SipMTU > 0 && len(request.String()) > conf.SipMTU && conf.hasSipNetwork("TCP") {
+		tcpReq := request.Clone().(sip.Request)
+		tcpReq.SetTransport("TCP")
+		if resp, err = srv.RequestWithContext(context.Background(), tcpReq); err == nil {
+			return
 		}
+		d.Debug("send over tcp failed, fallback to udp", zap.Error(err))
+	}
+	resp, err = srv.RequestWithContext(context.Background(), request)
+	return
+}
+
+// transport 设备注册时使用的信令传输协议，向设备发送请求时使用相同的协议
+func (d *Device) transport() string {
+	if d.Transport == "" {
+		return conf.SipNetwork
 	}
+	return d.Transport
 }
 
-func (d *Device) SipRequestForResponse(request sip.Request) (sip.Response, error) {
-	return srv.RequestWithContext(context.Background(), request)
+// QueryForResponse 发送 MANSCDP 消息并等待设备以 MESSAGE 返回的应答，build 使用本次请求的 sn 生成消息体
+// channelId 为空时匹配该设备任意通道的应答，until 为空时按应答的 SumNum 判断是否收齐
+func (d *Device) QueryForResponse(channelId, cmdType string, timeout time.Duration, build func(sn int) string, until func(parts []any) bool) ([]any, error) {
+	request := d.CreateRequest(sip.MESSAGE)
+	contentType := sip.ContentType("Application/MANSCDP+xml")
+	request.AppendHeader(&contentType)
+	sn := requestSN(request)
+	request.SetBody(build(sn), true)
+	pending := ResponseBroker.Wait(d.ID, channelId, cmdType, sn, timeout).Until(until)
+	resp, err := d.SipRequestForResponse(request)
+	if err != nil {
+		pending.Cancel()
+		return nil, fmt.Errorf("query error: %s", err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		pending.Cancel()
+		return nil, fmt.Errorf("query error, status=%d", resp.StatusCode())
+	}
+	return pending.Result()
 }
 
 // MobilePositionSubscribe 移动位置订阅
@@ -424,7 +574,7 @@ func (d *Device) MobilePositionSubscribe(id string, expires time.Duration, inter
 	mobilePosition.AppendHeader(&contentType)
 	mobilePosition.AppendHeader(&expiresHeader)
 
-	mobilePosition.SetBody(BuildDevicePositionXML(d.SN, id, int(interval/time.Second)), true)
+	mobilePosition.SetBody(BuildDevicePositionXML(requestSN(mobilePosition), id, int(interval/time.Second)), true)
 
 	response, err := d.SipRequestForResponse(mobilePosition)
 	if err == nil && response != nil {
@@ -447,12 +597,18 @@ func (d *Device) UpdateChannelPosition(channelId string, gpsTime string, lng str
 		c.Longitude = lng
 		c.Latitude = lat
 		c.Debug("update channel position success")
+		c.hook(WebhookChannelPosition)
 	} else {
 		//如果未找到通道，则更新到设备上
 		d.GpsTime = time.Now() //时间取系统收到的时间，避免设备时间和格式问题
 		d.Longitude = lng
 		d.Latitude = lat
 		d.Debug("update device position success", zap.String("channelId", channelId))
+		hook(WebhookDevicePosition, d.ID, "", &struct {
+			GpsTime   time.Time
+			Longitude string
+			Latitude  string
+		}{d.GpsTime, d.Longitude, d.Latitude})
 	}
 }
 
@@ -490,7 +646,7 @@ func (d *Device) UpdateChannelStatus(deviceList []*notifyMessage) {
 				Secrecy:      v.Secrecy,
 				Status:       ChannelStatus(v.Status),
 			}
-			d.addOrUpdateChannel(channel)
+			d.addOrUpdateChannel(channel, d.ID)
 		case "DEL":
 			//删除
 			d.Debug("receive channel delete notify")
@@ -522,7 +678,7 @@ func (d *Device) UpdateChannelStatus(deviceList []*notifyMessage) {
 func (d *Device) channelOnline(DeviceID string) {
 	if v, ok := d.channelMap.Load(DeviceID); ok {
 		c := v.(*Channel)
-		c.Status = ChannelOnStatus
+		c.setStatus(ChannelOnStatus)
 		c.Debug("channel online", zap.String("channelId", DeviceID))
 	} else {
 		d.Debug("update channel status failed, not found", zap.String("channelId", DeviceID))
@@ -532,7 +688,7 @@ func (d *Device) channelOnline(DeviceID string) {
 func (d *Device) channelOffline(DeviceID string) {
 	if v, ok := d.channelMap.Load(DeviceID); ok {
 		c := v.(*Channel)
-		c.Status = ChannelOffStatus
+		c.setStatus(ChannelOffStatus)
 		c.Debug("channel offline", zap.String("channelId", DeviceID))
 	} else {
 		d.Debug("update channel status failed, not found", zap.String("channelId", DeviceID))
@@ -0,0 +1,133 @@
+package gb28181
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/gb28181/v4/manscdp"
+)
+
+var QUERY_CONFIG_TIMEOUT = time.Second * 10
+
+// onConfigDownload 收到设备配置查询应答
+func (d *Device) onConfigDownload(body string) {
+	resp := &manscdp.ConfigDownloadResponse{}
+	if err := manscdp.Decode([]byte(body), resp); err != nil {
+		d.Error("decode config download err", zap.Error(err))
+		return
+	}
+	ResponseBroker.Put(d.ID, resp.DeviceID, manscdp.CmdConfigDownload, resp.SN, 0, 1, resp)
+}
+
+// QueryConfig 设备配置查询，id 为设备或通道编号，configTypes 为 manscdp.ConfigTypeXXX
+// 设备可能分多条消息返回，收齐所有配置类型或超时后返回，超时时返回已收到的部分
+func (d *Device) QueryConfig(id string, configTypes ...string) (*manscdp.ConfigDownloadResponse, error) {
+	if len(configTypes) == 0 {
+		configTypes = []string{manscdp.ConfigTypeBasicParam}
+	}
+	merge := func(parts []any) *manscdp.ConfigDownloadResponse {
+		result := *parts[0].(*manscdp.ConfigDownloadResponse)
+		for _, part := range parts[1:] {
+			result.Merge(part.(*manscdp.ConfigDownloadResponse))
+		}
+		return &result
+	}
+	parts, err := d.QueryForResponse(id, manscdp.CmdConfigDownload, QUERY_CONFIG_TIMEOUT, func(sn int) string {
+		return BuildConfigDownloadXML(sn, id, strings.Join(configTypes, "/"))
+	}, func(parts []any) bool {
+		result := merge(parts)
+		if result.Failed() {
+			return true
+		}
+		for _, t := range configTypes {
+			if !result.Has(t) {
+				return false
+			}
+		}
+		return true
+	})
+	if errors.Is(err, ErrResponsePartial) {
+		d.Warn("config download partial", zap.Strings("types", configTypes), zap.Int("received", len(parts)))
+	} else if err != nil {
+		return nil, err
+	}
+	result := merge(parts)
+	if result.Failed() {
+		return result, fmt.Errorf("config download result: %s", result.Result)
+	}
+	return result, nil
+}
+
+// SetBasicParam 修改设备基本参数，零值的参数不修改
+// 修改成功后同步更新本地的设备名称
+func (d *Device) SetBasicParam(param manscdp.BasicParam) (code int, err error) {
+	if code, err = d.DeviceConfig(&manscdp.DeviceConfig{BasicParam: &param}); err == nil && param.Name != "" {
+		d.Name = param.Name
+	}
+	return
+}
+
+// DeviceConfig 设备配置，等待设备返回的 Result 应答
+func (d *Device) DeviceConfig(cfg *manscdp.DeviceConfig) (int, error) {
+	return d.ChannelConfig(d.ID, cfg)
+}
+
+// ChannelConfig 配置设备或通道，id 为设备或通道编号
+func (d *Device) ChannelConfig(id string, cfg *manscdp.DeviceConfig) (int, error) {
+	parts, err := d.QueryForResponse("", manscdp.CmdDeviceConfig, DEVICE_CONTROL_TIMEOUT, func(sn int) string {
+		cfg.Header = manscdp.Header{CmdType: manscdp.CmdDeviceConfig, SN: sn, DeviceID: id}
+		return encodeXML(cfg)
+	}, nil)
+	if err != nil {
+		return http.StatusRequestTimeout, err
+	}
+	return http.StatusOK, checkResult(parts)
+}
+
+func (c *GB28181Config) API_config_query(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	channel := query.Get("channel")
+	if channel == "" {
+		channel = id
+	}
+	var configTypes []string
+	if t := query.Get("type"); t != "" {
+		configTypes = strings.Split(t, "/")
+	}
+	if v, ok := Devices.Load(id); ok {
+		if res, err := v.(*Device).QueryConfig(channel, configTypes...); err == nil {
+			util.ReturnValue(res, w, r)
+		} else {
+			util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+		}
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q  not found", id), w, r)
+	}
+}
+
+func (c *GB28181Config) API_config_basic(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	var param manscdp.BasicParam
+	param.Name = query.Get("name")
+	param.Expiration, _ = strconv.Atoi(query.Get("expiration"))
+	param.HeartBeatInterval, _ = strconv.Atoi(query.Get("heartBeatInterval"))
+	param.HeartBeatCount, _ = strconv.Atoi(query.Get("heartBeatCount"))
+	if param == (manscdp.BasicParam{}) {
+		util.ReturnError(util.APIErrorQueryParse, "no parameter to set", w, r)
+		return
+	}
+	if v, ok := Devices.Load(id); ok {
+		code, err := v.(*Device).SetBasicParam(param)
+		returnControlResult(code, err, w, r)
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q  not found", id), w, r)
+	}
+}
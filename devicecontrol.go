@@ -0,0 +1,231 @@
+package gb28181
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/gb28181/v4/manscdp"
+)
+
+var DEVICE_CONTROL_TIMEOUT = time.Second * 10 // 等待设备控制应答的超时时间
+
+// DeviceControl 向设备发送控制命令，id 为目标设备或通道编号
+// wait 为 true 时等待设备返回的 Result 应答，设备应答 ERROR 或超时时返回错误
+func (d *Device) DeviceControl(id string, ctrl *manscdp.DeviceControl, wait bool) (code int, err error) {
+	build := func(sn int) string {
+		ctrl.Header = manscdp.Header{CmdType: manscdp.CmdDeviceControl, SN: sn, DeviceID: id}
+		return encodeXML(ctrl)
+	}
+	if wait {
+		parts, err := d.QueryForResponse("", manscdp.CmdDeviceControl, DEVICE_CONTROL_TIMEOUT, build, nil)
+		if err != nil {
+			return http.StatusRequestTimeout, err
+		}
+		return http.StatusOK, checkResult(parts)
+	}
+	request := d.CreateRequest(sip.MESSAGE)
+	contentType := sip.ContentType("Application/MANSCDP+xml")
+	request.AppendHeader(&contentType)
+	request.SetBody(build(requestSN(request)), true)
+	resp, err := d.SipRequestForResponse(request)
+	if err != nil {
+		return http.StatusRequestTimeout, err
+	}
+	if code = int(resp.StatusCode()); code != http.StatusOK {
+		err = fmt.Errorf("device control error, status=%d", code)
+	}
+	return
+}
+
+// checkResult 检查只携带 Result 的应答，不带 Result 时视为成功
+func checkResult(parts []any) error {
+	if result := parts[0].(*manscdp.ResultResponse); result.Failed() {
+		return fmt.Errorf("%s result: %s", result.CmdType, result.Result)
+	}
+	return nil
+}
+
+// TeleBoot 远程启动，设备重启前不返回应答
+func (d *Device) TeleBoot() (int, error) {
+	return d.DeviceControl(d.ID, &manscdp.DeviceControl{TeleBoot: manscdp.TeleBoot}, false)
+}
+
+// Guard 设备布防/撤防
+func (d *Device) Guard(set bool) (int, error) {
+	return d.DeviceControl(d.ID, guardControl(set), true)
+}
+
+func guardControl(set bool) *manscdp.DeviceControl {
+	if set {
+		return &manscdp.DeviceControl{GuardCmd: manscdp.SetGuard}
+	}
+	return &manscdp.DeviceControl{GuardCmd: manscdp.ResetGuard}
+}
+
+// Record 开始/停止设备端录像
+func (channel *Channel) Record(start bool) (int, error) {
+	cmd := manscdp.StopRecord
+	if start {
+		cmd = manscdp.Record
+	}
+	return channel.Device.DeviceControl(channel.DeviceID, &manscdp.DeviceControl{RecordCmd: cmd}, true)
+}
+
+// Guard 通道布防/撤防
+func (channel *Channel) Guard(set bool) (int, error) {
+	return channel.Device.DeviceControl(channel.DeviceID, guardControl(set), true)
+}
+
+// IFrame 强制关键帧
+func (channel *Channel) IFrame() (int, error) {
+	return channel.Device.DeviceControl(channel.DeviceID, &manscdp.DeviceControl{IFameCmd: manscdp.IFameSend}, false)
+}
+
+// DragZoom 拉框放大/缩小，in 为 true 时放大
+func (channel *Channel) DragZoom(in bool, z manscdp.DragZoom) (int, error) {
+	ctrl := &manscdp.DeviceControl{DragZoomOut: &z}
+	if in {
+		ctrl = &manscdp.DeviceControl{DragZoomIn: &z}
+	}
+	return channel.Device.DeviceControl(channel.DeviceID, ctrl, false)
+}
+
+// HomePosition 看守位控制，resetTime 为自动归位时间（秒），presetIndex 为看守位使用的预置位
+func (channel *Channel) HomePosition(enabled bool, resetTime, presetIndex int) (int, error) {
+	home := &manscdp.HomePosition{ResetTime: resetTime, PresetIndex: presetIndex}
+	if enabled {
+		home.Enabled = 1
+	}
+	return channel.Device.DeviceControl(channel.DeviceID, &manscdp.DeviceControl{HomePosition: home}, true)
+}
+
+func returnControlResult(code int, err error, w http.ResponseWriter, r *http.Request) {
+	if err != nil {
+		util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+	} else {
+		util.ReturnError(0, fmt.Sprintf("control code:%d", code), w, r)
+	}
+}
+
+func (c *GB28181Config) API_control_teleboot(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if v, ok := Devices.Load(id); ok {
+		code, err := v.(*Device).TeleBoot()
+		returnControlResult(code, err, w, r)
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q  not found", id), w, r)
+	}
+}
+
+func (c *GB28181Config) API_control_record(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	channel := query.Get("channel")
+	cmd := query.Get("cmd") // start=开始录像，stop=停止录像
+	if cmd != "start" && cmd != "stop" {
+		util.ReturnError(util.APIErrorQueryParse, "cmd parameter is invalid", w, r)
+		return
+	}
+	if c := FindChannel(id, channel); c != nil {
+		code, err := c.Record(cmd == "start")
+		returnControlResult(code, err, w, r)
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q channel %q not found", id, channel), w, r)
+	}
+}
+
+func (c *GB28181Config) API_control_guard(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	channel := query.Get("channel")
+	cmd := query.Get("cmd") // set=布防，reset=撤防
+	if cmd != "set" && cmd != "reset" {
+		util.ReturnError(util.APIErrorQueryParse, "cmd parameter is invalid", w, r)
+		return
+	}
+	// 未指定通道时对设备布防/撤防
+	if channel == "" {
+		if v, ok := Devices.Load(id); ok {
+			code, err := v.(*Device).Guard(cmd == "set")
+			returnControlResult(code, err, w, r)
+		} else {
+			util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q  not found", id), w, r)
+		}
+	} else if c := FindChannel(id, channel); c != nil {
+		code, err := c.Guard(cmd == "set")
+		returnControlResult(code, err, w, r)
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q channel %q not found", id, channel), w, r)
+	}
+}
+
+func (c *GB28181Config) API_control_iframe(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	channel := query.Get("channel")
+	if c := FindChannel(id, channel); c != nil {
+		code, err := c.IFrame()
+		returnControlResult(code, err, w, r)
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q channel %q not found", id, channel), w, r)
+	}
+}
+
+func (c *GB28181Config) API_control_dragzoom(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	channel := query.Get("channel")
+	cmd := query.Get("cmd") // in=放大，out=缩小
+	if cmd != "in" && cmd != "out" {
+		util.ReturnError(util.APIErrorQueryParse, "cmd parameter is invalid", w, r)
+		return
+	}
+	var z manscdp.DragZoom
+	for name, v := range map[string]*int{
+		"length":    &z.Length,
+		"width":     &z.Width,
+		"midPointX": &z.MidPointX,
+		"midPointY": &z.MidPointY,
+		"lengthX":   &z.LengthX,
+		"lengthY":   &z.LengthY,
+	} {
+		n, err := strconv.Atoi(query.Get(name))
+		if err != nil {
+			util.ReturnError(util.APIErrorQueryParse, name+" parameter is invalid", w, r)
+			return
+		}
+		*v = n
+	}
+	if c := FindChannel(id, channel); c != nil {
+		if ptzLocked(c, w, r) {
+			return
+		}
+		code, err := c.DragZoom(cmd == "in", z)
+		returnControlResult(code, err, w, r)
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q channel %q not found", id, channel), w, r)
+	}
+}
+
+func (c *GB28181Config) API_control_homeposition(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	channel := query.Get("channel")
+	enabled := query.Get("enabled") == "1" || query.Get("enabled") == "true"
+	resetTime, _ := strconv.Atoi(query.Get("resetTime"))
+	presetIndex, _ := strconv.Atoi(query.Get("presetIndex"))
+	if enabled && (presetIndex < 1 || presetIndex > 255) {
+		util.ReturnError(util.APIErrorQueryParse, "presetIndex parameter is invalid", w, r)
+		return
+	}
+	if c := FindChannel(id, channel); c != nil {
+		code, err := c.HomePosition(enabled, resetTime, presetIndex)
+		returnControlResult(code, err, w, r)
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q channel %q not found", id, channel), w, r)
+	}
+}
@@ -0,0 +1,97 @@
+package gb28181
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/gb28181/v4/manscdp"
+)
+
+var QUERY_STATUS_TIMEOUT = time.Second * 10
+
+// DeviceStatusInfo 设备状态查询结果
+type DeviceStatusInfo struct {
+	manscdp.DeviceStatusResponse
+	UpdateTime time.Time // 收到应答的时间
+}
+
+// Faulty 设备是否处于异常状态，心跳正常但编码停止等情况；未配置录像计划的设备 Record 为 OFF，不视为异常
+func (s *DeviceStatusInfo) Faulty() bool {
+	return s.Online == "OFFLINE" || (s.Status != "" && s.Status != "OK") || s.Encode == "OFF"
+}
+
+// DeviceStatusEvent 设备状态由正常变为异常或由异常恢复时发出的事件
+type DeviceStatusEvent struct {
+	Device *Device
+	Status *DeviceStatusInfo
+}
+
+// onDeviceStatus 收到设备状态查询应答
+func (d *Device) onDeviceStatus(body string) {
+	s := &DeviceStatusInfo{UpdateTime: time.Now()}
+	if err := manscdp.Decode([]byte(body), &s.DeviceStatusResponse); err != nil {
+		d.Error("decode device status err", zap.Error(err))
+		return
+	}
+	last := d.StatusInfo
+	d.StatusInfo = s
+	if s.Faulty() {
+		d.Warn("device status faulty", zap.String("status", s.Status), zap.String("reason", s.Reason), zap.String("encode", s.Encode), zap.String("record", s.Record))
+	}
+	if last == nil && s.Faulty() || last != nil && last.Faulty() != s.Faulty() {
+		EmitEvent(DeviceStatusEvent{Device: d, Status: s})
+	}
+	ResponseBroker.Put(d.ID, s.DeviceID, manscdp.CmdDeviceStatus, s.SN, 0, 1, s)
+}
+
+// QueryStatus 查询设备状态，结果同时保存在 Device.StatusInfo 中
+func (d *Device) QueryStatus() (*DeviceStatusInfo, error) {
+	d.lastStatusQuery = time.Now()
+	parts, err := d.QueryForResponse("", manscdp.CmdDeviceStatus, QUERY_STATUS_TIMEOUT, func(sn int) string {
+		return BuildDeviceStatusXML(sn, d.ID)
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parts[0].(*DeviceStatusInfo), nil
+}
+
+// pollStatus 配置了设备状态查询间隔时定时查询设备状态
+func (d *Device) pollStatus() {
+	if conf.StatusInterval <= 0 || d.Status == DeviceOfflineStatus || d.Status == DeviceRecoverStatus {
+		return
+	}
+	if time.Since(d.lastStatusQuery) >= conf.StatusInterval {
+		d.lastStatusQuery = time.Now()
+		go func() {
+			if _, err := d.QueryStatus(); err != nil {
+				d.Debug("query device status", zap.Error(err))
+			}
+		}()
+	}
+}
+
+func (c *GB28181Config) API_status(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	v, ok := Devices.Load(id)
+	if !ok {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q  not found", id), w, r)
+		return
+	}
+	d := v.(*Device)
+	// cache=1 时直接返回最近一次的查询结果
+	if query.Get("cache") == "1" && d.StatusInfo != nil {
+		util.ReturnValue(d.StatusInfo, w, r)
+		return
+	}
+	if s, err := d.QueryStatus(); err == nil {
+		util.ReturnValue(s, w, r)
+	} else {
+		util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+	}
+}
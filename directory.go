@@ -0,0 +1,194 @@
+package gb28181
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"m7s.live/engine/v4/util"
+)
+
+// 目录树中的节点类型
+const (
+	NodeDevice        = "device"        // 注册到本服务的设备，树的根节点
+	NodeCivilCode     = "civilcode"     // 行政区划，编码为2、4、6、8位
+	NodeBusinessGroup = "businessgroup" // 业务分组，类型编码 215
+	NodeVirtualOrg    = "virtualorg"    // 虚拟组织，类型编码 216
+	NodeSubDevice     = "subdevice"     // 下级平台、NVR 等下挂的设备
+	NodeChannel       = "channel"       // 摄像机等视频通道
+)
+
+// idTypeCode 20位编码中第11～13位的类型编码
+func idTypeCode(id string) string {
+	if len(id) != 20 {
+		return ""
+	}
+	return id[10:13]
+}
+
+// NodeType 目录项在目录树中的类型
+func (channel *Channel) NodeType() string {
+	id := channel.DeviceID
+	if len(id) <= 8 {
+		return NodeCivilCode
+	}
+	switch code := idTypeCode(id); {
+	case code == "215":
+		return NodeBusinessGroup
+	case code == "216":
+		return NodeVirtualOrg
+	case code >= "111" && code <= "130", code == "200":
+		// 111～130 为 DVR、NVR、编码器等前端主设备，200 为下级平台
+		return NodeSubDevice
+	}
+	return NodeChannel
+}
+
+// IsDirectory 行政区划、业务分组、虚拟组织只用于组织目录，不能点播
+func (channel *Channel) IsDirectory() bool {
+	switch channel.NodeType() {
+	case NodeCivilCode, NodeBusinessGroup, NodeVirtualOrg:
+		return true
+	}
+	return false
+}
+
+// TreeNode 目录树节点，Children 只包含直接子节点的数量，子节点通过 parent 参数再次查询
+type TreeNode struct {
+	ID         string
+	Name       string
+	Type       string
+	ParentID   string // 在目录树中的父节点，根节点为设备 ID
+	Status     string
+	ChildCount int
+	Channel    *Channel `json:",omitempty"` // 视频通道的详细信息
+}
+
+// directoryTree 一个设备的目录树，根据目录项的 ParentID、BusinessGroupID、CivilCode 及编码规则确定父节点
+type directoryTree struct {
+	root     string
+	nodes    map[string]*Channel
+	children map[string][]*Channel
+}
+
+func (d *Device) directoryTree() *directoryTree {
+	t := &directoryTree{root: d.ID, nodes: make(map[string]*Channel), children: make(map[string][]*Channel)}
+	d.channelMap.Range(func(key, value any) bool {
+		c := value.(*Channel)
+		t.nodes[c.DeviceID] = c
+		return true
+	})
+	for _, c := range t.nodes {
+		parent := t.parentOf(c)
+		t.children[parent] = append(t.children[parent], c)
+	}
+	for _, list := range t.children {
+		sort.Slice(list, func(i, j int) bool {
+			if a, b := list[i].IsDirectory(), list[j].IsDirectory(); a != b {
+				return a
+			}
+			return list[i].DeviceID < list[j].DeviceID
+		})
+	}
+	return t
+}
+
+// parentOf 依次按 ParentID、业务分组、上级行政区划、所属行政区划查找父节点，都找不到时挂在设备下
+func (t *directoryTree) parentOf(c *Channel) string {
+	known := func(id string) bool {
+		_, ok := t.nodes[id]
+		return ok && id != c.DeviceID
+	}
+	if c.ParentID != "" {
+		// ParentID 可能是以 / 分隔的路径，取最后一级
+		path := strings.Split(c.ParentID, "/")
+		if parent := path[len(path)-1]; known(parent) {
+			return parent
+		}
+	}
+	switch c.NodeType() {
+	case NodeVirtualOrg:
+		if known(c.BusinessGroupID) {
+			return c.BusinessGroupID
+		}
+	case NodeCivilCode:
+		for l := len(c.DeviceID) - 2; l >= 2; l -= 2 {
+			if known(c.DeviceID[:l]) {
+				return c.DeviceID[:l]
+			}
+		}
+		return t.root
+	case NodeBusinessGroup:
+		return t.root
+	}
+	if known(c.CivilCode) {
+		return c.CivilCode
+	}
+	return t.root
+}
+
+func (t *directoryTree) node(c *Channel) *TreeNode {
+	n := &TreeNode{
+		ID:         c.DeviceID,
+		Name:       c.Name,
+		Type:       c.NodeType(),
+		ParentID:   t.parentOf(c),
+		Status:     string(c.Status),
+		ChildCount: len(t.children[c.DeviceID]),
+	}
+	if !c.IsDirectory() {
+		n.Channel = c
+	}
+	return n
+}
+
+// Children 返回 parent 的直接子节点，parent 为空或为设备 ID 时返回顶层节点
+func (t *directoryTree) Children(parent string) ([]*TreeNode, bool) {
+	if parent == "" {
+		parent = t.root
+	} else if _, ok := t.nodes[parent]; !ok && parent != t.root {
+		return nil, false
+	}
+	list := make([]*TreeNode, 0, len(t.children[parent]))
+	for _, c := range t.children[parent] {
+		list = append(list, t.node(c))
+	}
+	return list, true
+}
+
+func (c *GB28181Config) API_tree(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	parent := query.Get("parent")
+	// 不指定设备时返回所有设备作为根节点
+	if id == "" {
+		list := make([]*TreeNode, 0)
+		Devices.Range(func(key, value any) bool {
+			d := value.(*Device)
+			list = append(list, &TreeNode{
+				ID:         d.ID,
+				Name:       d.Name,
+				Type:       NodeDevice,
+				Status:     string(d.Status),
+				ChildCount: len(d.directoryTree().children[d.ID]),
+			})
+			return true
+		})
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].ID < list[j].ID
+		})
+		util.ReturnValue(list, w, r)
+		return
+	}
+	v, ok := Devices.Load(id)
+	if !ok {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q  not found", id), w, r)
+		return
+	}
+	if list, ok := v.(*Device).directoryTree().Children(parent); ok {
+		util.ReturnValue(list, w, r)
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q node %q not found", id, parent), w, r)
+	}
+}
@@ -0,0 +1,65 @@
+package gb28181
+
+import "testing"
+
+func TestDirectoryTreeParentOf(t *testing.T) {
+	const (
+		deviceID = "34020000002000000001"
+		province = "34"
+		city     = "3402"
+		district = "340200"
+		group    = "34020000002150000001" // 业务分组
+		org      = "34020000002160000001" // 虚拟组织
+		nvr      = "34020000001180000001"
+	)
+	d := &Device{ID: deviceID}
+	for _, info := range []ChannelInfo{
+		{DeviceID: province},
+		{DeviceID: city},
+		{DeviceID: district},
+		{DeviceID: "34020000", ParentID: deviceID},
+		{DeviceID: group},
+		{DeviceID: org, BusinessGroupID: group},
+		{DeviceID: "34020000002160000002", ParentID: group + "/" + org},
+		{DeviceID: "34020000002160000003", BusinessGroupID: "34020000002150000009"},
+		{DeviceID: nvr, CivilCode: district},
+		{DeviceID: "34020000001310000001", ParentID: org, CivilCode: district},
+		{DeviceID: "34020000001310000002", ParentID: nvr},
+		{DeviceID: "34020000001310000003", CivilCode: district},
+		{DeviceID: "34020000001310000004", ParentID: "34020000001180000009", CivilCode: "999999"},
+		{DeviceID: "34020000001310000005", ParentID: "34020000001310000005"},
+	} {
+		d.channelMap.Store(info.DeviceID, &Channel{ChannelInfo: info})
+	}
+	tree := d.directoryTree()
+	for _, tt := range []struct {
+		name string
+		id   string
+		want string
+	}{
+		{"top civil code", province, deviceID},
+		{"civil code prefix", city, province},
+		{"civil code prefix chain", district, city},
+		{"civil code skips unknown level", "34020000", district},
+		{"business group", group, deviceID},
+		{"virtual org in business group", org, group},
+		{"virtual org path", "34020000002160000002", org},
+		{"virtual org unknown group", "34020000002160000003", deviceID},
+		{"subdevice civil code", nvr, district},
+		{"channel ParentID", "34020000001310000001", org},
+		{"channel under subdevice", "34020000001310000002", nvr},
+		{"channel civil code", "34020000001310000003", district},
+		{"unknown parent", "34020000001310000004", deviceID},
+		{"self parent", "34020000001310000005", deviceID},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tree.nodes[tt.id]
+			if c == nil {
+				t.Fatalf("node %s not in tree", tt.id)
+			}
+			if got := tree.parentOf(c); got != tt.want {
+				t.Errorf("parentOf(%s) = %s, want %s", tt.id, got, tt.want)
+			}
+		})
+	}
+}
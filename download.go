@@ -0,0 +1,253 @@
+package gb28181
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/util"
+)
+
+const (
+	DownloadingStatus = "DOWNLOADING"
+	DownloadedStatus  = "FINISHED"
+	DownloadFailed    = "FAILED"
+)
+
+const (
+	MediaStatusEnd = "121" // 录像文件发送结束
+)
+
+var (
+	DownloadJobs           sync.Map          // 录像下载任务，key 为 StreamPath
+	DOWNLOAD_JOB_KEEP      = time.Hour       // 结束的下载任务保留时长
+	DOWNLOAD_BYE_DELAY     = time.Second * 2 // 收到发送结束通知后延迟挂断，保证剩余数据接收完成
+	DOWNLOAD_DEFAULT_SPEED = 4
+)
+
+// DownloadJob 录像下载任务，通过订阅下载流计算进度
+type DownloadJob struct {
+	Subscriber
+	DeviceID   string
+	ChannelID  string
+	StreamPath string
+	Start      int
+	End        int
+	Speed      int
+	Status     string
+	Progress   float64 // 完成百分比
+	CreateTime time.Time
+	FinishTime time.Time
+	Error      string
+	channel    *Channel
+	firstTime  uint32
+	started    bool
+	mu         sync.Mutex
+}
+
+func (j *DownloadJob) MarshalJSON() ([]byte, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return json.Marshal(map[string]any{
+		"DeviceID":   j.DeviceID,
+		"ChannelID":  j.ChannelID,
+		"StreamPath": j.StreamPath,
+		"Start":      j.Start,
+		"End":        j.End,
+		"Speed":      j.Speed,
+		"Status":     j.Status,
+		"Progress":   j.Progress,
+		"CreateTime": j.CreateTime,
+		"FinishTime": j.FinishTime,
+		"Error":      j.Error,
+	})
+}
+
+// Download 下载录像，speed 为下载倍速
+func (channel *Channel) Download(start, end, speed int) (*DownloadJob, error) {
+	if speed <= 0 {
+		speed = DOWNLOAD_DEFAULT_SPEED
+	}
+	opt := &InviteOptions{Start: start, End: end, Download: true, DownloadSpeed: speed}
+	if opt.IsLive() || start >= end {
+		return nil, fmt.Errorf("invalid time range %d-%d", start, end)
+	}
+	code, err := channel.Invite(opt)
+	if err != nil {
+		return nil, err
+	}
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("invite return code %d", code)
+	}
+	job := &DownloadJob{
+		DeviceID:   channel.Device.ID,
+		ChannelID:  channel.DeviceID,
+		StreamPath: opt.StreamPath,
+		Start:      start,
+		End:        end,
+		Speed:      speed,
+		Status:     DownloadingStatus,
+		CreateTime: time.Now(),
+		channel:    channel,
+	}
+	DownloadJobs.Store(job.StreamPath, job)
+	if err = GB28181Plugin.Subscribe(job.StreamPath, job); err != nil {
+		job.finish(DownloadFailed, err.Error())
+		channel.Bye(job.StreamPath)
+		return job, err
+	}
+	go func() {
+		job.PlayRaw()
+		// 流结束时还未收到发送结束通知
+		job.finish(DownloadFailed, "stream closed")
+	}()
+	return job, nil
+}
+
+func (j *DownloadJob) OnEvent(event any) {
+	switch v := event.(type) {
+	case VideoFrame:
+		j.updateProgress(v.AbsTime)
+	case AudioFrame:
+	default:
+		j.Subscriber.OnEvent(event)
+	}
+}
+
+func (j *DownloadJob) updateProgress(absTime uint32) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.started {
+		j.started = true
+		j.firstTime = absTime
+		return
+	}
+	total := float64(j.End-j.Start) * 1000
+	progress := float64(absTime-j.firstTime) / total * 100
+	// 进度以设备的发送结束通知为准，之前最多到 99%
+	if progress > 99 {
+		progress = 99
+	}
+	if progress > j.Progress {
+		j.Progress = progress
+	}
+}
+
+// finish 结束任务，已结束的任务不再改变状态
+func (j *DownloadJob) finish(status, reason string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.Status != DownloadingStatus {
+		return
+	}
+	j.Status = status
+	j.Error = reason
+	j.FinishTime = time.Now()
+	if status == DownloadedStatus {
+		j.Progress = 100
+	}
+	j.channel.Info("download finished", zap.String("stream", j.StreamPath), zap.String("status", status), zap.String("reason", reason))
+}
+
+// onMediaStatusEnd 设备通知录像发送结束，id 为通道编号，部分设备使用设备编号
+func (d *Device) onMediaStatusEnd(id string) {
+	var job *DownloadJob
+	DownloadJobs.Range(func(key, value any) bool {
+		j := value.(*DownloadJob)
+		if j.Status == DownloadingStatus && j.DeviceID == d.ID && (j.ChannelID == id || d.ID == id) {
+			if job == nil || j.CreateTime.Before(job.CreateTime) {
+				job = j
+			}
+		}
+		return true
+	})
+	if job == nil {
+		d.Debug("media status end, download job not found", zap.String("id", id))
+		return
+	}
+	job.finish(DownloadedStatus, "")
+	time.AfterFunc(DOWNLOAD_BYE_DELAY, func() {
+		job.channel.Bye(job.StreamPath)
+	})
+}
+
+func (j *DownloadJob) stop() int {
+	j.finish(DownloadFailed, "stopped")
+	return j.channel.Bye(j.StreamPath)
+}
+
+// expired 任务结束超过 DOWNLOAD_JOB_KEEP
+func (j *DownloadJob) expired() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Status != DownloadingStatus && time.Since(j.FinishTime) > DOWNLOAD_JOB_KEEP
+}
+
+// cleanDownloadJobs 清除结束较久的下载任务，由 startJob 定时调用
+func cleanDownloadJobs() {
+	DownloadJobs.Range(func(key, value any) bool {
+		if value.(*DownloadJob).expired() {
+			DownloadJobs.Delete(key)
+		}
+		return true
+	})
+}
+
+func (c *GB28181Config) API_download(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	channel := query.Get("channel")
+	startTime := query.Get("startTime")
+	endTime := query.Get("endTime")
+	trange := strings.Split(query.Get("range"), "-")
+	if len(trange) == 2 {
+		startTime = trange[0]
+		endTime = trange[1]
+	}
+	speed, _ := strconv.Atoi(query.Get("speed"))
+	var opt InviteOptions
+	if err := opt.Validate(startTime, endTime); err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+		return
+	}
+	if c := FindChannel(id, channel); c == nil {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q channel %q not found", id, channel), w, r)
+	} else if job, err := c.Download(opt.Start, opt.End, speed); err != nil {
+		util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+	} else {
+		util.ReturnValue(job, w, r)
+	}
+}
+
+func (c *GB28181Config) API_download_list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	if query.Get("interval") == "" {
+		query.Set("interval", "1s")
+	}
+	util.ReturnFetchValue(func() (list []*DownloadJob) {
+		list = make([]*DownloadJob, 0)
+		DownloadJobs.Range(func(key, value any) bool {
+			if j := value.(*DownloadJob); id == "" || j.DeviceID == id {
+				list = append(list, j)
+			}
+			return true
+		})
+		return
+	}, w, r)
+}
+
+func (c *GB28181Config) API_download_stop(w http.ResponseWriter, r *http.Request) {
+	streamPath := r.URL.Query().Get("streamPath")
+	if v, ok := DownloadJobs.Load(streamPath); ok {
+		util.ReturnError(0, fmt.Sprintf("bye code:%d", v.(*DownloadJob).stop()), w, r)
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("download %q not found", streamPath), w, r)
+	}
+}
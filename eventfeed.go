@@ -0,0 +1,120 @@
+package gb28181
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+var (
+	EVENT_FEED_BUFFER    = 256
+	EVENT_FEED_KEEPALIVE = time.Second * 30
+)
+
+// liveFeed 通过 SSE 实时推送的事件流，事件格式与 webhooks 相同
+var liveFeed eventFeed
+
+type eventFeed struct {
+	subscribers map[*feedSubscriber]struct{}
+	sync.RWMutex
+}
+
+// feedSubscriber 一个 SSE 连接，devices 为空时接收所有设备的事件
+type feedSubscriber struct {
+	devices map[string]struct{}
+	events  []string
+	ch      chan []byte
+	dropped atomic.Int64 // 因客户端处理不过来丢弃的事件数
+}
+
+func (f *eventFeed) active() bool {
+	f.RLock()
+	defer f.RUnlock()
+	return len(f.subscribers) > 0
+}
+
+func (f *eventFeed) subscribe(devices, events []string) *feedSubscriber {
+	s := &feedSubscriber{events: events, ch: make(chan []byte, EVENT_FEED_BUFFER)}
+	if len(devices) > 0 {
+		s.devices = make(map[string]struct{})
+		for _, id := range devices {
+			s.devices[id] = struct{}{}
+		}
+	}
+	f.Lock()
+	defer f.Unlock()
+	if f.subscribers == nil {
+		f.subscribers = make(map[*feedSubscriber]struct{})
+	}
+	f.subscribers[s] = struct{}{}
+	return s
+}
+
+func (f *eventFeed) unsubscribe(s *feedSubscriber) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.subscribers, s)
+}
+
+// publish 客户端处理不过来时丢弃事件，不阻塞信令处理
+func (f *eventFeed) publish(e *WebhookEvent, body []byte) {
+	f.RLock()
+	defer f.RUnlock()
+	for s := range f.subscribers {
+		if s.devices != nil {
+			if _, ok := s.devices[e.DeviceID]; !ok {
+				continue
+			}
+		}
+		if !matchEvent(s.events, e.Event) {
+			continue
+		}
+		select {
+		case s.ch <- body:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+func splitParam(s string) (list []string) {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return
+}
+
+func (c *GB28181Config) API_events(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	sub := liveFeed.subscribe(splitParam(query.Get("id")), splitParam(query.Get("events")))
+	defer liveFeed.unsubscribe(sub)
+	sse := util.NewSSE(w, r.Context())
+	keepalive := time.NewTicker(EVENT_FEED_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-sse.Done():
+			return
+		case body := <-sub.ch:
+			if _, err := sse.Write(body); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			// 定时发送，避免代理关闭空闲连接，同时告知客户端丢弃的事件数
+			dropped := sub.dropped.Load()
+			if dropped > 0 {
+				GB28181Plugin.Debug("event feed dropped", zap.String("remote", r.RemoteAddr), zap.Int64("count", dropped))
+			}
+			if err := sse.WriteJSON(map[string]any{"Event": "keepalive", "Time": time.Now(), "Dropped": dropped}); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package gb28181
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/gb28181/v4/manscdp"
+)
+
+// 协议版本，即 X-GB-Ver 头的取值
+const (
+	GBVersion2011 = "1.0"
+	GBVersion2016 = "2.0"
+	GBVersion2022 = "3.0"
+)
+
+const HeaderGBVer = "X-GB-Ver"
+
+var QUERY_2022_TIMEOUT = time.Second * 10
+
+// gbVersion 本服务支持的协议版本
+func (c *GB28181Config) gbVersion() string {
+	if c.Version == "2022" {
+		return GBVersion2022
+	}
+	return GBVersion2016
+}
+
+func parseGBVersion(ver string) float64 {
+	v, _ := strconv.ParseFloat(strings.TrimSpace(ver), 64)
+	return v
+}
+
+// negotiateVersion 取设备注册时携带的 X-GB-Ver 与本服务版本中较低的一个，设备未携带时视为 2016 版
+func (c *GB28181Config) negotiateVersion(req sip.Request) string {
+	ver := GBVersion2016
+	if hdrs := req.GetHeaders(HeaderGBVer); len(hdrs) > 0 {
+		if v := parseGBVersion(hdrs[0].Value()); v > 0 {
+			ver = strconv.FormatFloat(v, 'f', 1, 64)
+		}
+	}
+	if server := c.gbVersion(); parseGBVersion(server) < parseGBVersion(ver) {
+		ver = server
+	}
+	return ver
+}
+
+// Is2022 设备是否按 GB/T 28181-2022 通信
+func (d *Device) Is2022() bool {
+	return parseGBVersion(d.GBVersion) >= parseGBVersion(GBVersion2022)
+}
+
+// appendGBVer 向 2022 版设备发送的请求携带 X-GB-Ver
+func (d *Device) appendGBVer(req sip.Request) {
+	if d.Is2022() {
+		req.AppendHeader(&sip.GenericHeader{HeaderName: HeaderGBVer, Contents: d.GBVersion})
+	}
+}
+
+// ChannelFaultEvent 心跳中上报的通道故障状态变化
+type ChannelFaultEvent struct {
+	Channel *Channel
+	Faulty  bool
+}
+
+// onKeepalive 2022 版设备在心跳的 Info 中列出故障的通道，不在列表中的通道恢复正常
+func (d *Device) onKeepalive(body string) {
+	var k manscdp.Keepalive
+	if err := manscdp.Decode([]byte(body), &k); err != nil {
+		d.Error("decode keepalive err", zap.Error(err))
+		return
+	}
+	faulty := make(map[string]struct{})
+	for _, id := range k.FaultyChannels() {
+		faulty[id] = struct{}{}
+	}
+	d.channelMap.Range(func(key, value any) bool {
+		ch := value.(*Channel)
+		_, bad := faulty[ch.DeviceID]
+		if bad != ch.Faulty {
+			ch.Faulty = bad
+			if bad {
+				ch.Warn("channel faulty")
+			} else {
+				ch.Info("channel recovered")
+			}
+			EmitEvent(ChannelFaultEvent{Channel: ch, Faulty: bad})
+		}
+		return true
+	})
+}
+
+// SnapShotFinishedEvent 设备上传抓拍图像完成
+type SnapShotFinishedEvent struct {
+	Device *Device
+	*manscdp.UploadSnapShotFinished
+}
+
+// DeviceUpgradeEvent 设备软件升级结果
+type DeviceUpgradeEvent struct {
+	Device *Device
+	*manscdp.DeviceUpgradeResult
+}
+
+func (d *Device) onSnapShotFinished(body string) {
+	n := &manscdp.UploadSnapShotFinished{}
+	if err := manscdp.Decode([]byte(body), n); err != nil {
+		d.Error("decode snapshot finished err", zap.Error(err))
+		return
+	}
+	d.Info("snapshot finished", zap.String("session", n.SessionID), zap.Strings("files", n.SnapShotList))
+	onSnapShotDone(n.SessionID)
+	EmitEvent(SnapShotFinishedEvent{Device: d, UploadSnapShotFinished: n})
+}
+
+func (d *Device) onUpgradeResult(body string) {
+	n := &manscdp.DeviceUpgradeResult{}
+	if err := manscdp.Decode([]byte(body), n); err != nil {
+		d.Error("decode upgrade result err", zap.Error(err))
+		return
+	}
+	d.Info("upgrade result", zap.String("result", n.Result), zap.String("firmware", n.Firmware), zap.String("reason", n.UpgradeFailedReason))
+	EmitEvent(DeviceUpgradeEvent{Device: d, DeviceUpgradeResult: n})
+}
+
+func (d *Device) onSDCardStatus(body string) {
+	resp := &manscdp.SDCardStatusResponse{}
+	if err := manscdp.Decode([]byte(body), resp); err != nil {
+		d.Error("decode sdcard status err", zap.Error(err))
+		return
+	}
+	ResponseBroker.Put(d.ID, resp.DeviceID, manscdp.CmdSDCardStatus, resp.SN, resp.SumNum, len(resp.SDCardList), resp)
+}
+
+func (d *Device) onHomePosition(body string) {
+	resp := &manscdp.HomePositionResponse{}
+	if err := manscdp.Decode([]byte(body), resp); err != nil {
+		d.Error("decode home position err", zap.Error(err))
+		return
+	}
+	ResponseBroker.Put(d.ID, resp.DeviceID, manscdp.CmdHomePositionQuery, resp.SN, 0, 1, resp)
+}
+
+// QuerySDCardStatus 查询存储卡状态，2022
+func (d *Device) QuerySDCardStatus() (*manscdp.SDCardStatusResponse, error) {
+	parts, err := d.QueryForResponse("", manscdp.CmdSDCardStatus, QUERY_2022_TIMEOUT, func(sn int) string {
+		return encodeXML(&manscdp.SDCardStatusQuery{Header: manscdp.Header{CmdType: manscdp.CmdSDCardStatus, SN: sn, DeviceID: d.ID}})
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	// 分多条返回时合并存储卡列表
+	res := parts[0].(*manscdp.SDCardStatusResponse)
+	for _, part := range parts[1:] {
+		res.SDCardList = append(res.SDCardList, part.(*manscdp.SDCardStatusResponse).SDCardList...)
+	}
+	return res, nil
+}
+
+// FormatSDCard 格式化存储卡，index 为存储卡编号，2022
+func (d *Device) FormatSDCard(index int) (int, error) {
+	return d.DeviceControl(d.ID, &manscdp.DeviceControl{FormatSDCard: index}, true)
+}
+
+// QueryHomePosition 查询通道的看守位信息，2022
+func (channel *Channel) QueryHomePosition() (*manscdp.HomePositionResponse, error) {
+	d := channel.Device
+	parts, err := d.QueryForResponse(channel.DeviceID, manscdp.CmdHomePositionQuery, QUERY_2022_TIMEOUT, func(sn int) string {
+		return encodeXML(&manscdp.HomePositionQuery{Header: manscdp.Header{CmdType: manscdp.CmdHomePositionQuery, SN: sn, DeviceID: channel.DeviceID}})
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parts[0].(*manscdp.HomePositionResponse), nil
+}
+
+func (c *GB28181Config) API_sdcard_status(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if v, ok := Devices.Load(id); ok {
+		if res, err := v.(*Device).QuerySDCardStatus(); err == nil {
+			util.ReturnValue(res, w, r)
+		} else {
+			util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+		}
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q  not found", id), w, r)
+	}
+}
+
+func (c *GB28181Config) API_sdcard_format(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	index, err := strconv.Atoi(query.Get("index"))
+	if err != nil || index < 1 {
+		util.ReturnError(util.APIErrorQueryParse, "index must be a positive number", w, r)
+		return
+	}
+	if v, ok := Devices.Load(id); ok {
+		code, err := v.(*Device).FormatSDCard(index)
+		returnControlResult(code, err, w, r)
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q  not found", id), w, r)
+	}
+}
+
+func (c *GB28181Config) API_homeposition_query(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	channel := query.Get("channel")
+	if c := FindChannel(id, channel); c != nil {
+		if res, err := c.QueryHomePosition(); err == nil {
+			util.ReturnValue(res, w, r)
+		} else {
+			util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+		}
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q channel %q not found", id, channel), w, r)
+	}
+}
@@ -1,8 +1,6 @@
 package gb28181
 
 import (
-	"bytes"
-	"crypto/md5"
 	"encoding/xml"
 	"fmt"
 	"strconv"
@@ -10,48 +8,13 @@ import (
 	"github.com/ghettovoice/gosip/sip"
 	"go.uber.org/zap"
 	. "m7s.live/engine/v4"
+	"m7s.live/plugin/gb28181/v4/manscdp"
 	"m7s.live/plugin/gb28181/v4/utils"
 
 	"net/http"
 	"time"
-
-	"golang.org/x/net/html/charset"
 )
 
-type Authorization struct {
-	*sip.Authorization
-}
-
-func (a *Authorization) Verify(username, passwd, realm, nonce string) bool {
-
-	//1、将 username,realm,password 依次组合获取 1 个字符串，并用算法加密的到密文 r1
-	s1 := fmt.Sprintf("%s:%s:%s", username, realm, passwd)
-	r1 := a.getDigest(s1)
-	//2、将 method，即REGISTER ,uri 依次组合获取 1 个字符串，并对这个字符串使用算法 加密得到密文 r2
-	s2 := fmt.Sprintf("REGISTER:%s", a.Uri())
-	r2 := a.getDigest(s2)
-
-	if r1 == "" || r2 == "" {
-		GB28181Plugin.Error("Authorization algorithm wrong")
-		return false
-	}
-	//3、将密文 1，nonce 和密文 2 依次组合获取 1 个字符串，并对这个字符串使用算法加密，获得密文 r3，即Response
-	s3 := fmt.Sprintf("%s:%s:%s", r1, nonce, r2)
-	r3 := a.getDigest(s3)
-
-	//4、计算服务端和客户端上报的是否相等
-	return r3 == a.Response()
-}
-
-func (a *Authorization) getDigest(raw string) string {
-	switch a.Algorithm() {
-	case "MD5":
-		return fmt.Sprintf("%x", md5.Sum([]byte(raw)))
-	default: //如果没有算法，默认使用MD5
-		return fmt.Sprintf("%x", md5.Sum([]byte(raw)))
-	}
-}
-
 func (c *GB28181Config) OnRegister(req sip.Request, tx sip.ServerTransaction) {
 	from, ok := req.From()
 	if !ok || from.Address == nil || from.Address.User() == nil {
@@ -97,8 +60,20 @@ func (c *GB28181Config) OnRegister(req sip.Request, tx sip.ServerTransaction) {
 		return
 	}
 	passAuth := false
+	stale := false
+	realm, err := c.deviceCredential(id)
+	if err != nil {
+		GB28181Plugin.Info("OnRegister forbidden", zap.String("id", id), zap.String("source", req.Source()), zap.Error(err))
+		if err == ErrDeviceDisabled {
+			metrics.registerRejected.Inc("disabled")
+		} else {
+			metrics.registerRejected.Inc("error")
+		}
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusForbidden, "Forbidden", ""))
+		return
+	}
 	// 不需要密码情况
-	if c.Username == "" && c.Password == "" {
+	if !realm.needAuth() {
 		passAuth = true
 	} else {
 		// 需要密码情况 设备第一次上报，返回401和加密算法
@@ -111,19 +86,30 @@ func (c *GB28181Config) OnRegister(req sip.Request, tx sip.ServerTransaction) {
 			if auth.Username() == id {
 				username = id
 			} else {
-				username = c.Username
+				username = realm.Username
 			}
 
 			if dc, ok := DeviceRegisterCount.LoadOrStore(id, 1); ok && dc.(int) > MaxRegisterCount {
+				metrics.registerRejected.Inc("banned")
 				response := sip.NewResponseFromRequest("", req, http.StatusForbidden, "Forbidden", "")
 				tx.Respond(response)
 				return
 			} else {
 				// 设备第二次上报，校验
 				_nonce, loaded := DeviceNonce.Load(id)
-				if loaded && auth.Verify(username, c.Password, c.Realm, _nonce.(string)) {
-					passAuth = true
+				if loaded && auth.Verify(string(req.Method()), username, realm, _nonce.(*digestNonce).Value) {
+					n := _nonce.(*digestNonce)
+					if n.Expired() {
+						// 密码正确但 nonce 已过期，要求设备使用新的 nonce 重新认证
+						stale = true
+					} else if n.use(auth.Nc()) {
+						passAuth = true
+					} else {
+						metrics.authFailures.Inc()
+						DeviceRegisterCount.Store(id, dc.(int)+1)
+					}
 				} else {
+					metrics.authFailures.Inc()
 					DeviceRegisterCount.Store(id, dc.(int)+1)
 				}
 			}
@@ -134,8 +120,10 @@ func (c *GB28181Config) OnRegister(req sip.Request, tx sip.ServerTransaction) {
 		if isUnregister {
 			tmpd, ok := Devices.LoadAndDelete(id)
 			if ok {
+				saver.markDeleted(id)
 				GB28181Plugin.Info("Unregister Device", zap.String("id", id))
 				d = tmpd.(*Device)
+				d.hook(WebhookDeviceUnregister, "unregister")
 			} else {
 				return
 			}
@@ -146,6 +134,7 @@ func (c *GB28181Config) OnRegister(req sip.Request, tx sip.ServerTransaction) {
 			} else {
 				d = c.StoreDevice(id, req)
 			}
+			d.hook(WebhookDeviceRegister, "")
 		}
 		DeviceNonce.Delete(id)
 		DeviceRegisterCount.Delete(id)
@@ -159,6 +148,9 @@ func (c *GB28181Config) OnRegister(req sip.Request, tx sip.ServerTransaction) {
 			HeaderName: "Date",
 			Contents:   time.Now().Format(TIME_LAYOUT),
 		})
+		if c.Version == "2022" {
+			resp.AppendHeader(&sip.GenericHeader{HeaderName: HeaderGBVer, Contents: d.GBVersion})
+		}
 		_ = tx.Respond(resp)
 
 		if !isUnregister {
@@ -169,17 +161,7 @@ func (c *GB28181Config) OnRegister(req sip.Request, tx sip.ServerTransaction) {
 		GB28181Plugin.Info("OnRegister unauthorized", zap.String("id", id), zap.String("source", req.Source()),
 			zap.String("destination", req.Destination()))
 		response := sip.NewResponseFromRequest("", req, http.StatusUnauthorized, "Unauthorized", "")
-		_nonce, _ := DeviceNonce.LoadOrStore(id, utils.RandNumString(32))
-		auth := fmt.Sprintf(
-			`Digest realm="%s",algorithm=%s,nonce="%s"`,
-			c.Realm,
-			"MD5",
-			_nonce.(string),
-		)
-		response.AppendHeader(&sip.GenericHeader{
-			HeaderName: "WWW-Authenticate",
-			Contents:   auth,
-		})
+		appendChallenge(response, realm, challengeNonce(id, realm.Realm).Value, stale)
 		_ = tx.Respond(response)
 	}
 }
@@ -216,6 +198,7 @@ func (c *GB28181Config) OnMessage(req sip.Request, tx sip.ServerTransaction) {
 			go d.syncChannels()
 		case DeviceRegisterStatus:
 			d.Status = DeviceOnlineStatus
+			d.hook(WebhookDeviceOnline, "")
 		}
 		d.UpdateTime = time.Now()
 		temp := &struct {
@@ -227,23 +210,20 @@ func (c *GB28181Config) OnMessage(req sip.Request, tx sip.ServerTransaction) {
 			Manufacturer string
 			Model        string
 			Channel      string
+			Result       string
+			NotifyType   string        // 媒体通知类型，121 表示录像文件发送结束
 			DeviceList   []ChannelInfo `xml:"DeviceList>Item"`
 			RecordList   []*Record     `xml:"RecordList>Item"`
-			SumNum       int           // 录像结果的总数 SumNum，录像结果会按照多条消息返回，可用于判断是否全部返回
+			SumNum       int           // 录像或目录结果的总数 SumNum，结果会按照多条消息返回，可用于判断是否全部返回
 		}{}
-		decoder := xml.NewDecoder(bytes.NewReader([]byte(req.Body())))
-		decoder.CharsetReader = charset.NewReaderLabel
-		err := decoder.Decode(temp)
-		if err != nil {
-			err = utils.DecodeGbk(temp, []byte(req.Body()))
-			if err != nil {
-				GB28181Plugin.Error("decode catelog err", zap.Error(err))
-			}
+		if err := manscdp.Decode([]byte(req.Body()), temp); err != nil {
+			GB28181Plugin.Error("decode catelog err", zap.Error(err))
 		}
 		var body string
 		switch temp.CmdType {
 		case "Keepalive":
 			d.LastKeepaliveAt = time.Now()
+			d.onKeepalive(req.Body())
 			//callID !="" 说明是订阅的事件类型信息
 			if d.lastSyncTime.IsZero() {
 				go d.syncChannels()
@@ -260,22 +240,49 @@ func (c *GB28181Config) OnMessage(req sip.Request, tx sip.ServerTransaction) {
 				d.MobilePositionSubscribe(d.ID, c.Position.Expires, c.Position.Interval)
 				GB28181Plugin.Debug("Mobile Position Subscribe", zap.String("deviceID", d.ID))
 			}
+			//开启了自动订阅报警，则在订阅过期前续订
+			go d.autoAlarmSubscribe()
+			//已订阅 PTZ 精准状态的通道在订阅过期前续订
+			go d.renewPTZSubscriptions()
 		case "Catalog":
-			d.UpdateChannels(temp.DeviceList...)
+			d.onCatalog(temp.SN, temp.SumNum, temp.DeviceList)
 		case "RecordInfo":
-			RecordQueryLink.Put(d.ID, temp.DeviceID, temp.SN, temp.SumNum, temp.RecordList)
+			ResponseBroker.Put(d.ID, temp.DeviceID, temp.CmdType, temp.SN, temp.SumNum, len(temp.RecordList), &recordInfoPart{SumNum: temp.SumNum, List: temp.RecordList})
 		case "DeviceInfo":
-			// 主设备信息
-			d.Name = temp.DeviceName
-			d.Manufacturer = temp.Manufacturer
-			d.Model = temp.Model
+			d.onDeviceInfo(req.Body())
 		case "Alarm":
-			d.Status = DeviceAlarmedStatus
-			body = BuildAlarmResponseXML(d.ID)
+			d.onAlarm(req.Body())
+			body = BuildAlarmResponseXML(temp.SN, d.ID)
+		case "DeviceControl", "DeviceConfig":
+			ResponseBroker.Put(d.ID, temp.DeviceID, temp.CmdType, temp.SN, 0, 1, &manscdp.ResultResponse{
+				Header: manscdp.Header{CmdType: temp.CmdType, SN: temp.SN, DeviceID: temp.DeviceID},
+				Result: temp.Result,
+			})
+		case "ConfigDownload":
+			d.onConfigDownload(req.Body())
+		case "DeviceStatus":
+			d.onDeviceStatus(req.Body())
 		case "Broadcast":
 			GB28181Plugin.Info("broadcast message", zap.String("body", req.Body()))
+			if s := findBroadcastSession(temp.DeviceID); s != nil {
+				s.onBroadcastResult(temp.Result)
+			}
 		case "PresetQuery":
-			GB28181Plugin.Info("PresetQuery message", zap.String("body", req.Body()))
+			d.onPresetQuery(req.Body())
+		case manscdp.CmdSDCardStatus:
+			d.onSDCardStatus(req.Body())
+		case manscdp.CmdHomePositionQuery:
+			d.onHomePosition(req.Body())
+		case manscdp.CmdPTZPosition:
+			d.onPTZPosition(req.Body())
+		case manscdp.CmdUploadSnapShotFinished:
+			d.onSnapShotFinished(req.Body())
+		case manscdp.CmdDeviceUpgradeResult:
+			d.onUpgradeResult(req.Body())
+		case "MediaStatus":
+			if temp.NotifyType == MediaStatusEnd {
+				d.onMediaStatusEnd(temp.DeviceID)
+			}
 		default:
 			d.Warn("Not supported CmdType", zap.String("CmdType", temp.CmdType), zap.String("body", req.Body()))
 			response := sip.NewResponseFromRequest("", req, http.StatusBadRequest, "", "")
@@ -287,12 +294,50 @@ func (c *GB28181Config) OnMessage(req sip.Request, tx sip.ServerTransaction) {
 			Device: d,
 		})
 		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusOK, "OK", body))
+	} else if v, ok := Platforms.Load(id); ok {
+		v.(*Platform).OnMessage(req, tx)
 	} else {
 		GB28181Plugin.Debug("Unauthorized message, device not found", zap.String("id", id))
 	}
 }
 func (c *GB28181Config) OnBye(req sip.Request, tx sip.ServerTransaction) {
 	tx.Respond(sip.NewResponseFromRequest("", req, http.StatusOK, "OK", ""))
+	if callID, ok := req.CallID(); ok {
+		if v, ok := CascadeSessions.Load(callID.Value()); ok {
+			s := v.(*CascadeSession)
+			s.byeByPeer = true
+			s.Hangup()
+		} else if s := findAudioSessionByCallID(callID.Value()); s != nil {
+			s.byeByPeer = true
+			s.Hangup()
+		}
+	}
+}
+
+// OnInvite 接受上级平台的点播，以及设备收到语音广播通知后发起的邀请
+func (c *GB28181Config) OnInvite(req sip.Request, tx sip.ServerTransaction) {
+	from, ok := req.From()
+	if !ok || from.Address == nil || from.Address.User() == nil {
+		GB28181Plugin.Error("OnInvite", zap.String("error", "no id"))
+		return
+	}
+	id := from.Address.User().String()
+	GB28181Plugin.Debug("SIP<-OnInvite", zap.String("id", id), zap.String("source", req.Source()), zap.String("req", req.String()))
+	if v, ok := Platforms.Load(id); ok {
+		v.(*Platform).OnInvite(req, tx)
+	} else if s := findBroadcastSession(id); s != nil {
+		s.OnInvite(req, tx)
+	} else {
+		tx.Respond(sip.NewResponseFromRequest("", req, http.StatusForbidden, "Forbidden", ""))
+	}
+}
+
+func (c *GB28181Config) OnAck(req sip.Request, tx sip.ServerTransaction) {
+	if callID, ok := req.CallID(); ok {
+		if v, ok := CascadeSessions.Load(callID.Value()); ok {
+			v.(*CascadeSession).OnAck()
+		}
+	}
 }
 
 type NotifyEvent MessageEvent
@@ -309,25 +354,20 @@ func (c *GB28181Config) OnNotify(req sip.Request, tx sip.ServerTransaction) {
 		d := v.(*Device)
 		d.UpdateTime = time.Now()
 		temp := &struct {
-			XMLName   xml.Name
-			CmdType   string
-			DeviceID  string
-			Time      string //位置订阅-GPS时间
-			Longitude string //位置订阅-经度
-			Latitude  string //位置订阅-维度
+			XMLName    xml.Name
+			CmdType    string
+			DeviceID   string
+			Time       string //位置订阅-GPS时间
+			Longitude  string //位置订阅-经度
+			Latitude   string //位置订阅-维度
+			NotifyType string //媒体通知类型，121 表示录像文件发送结束
 			// Speed      string           //位置订阅-速度(km/h)(可选)
 			// Direction  string           //位置订阅-方向(取值为当前摄像头方向与正北方的顺时针夹角,取值范围0°~360°,单位:°)(可选)
 			// Altitude   string           //位置订阅-海拔高度,单位:m(可选)
 			DeviceList []*notifyMessage `xml:"DeviceList>Item"` //目录订阅
 		}{}
-		decoder := xml.NewDecoder(bytes.NewReader([]byte(req.Body())))
-		decoder.CharsetReader = charset.NewReaderLabel
-		err := decoder.Decode(temp)
-		if err != nil {
-			err = utils.DecodeGbk(temp, []byte(req.Body()))
-			if err != nil {
-				GB28181Plugin.Error("decode catelog err", zap.Error(err))
-			}
+		if err := manscdp.Decode([]byte(req.Body()), temp); err != nil {
+			GB28181Plugin.Error("decode catelog err", zap.Error(err))
 		}
 		var body string
 		switch temp.CmdType {
@@ -338,7 +378,13 @@ func (c *GB28181Config) OnNotify(req sip.Request, tx sip.ServerTransaction) {
 			//更新channel的坐标
 			d.UpdateChannelPosition(temp.DeviceID, temp.Time, temp.Longitude, temp.Latitude)
 		case "Alarm":
-			d.Status = DeviceAlarmedStatus
+			d.onAlarm(req.Body())
+		case manscdp.CmdPTZPosition:
+			d.onPTZPositionNotify(req.Body())
+		case "MediaStatus":
+			if temp.NotifyType == MediaStatusEnd {
+				d.onMediaStatusEnd(temp.DeviceID)
+			}
 		default:
 			d.Warn("Not supported CmdType", zap.String("CmdType", temp.CmdType), zap.String("body", req.Body()))
 			response := sip.NewResponseFromRequest("", req, http.StatusBadRequest, "", "")
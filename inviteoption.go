@@ -5,17 +5,43 @@ import (
 	"fmt"
 	"math/rand"
 	"strconv"
+	"strings"
 )
 
+// 媒体流传输方式
+const (
+	MediaTransportUDP        = "udp"
+	MediaTransportTCPPassive = "tcp-passive" // 本服务监听端口，设备主动连接
+	MediaTransportTCPActive  = "tcp-active"  // 本服务主动连接设备应答中的端口，用于设备在 NAT 后的情况
+)
+
+// ParseMediaTransport 解析媒体传输方式，tcp 等同于 tcp-passive，为空时返回空字符串
+func ParseMediaTransport(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return "", nil
+	case "udp":
+		return MediaTransportUDP, nil
+	case "tcp", "passive", MediaTransportTCPPassive:
+		return MediaTransportTCPPassive, nil
+	case "active", MediaTransportTCPActive:
+		return MediaTransportTCPActive, nil
+	}
+	return "", fmt.Errorf("unknown media transport %q", s)
+}
+
 type InviteOptions struct {
-	Start       int
-	End         int
-	dump        string
-	ssrc        string
-	SSRC        uint32
-	MediaPort   uint16
-	StreamPath  string
-	recyclePort func(p uint16) (err error)
+	Start         int
+	End           int
+	dump          string
+	ssrc          string
+	SSRC          uint32
+	MediaPort     uint16
+	StreamPath    string
+	Download      bool   // 录像下载，s=Download
+	DownloadSpeed int    // 下载倍速，仅下载时有效
+	Transport     string // 媒体传输方式，udp、tcp-passive、tcp-active，为空时按 MediaNetwork 配置
+	recyclePort   func(p uint16) (err error)
 }
 
 func (o InviteOptions) IsLive() bool {
@@ -26,6 +52,28 @@ func (o InviteOptions) Record() bool {
 	return !o.IsLive()
 }
 
+// MediaTransport 本次邀请使用的媒体传输方式
+func (o InviteOptions) MediaTransport() string {
+	if t, err := ParseMediaTransport(o.Transport); err == nil && t != "" {
+		return t
+	}
+	if conf.IsMediaNetworkTCP() {
+		return MediaTransportTCPPassive
+	}
+	return MediaTransportUDP
+}
+
+// SessionName SDP 中的 s 字段
+func (o InviteOptions) SessionName() string {
+	if o.IsLive() {
+		return "Play"
+	}
+	if o.Download {
+		return "Download"
+	}
+	return "Playback"
+}
+
 func (o *InviteOptions) Validate(start, end string) error {
 	if start != "" {
 		sint, err1 := strconv.ParseInt(start, 10, 0)
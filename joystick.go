@@ -0,0 +1,316 @@
+package gb28181
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/goccy/go-json"
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+var (
+	JOYSTICK_DEADLINE        = time.Millisecond * 500 // 超过该时间未收到速度向量时自动停止
+	JOYSTICK_DEADZONE        = 0.05                   // 绝对值小于该值的分量视为 0，避免摇杆零漂
+	JOYSTICK_RELEASE_TIMEOUT = time.Second * 3        // 抢占时等待原操作员停止云台的时间
+)
+
+// PTZOperator 通过 WebSocket 控制云台的操作员，同一通道同时只有一个操作员
+type PTZOperator struct {
+	Operator   string
+	Priority   int
+	RemoteAddr string
+	StartTime  time.Time
+	preempted  chan struct{} // 被优先级更高的操作员抢占时关闭
+	preemptBy  *PTZOperator
+	released   chan struct{} // 已停止云台并释放控制权时关闭
+}
+
+type ptzLock struct {
+	owner *PTZOperator
+	sync.Mutex
+}
+
+// acquirePTZ 获取通道的云台控制权，优先级高于当前操作员时抢占，并等待原操作员停止云台
+func (channel *Channel) acquirePTZ(op *PTZOperator) error {
+	l := &channel.ptzLock
+	l.Lock()
+	old := l.owner
+	if old != nil && op.Priority <= old.Priority {
+		l.Unlock()
+		return fmt.Errorf("ptz is controlled by %q with priority %d", old.Operator, old.Priority)
+	}
+	l.owner = op
+	if old != nil {
+		old.preemptBy = op
+		close(old.preempted)
+	}
+	l.Unlock()
+	if old != nil {
+		channel.Info("ptz preempted", zap.String("operator", op.Operator), zap.String("old", old.Operator))
+		select {
+		case <-old.released:
+		case <-time.After(JOYSTICK_RELEASE_TIMEOUT):
+		}
+	}
+	return nil
+}
+
+func (channel *Channel) releasePTZ(op *PTZOperator) {
+	l := &channel.ptzLock
+	l.Lock()
+	if l.owner == op {
+		l.owner = nil
+	}
+	l.Unlock()
+	close(op.released)
+}
+
+// PTZOperator 当前控制云台的操作员，没有时返回 nil
+func (channel *Channel) PTZOperator() *PTZOperator {
+	l := &channel.ptzLock
+	l.Lock()
+	defer l.Unlock()
+	return l.owner
+}
+
+// ptzLocked 操作员通过 WebSocket 控制云台时，不接受其他来源的云台指令，返回 423 后返回 true
+func ptzLocked(channel *Channel, w http.ResponseWriter, r *http.Request) bool {
+	if op := channel.PTZOperator(); op != nil {
+		util.ReturnError(http.StatusLocked, fmt.Sprintf("ptz is controlled by %q", op.Operator), w, r)
+		return true
+	}
+	return false
+}
+
+// joystickCommand 客户端发送的速度向量，各分量取值 -1～1，X 正为右、Y 正为上、Z 正为放大，全为 0 或 Stop 为 true 时停止
+type joystickCommand struct {
+	X, Y, Z float64
+	Stop    bool
+}
+
+// ptzCmd 将速度向量转换为 PTZ 指令，水平、垂直速度映射到 0～255，变倍速度映射到 0～15
+func (j *joystickCommand) ptzCmd() string {
+	var code uint8
+	speed := func(v float64, positive, negative uint8, scale float64) uint8 {
+		if j.Stop || math.Abs(v) < JOYSTICK_DEADZONE {
+			return 0
+		}
+		if v > 0 {
+			code |= positive
+		} else {
+			code |= negative
+		}
+		return uint8(math.Round(math.Min(math.Abs(v), 1) * scale))
+	}
+	hs := speed(j.X, name2code["right"], name2code["left"], 255)
+	vs := speed(j.Y, name2code["up"], name2code["down"], 255)
+	zs := speed(j.Z, name2code["zoomin"], name2code["zoomout"], 15)
+	return toPtzStr(code, hs, vs, zs<<4)
+}
+
+// joystickMessage 发送给客户端的消息，Type 为 locked、stopped 或 preempted
+type joystickMessage struct {
+	Type     string
+	Operator string `json:",omitempty"`
+	Priority int    `json:",omitempty"`
+	Deadline int64  `json:",omitempty"` // 自动停止的超时时间（毫秒）
+	Reason   string `json:",omitempty"`
+}
+
+// wsConn 读取时自动回复的 Ping、Close 与主动发送的消息在不同协程中写入，需要加锁
+type wsConn struct {
+	net.Conn
+	sync.Mutex
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *wsConn) send(msg *joystickMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	return wsutil.WriteServerMessage(c.Conn, ws.OpText, data)
+}
+
+// joystick 向设备发送 PTZ 指令，只发送最新的指令，连接断开后保证最后发送停止指令
+type joystick struct {
+	channel *Channel
+	last    string
+	cmds    chan string
+	done    chan struct{}
+}
+
+func newJoystick(channel *Channel) *joystick {
+	j := &joystick{channel: channel, last: toPtzStr(0, 0, 0, 0), cmds: make(chan string, 1), done: make(chan struct{})}
+	go func() {
+		defer close(j.done)
+		for cmd := range j.cmds {
+			if code := channel.Control(cmd); code != http.StatusOK {
+				channel.Warn("joystick ptz failed", zap.String("cmd", cmd), zap.Int("code", code))
+			}
+		}
+	}()
+	return j
+}
+
+// move 指令与上一次相同时不重复发送，设备处理不过来时丢弃未发送的旧指令
+func (j *joystick) move(cmd string) {
+	if cmd == j.last {
+		return
+	}
+	j.last = cmd
+	select {
+	case <-j.cmds:
+	default:
+	}
+	j.cmds <- cmd
+}
+
+func (j *joystick) stop() {
+	j.move(toPtzStr(0, 0, 0, 0))
+}
+
+func (j *joystick) moving() bool {
+	return j.last != toPtzStr(0, 0, 0, 0)
+}
+
+// close 停止云台并等待指令发送完成
+func (j *joystick) close() {
+	j.stop()
+	close(j.cmds)
+	<-j.done
+}
+
+func (c *GB28181Config) API_ptz_ws(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	channel := query.Get("channel")
+	ch := FindChannel(id, channel)
+	if ch == nil {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q channel %q not found", id, channel), w, r)
+		return
+	}
+	op := &PTZOperator{
+		Operator:   query.Get("operator"),
+		RemoteAddr: r.RemoteAddr,
+		StartTime:  time.Now(),
+		preempted:  make(chan struct{}),
+		released:   make(chan struct{}),
+	}
+	if op.Operator == "" {
+		op.Operator = r.RemoteAddr
+	}
+	if p := query.Get("priority"); p != "" {
+		priority, err := strconv.Atoi(p)
+		if err != nil {
+			util.ReturnError(util.APIErrorQueryParse, "priority parameter is invalid", w, r)
+			return
+		}
+		op.Priority = priority
+	}
+	deadline := JOYSTICK_DEADLINE
+	if d, err := time.ParseDuration(query.Get("deadline")); err == nil && d >= time.Millisecond*100 {
+		deadline = d
+	}
+	if err := ch.acquirePTZ(op); err != nil {
+		util.ReturnError(http.StatusLocked, err.Error(), w, r)
+		return
+	}
+	j := newJoystick(ch)
+	defer ch.releasePTZ(op)
+	defer j.close()
+	netConn, _, _, err := ws.UpgradeHTTP(r, w)
+	if err != nil {
+		ch.Warn("joystick upgrade failed", zap.Error(err))
+		return
+	}
+	conn := &wsConn{Conn: netConn}
+	defer conn.Close()
+	ch.Info("joystick connected", zap.String("operator", op.Operator), zap.Int("priority", op.Priority))
+	defer ch.Info("joystick disconnected", zap.String("operator", op.Operator))
+
+	commands := make(chan *joystickCommand)
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			data, code, err := wsutil.ReadClientData(conn)
+			if err != nil {
+				closed <- err
+				return
+			}
+			if code != ws.OpText {
+				continue
+			}
+			cmd := &joystickCommand{}
+			if err = json.Unmarshal(data, cmd); err != nil {
+				// 无法解析的消息按停止处理
+				cmd.Stop = true
+			}
+			select {
+			case commands <- cmd:
+			case <-op.released:
+				return
+			}
+		}
+	}()
+
+	if conn.send(&joystickMessage{Type: "locked", Operator: op.Operator, Priority: op.Priority, Deadline: deadline.Milliseconds()}) != nil {
+		return
+	}
+	timer := time.NewTimer(deadline)
+	defer timer.Stop()
+	for {
+		select {
+		case cmd := <-commands:
+			j.move(cmd.ptzCmd())
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(deadline)
+		case <-timer.C:
+			// 未按时收到速度向量，可能是网络卡顿或客户端异常，停止云台
+			if j.moving() {
+				j.stop()
+				if conn.send(&joystickMessage{Type: "stopped", Reason: "timeout"}) != nil {
+					return
+				}
+			}
+			timer.Reset(deadline)
+		case <-op.preempted:
+			conn.send(&joystickMessage{Type: "preempted", Operator: op.preemptBy.Operator, Priority: op.preemptBy.Priority})
+			return
+		case err := <-closed:
+			ch.Debug("joystick closed", zap.String("operator", op.Operator), zap.Error(err))
+			return
+		}
+	}
+}
+
+func (c *GB28181Config) API_ptz_lock(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	channel := query.Get("channel")
+	if ch := FindChannel(id, channel); ch != nil {
+		util.ReturnValue(ch.PTZOperator(), w, r)
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q channel %q not found", id, channel), w, r)
+	}
+}
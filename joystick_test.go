@@ -0,0 +1,25 @@
+package gb28181
+
+import "testing"
+
+func TestJoystickPtzCmd(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		cmd  joystickCommand
+		want string
+	}{
+		{"right full speed", joystickCommand{X: 1}, "A50F0101FF0000B5"},
+		{"upleft half speed", joystickCommand{X: -0.5, Y: 0.5}, "A50F010A808000BF"},
+		{"down clamped", joystickCommand{Y: -2}, "A50F010400FF00B8"},
+		{"zoomout", joystickCommand{Z: -1}, "A50F01200000F0C5"},
+		{"right and zoomin", joystickCommand{X: 1, Z: 0.5}, "A50F0111FF008045"},
+		{"deadzone", joystickCommand{X: 0.01, Y: -0.04}, "A50F0100000000B5"},
+		{"stop", joystickCommand{X: 1, Y: 1, Z: 1, Stop: true}, "A50F0100000000B5"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cmd.ptzCmd(); got != tt.want {
+				t.Errorf("ptzCmd() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
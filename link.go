@@ -1,6 +1,7 @@
 package gb28181
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -8,112 +9,135 @@ import (
 	"go.uber.org/zap"
 )
 
-// 对于录像查询，通过 queryKey (即 deviceId + channelId + sn) 唯一区分一次请求和响应
-// 并将其关联起来，以实现异步响应的目的
+var (
+	ErrResponseTimeout = errors.New("wait response time out")
+	// ErrResponsePartial 超时前只收到部分应答，与已收到的部分一起返回，由调用方决定是否使用
+	ErrResponsePartial = fmt.Errorf("%w, response incomplete", ErrResponseTimeout)
+)
+
+// 对于需要等待设备应答的命令，通过 deviceId + channelId + CmdType + sn 唯一区分一次请求和应答
+// 并将其关联起来，以实现异步响应的目的。应答可以分多条消息返回，按 SumNum 汇总
 // 提供单例实例供调用
-var RecordQueryLink = NewRecordQueryLink(time.Second * 60)
+var ResponseBroker = NewBroker()
 
-type recordQueryLink struct {
-	pendingResult map[string]recordQueryResult // queryKey 查询结果缓存
-	pendingResp   map[string]recordQueryResp   // queryKey 待回复的查询请求
-	timeout       time.Duration                // 查询结果的过期时间
-	sync.RWMutex
+type Broker struct {
+	pending map[string]*PendingResponse // key 待回复的请求
+	sync.Mutex
 }
 
-type recordQueryResult struct {
-	time     time.Time
-	err      error
-	sum      int
+// PendingResponse 一次等待中的请求
+type PendingResponse struct {
+	broker   *Broker
+	key      string
+	cmdType  string
+	timeout  time.Duration
+	sum      int                    // 应答的条目总数，即 SumNum
+	count    int                    // 已收到的条目数
+	parts    []any                  // 收到的每条应答消息
+	complete func(parts []any) bool // 自定义的完成条件
+	done     chan struct{}
 	finished bool
-	list     []*Record
-}
-type recordQueryResp struct {
-	respChan  chan<- recordQueryResult
-	timeout   time.Duration
-	startTime time.Time
+	sync.Mutex
 }
 
-func NewRecordQueryLink(resultTimeout time.Duration) *recordQueryLink {
-	c := &recordQueryLink{
-		timeout:       resultTimeout,
-		pendingResult: make(map[string]recordQueryResult),
-		pendingResp:   make(map[string]recordQueryResp),
+func NewBroker() *Broker {
+	return &Broker{
+		pending: make(map[string]*PendingResponse),
 	}
-	return c
 }
 
-// 唯一区分一次录像查询
-func recordQueryKey(deviceId, channelId string, sn int) string {
-	return fmt.Sprintf("%s-%s-%d", deviceId, channelId, sn)
+// 唯一区分一次请求，channelId 为空时匹配该设备任意通道的应答
+func brokerKey(deviceId, channelId, cmdType string, sn int) string {
+	return fmt.Sprintf("%s-%s-%s-%d", deviceId, channelId, cmdType, sn)
 }
 
-// 定期清理过期的查询结果和请求
-func (c *recordQueryLink) cleanTimeout() {
-	for k, s := range c.pendingResp {
-		if time.Since(s.startTime) > s.timeout {
-			if r, ok := c.pendingResult[k]; ok {
-				c.notify(k, r)
-			} else {
-				c.notify(k, recordQueryResult{err: fmt.Errorf("query time out")})
-			}
-		}
-	}
-	for k, r := range c.pendingResult {
-		if time.Since(r.time) > c.timeout {
-			delete(c.pendingResult, k)
-		}
+// Wait 在发送命令前调用，timeout 为等待应答的最长时间
+// 默认收齐 SumNum 条目后完成，应答不带 SumNum 时收到第一条即完成
+func (b *Broker) Wait(deviceId, channelId, cmdType string, sn int, timeout time.Duration) *PendingResponse {
+	p := &PendingResponse{
+		broker:  b,
+		key:     brokerKey(deviceId, channelId, cmdType, sn),
+		cmdType: cmdType,
+		timeout: timeout,
+		done:    make(chan struct{}),
 	}
+	b.Lock()
+	defer b.Unlock()
+	b.pending[p.key] = p
+	return p
 }
 
-func (c *recordQueryLink) Put(deviceId, channelId string, sn int, sum int, record []*Record) {
-	key, r := c.doPut(deviceId, channelId, sn, sum, record)
-	if r.finished {
-		c.notify(key, r)
-	}
+// Until 自定义完成条件，用于应答不带 SumNum 但分多条返回的命令
+func (p *PendingResponse) Until(complete func(parts []any) bool) *PendingResponse {
+	p.complete = complete
+	return p
 }
 
-func (c *recordQueryLink) doPut(deviceId, channelId string, sn, sum int, record []*Record) (key string, r recordQueryResult) {
-	c.Lock()
-	defer c.Unlock()
-	key = recordQueryKey(deviceId, channelId, sn)
-	if v, ok := c.pendingResult[key]; ok {
-		r = v
-	} else {
-		r = recordQueryResult{time: time.Now(), sum: sum, list: make([]*Record, 0)}
-	}
+// Cancel 不再等待应答，命令发送失败时调用
+func (p *PendingResponse) Cancel() {
+	p.broker.Lock()
+	defer p.broker.Unlock()
+	delete(p.broker.pending, p.key)
+}
 
-	r.list = append(r.list, record...)
-	if len(r.list) == sum {
-		r.finished = true
+// Result 等待应答完成或超时，超时时如果已收到部分应答则返回已收到的部分和 ErrResponsePartial
+func (p *PendingResponse) Result() ([]any, error) {
+	defer p.Cancel()
+	select {
+	case <-p.done:
+	case <-time.After(p.timeout):
+	}
+	p.Lock()
+	defer p.Unlock()
+	if len(p.parts) == 0 {
+		metrics.responseTimeouts.Inc(p.cmdType)
+		return nil, ErrResponseTimeout
 	}
-	c.pendingResult[key] = r
-	GB28181Plugin.Logger.Debug("put record",
-		zap.String("key", key),
-		zap.Int("sum", sum),
-		zap.Int("count", len(r.list)))
-	return
+	if !p.finished {
+		metrics.responseTimeouts.Inc(p.cmdType)
+		return p.parts, ErrResponsePartial
+	}
+	return p.parts, nil
 }
 
-func (c *recordQueryLink) WaitResult(
-	deviceId, channelId string, sn int,
-	timeout time.Duration) (resultCh <-chan recordQueryResult) {
-
-	key := recordQueryKey(deviceId, channelId, sn)
-	c.Lock()
-	defer c.Unlock()
-	respCh := make(chan recordQueryResult, 1)
-	resultCh = respCh
-	c.pendingResp[key] = recordQueryResp{startTime: time.Now(), timeout: timeout, respChan: respCh}
-	return
+// Put 收到设备的应答，sumNum 为应答中的条目总数，count 为本条消息中的条目数
+func (b *Broker) Put(deviceId, channelId, cmdType string, sn, sumNum, count int, part any) bool {
+	b.Lock()
+	p, ok := b.pending[brokerKey(deviceId, channelId, cmdType, sn)]
+	if !ok {
+		p, ok = b.pending[brokerKey(deviceId, "", cmdType, sn)]
+	}
+	b.Unlock()
+	if !ok {
+		GB28181Plugin.Logger.Debug("response not wait",
+			zap.String("key", brokerKey(deviceId, channelId, cmdType, sn)))
+		return false
+	}
+	p.put(sumNum, count, part)
+	return true
 }
 
-func (c *recordQueryLink) notify(key string, r recordQueryResult) {
-	if s, ok := c.pendingResp[key]; ok {
-		s.respChan <- r
+func (p *PendingResponse) put(sumNum, count int, part any) {
+	p.Lock()
+	defer p.Unlock()
+	if p.finished {
+		return
+	}
+	p.parts = append(p.parts, part)
+	p.count += count
+	if sumNum > p.sum {
+		p.sum = sumNum
+	}
+	if p.complete != nil {
+		p.finished = p.complete(p.parts)
+	} else {
+		p.finished = p.count >= p.sum
+	}
+	GB28181Plugin.Logger.Debug("put response",
+		zap.String("key", p.key),
+		zap.Int("sum", p.sum),
+		zap.Int("count", p.count))
+	if p.finished {
+		close(p.done)
 	}
-	c.Lock()
-	defer c.Unlock()
-	delete(c.pendingResp, key)
-	delete(c.pendingResult, key)
-	GB28181Plugin.Logger.Debug("record notify", zap.String("key", key))
 }
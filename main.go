@@ -19,25 +19,101 @@ type GB28181PositionConfig struct {
 	Interval        time.Duration `default:"6s" desc:"订阅间隔"`    //订阅间隔
 }
 
+type GB28181AlarmConfig struct {
+	AutosubAlarm bool          `desc:"是否自动订阅报警"`                 //是否自动订阅报警
+	Expires      time.Duration `default:"3600s" desc:"订阅周期"`     //订阅周期
+	HistorySize  int           `default:"100" desc:"每个设备保留的报警数"` //每个设备保留的报警数
+}
+
+// GB28181StorageConfig 设备注册信息的持久化存储
+type GB28181StorageConfig struct {
+	Type      string        `default:"json" desc:"存储类型" enum:"json:JSON文件,bolt:bbolt数据库,none:不存储"` //存储类型
+	Path      string        `default:"devices.json" desc:"存储文件路径"`                                 //存储文件路径，bolt 类型未配置时为 devices.db
+	SaveDelay time.Duration `default:"2s" desc:"延迟合并写入的时间"`                                        //设备变化后延迟合并写入
+}
+
+// GB28181RealmConfig 认证域，设备 ID 以 Realm 开头时使用该域的账号密码
+type GB28181RealmConfig struct {
+	Realm     string `desc:"sip 服务域"`        //sip 服务域
+	Username  string `desc:"账号"`             //账号
+	Password  string `desc:"密码"`             //密码
+	Algorithm string `desc:"认证算法，为空时使用全局配置"` //认证算法
+}
+
+// GB28181AuthConfig 设备注册的摘要认证配置
+type GB28181AuthConfig struct {
+	Algorithm      string               `default:"MD5" desc:"认证算法，多个以逗号分隔，如 SHA-256,MD5"`   //下发给设备的认证算法，优先使用的在前
+	Qop            string               `default:"auth" desc:"qop，为空时不使用"`                  //为空时按 RFC 2069 方式认证
+	QopStrict      bool                 `desc:"为 true 时设备必须使用 qop 认证"`                      //默认兼容不带 qop 的设备
+	NonceExpires   time.Duration        `default:"300s" desc:"nonce 有效期"`                   //nonce 过期后要求设备重新认证
+	Realms         []GB28181RealmConfig `desc:"按设备 ID 前缀区分的认证域"`                            //按设备 ID 前缀区分的认证域
+	CredentialPath string               `default:"credentials.json" desc:"设备账号保存路径，为空时不保存"` //通过 API 设置的设备账号
+}
+
+// GB28181TLSConfig sip 服务 TLS 监听使用的证书
+type GB28181TLSConfig struct {
+	Cert string `desc:"证书文件路径"` //证书文件路径
+	Key  string `desc:"私钥文件路径"` //私钥文件路径
+}
+
+// GB28181CascadeConfig 上级平台配置，本服务作为下级平台向上级注册
+type GB28181CascadeConfig struct {
+	ServerID   string        `desc:"上级平台 sip 服务 id"`        //上级平台 sip 服务 id
+	Realm      string        `desc:"上级平台 sip 服务域"`          //上级平台 sip 服务域
+	ServerAddr string        `desc:"上级平台 sip 服务地址，ip:port"` //上级平台 sip 服务地址
+	Transport  string        `default:"udp" desc:"信令传输协议"`  //信令传输协议，默认UDP，可选TCP
+	Username   string        `desc:"注册账号，为空时使用本服务 id"`      //注册账号
+	Password   string        `desc:"注册密码"`                  //注册密码
+	Expires    time.Duration `default:"3600s" desc:"注册有效期"` //注册有效期
+	Keepalive  time.Duration `default:"60s" desc:"心跳间隔"`    //心跳间隔
+	Disabled   bool          `desc:"是否禁用"`                  //是否禁用
+}
+
+// GB28181WebhookConfig 事件推送地址，以 POST JSON 的方式推送设备、通道、报警、点播事件
+type GB28181WebhookConfig struct {
+	URL           string            `desc:"推送地址"`                              //推送地址
+	Secret        string            `desc:"签名密钥，为空时不签名"`                       //签名密钥，用于计算 X-GB28181-Signature
+	Events        []string          `desc:"推送的事件，为空时推送所有事件，支持 device.* 这样的前缀"` //推送的事件
+	Header        map[string]string `desc:"附加的请求头"`                            //附加的请求头
+	Timeout       time.Duration     `default:"5s" desc:"请求超时"`                 //请求超时
+	Retry         int               `default:"3" desc:"失败重试次数"`                //失败重试次数
+	RetryInterval time.Duration     `default:"1s" desc:"首次重试间隔，之后每次加倍"`        //首次重试间隔，之后每次加倍
+}
+
+// GB28181SnapshotConfig 图像抓拍，设备将图像上传到本服务内置的 HTTP 服务
+type GB28181SnapshotConfig struct {
+	ListenAddr     string        `desc:"接收设备上传图像的监听地址，如 :58180，为空时不启用"` //接收设备上传图像的监听地址
+	PublicURL      string        `desc:"下发给设备的上传地址前缀，为空时使用设备对应的媒体IP"`   //如 http://1.2.3.4:58180
+	Path           string        `default:"snapshots" desc:"图像保存目录"`    //图像保存目录
+	Retention      time.Duration `default:"168h" desc:"图像保存期限，0为不删除"`   //图像保存期限
+	SessionExpires time.Duration `default:"10m" desc:"上传地址的有效期"`        //上传地址的有效期
+}
+
 type GB28181Config struct {
 	InviteMode int    `default:"1" desc:"拉流模式" enum:"0:手动拉流,1:预拉流,2:按需拉流"`      //邀请模式，0:手动拉流，1:预拉流，2:按需拉流
 	InviteIDs  string `default:"131,132" desc:"允许邀请的设备类型（ 11～13位是设备类型编码）,逗号分割"` //按照国标gb28181协议允许邀请的设备类型:132 摄像机 NVR
 	ListenAddr string `default:"0.0.0.0" desc:"监听IP地址"`                         //监听地址
 	//sip服务器的配置
-	SipNetwork string   `default:"udp"  desc:"废弃，请使用 Port"`               //传输协议，默认UDP，可选TCP
-	SipIP      string   `desc:"sip 服务IP地址"`                               //sip 服务器公网IP
-	SipPort    sip.Port `default:"5060" desc:"废弃，请使用 Port"`               //sip 服务器端口，默认 5060
-	Serial     string   `default:"34020000002000000001" desc:"sip 服务 id"` //sip 服务器 id, 默认 34020000002000000001
-	Realm      string   `default:"3402000000" desc:"sip 服务域"`             //sip 服务器域，默认 3402000000
-	Username   string   `desc:"sip 服务账号"`                                 //sip 服务器账号
-	Password   string   `desc:"sip 服务密码"`                                 //sip 服务器密码
-	Port       struct { // 新配置方式
-		Sip   string `default:"udp:5060" desc:"sip服务端口号"`
+	SipNetwork string            `default:"udp"  desc:"废弃，请使用 Port"`               //传输协议，默认UDP，可选TCP
+	SipIP      string            `desc:"sip 服务IP地址"`                               //sip 服务器公网IP
+	SipPort    sip.Port          `default:"5060" desc:"废弃，请使用 Port"`               //sip 服务器端口，默认 5060
+	Serial     string            `default:"34020000002000000001" desc:"sip 服务 id"` //sip 服务器 id, 默认 34020000002000000001
+	Realm      string            `default:"3402000000" desc:"sip 服务域"`             //sip 服务器域，默认 3402000000
+	Username   string            `desc:"sip 服务账号"`                                 //sip 服务器账号
+	Password   string            `desc:"sip 服务密码"`                                 //sip 服务器密码
+	Auth       GB28181AuthConfig //设备注册认证
+	Version    string            `default:"2016" desc:"协议版本" enum:"2016:GB/T 28181-2016,2022:GB/T 28181-2022"` //2022 时与携带 X-GB-Ver: 3.0 的设备按 2022 版通信
+	Port       struct {          // 新配置方式
+		Sip   string `default:"udp:5060" desc:"sip服务端口号，多个以逗号分隔，如 udp:5060,tcp:5060,tls:5061"`
 		Media string `default:"tcp:58200-59200" desc:"媒体服务端口号"`
 		Fdm   bool   `default:"false" desc:"多路复用"`
 	}
+	SipTLS            GB28181TLSConfig //tls 监听使用的证书
+	SipMTU            int              `default:"1300" desc:"UDP 信令的最大长度，超过时改用 TCP 发送"` //超过该长度的 UDP 消息可能被分片丢弃，RFC3261 18.1.1
+	sipListeners      []sipListener
 	RegisterValidity  time.Duration `default:"3600s" desc:"注册有效期"` //注册有效期，单位秒，默认 3600
 	HeartbeatInterval time.Duration `default:"60s" desc:"心跳间隔"`    //心跳间隔，单位秒，默认 60
+	StatusInterval    time.Duration `desc:"设备状态查询间隔，0为不查询"`        //定时查询设备状态，用于发现心跳无法反映的编码异常
 
 	//媒体服务器配置
 	MediaIP      string `desc:"媒体服务IP地址"`                    //媒体服务器地址
@@ -54,7 +130,12 @@ type GB28181Config struct {
 	tcpPorts          PortManager
 	udpPorts          PortManager
 
-	Position GB28181PositionConfig //关于定位的配置参数
+	Position GB28181PositionConfig  //关于定位的配置参数
+	Alarm    GB28181AlarmConfig     //关于报警的配置参数
+	Storage  GB28181StorageConfig   //设备存储
+	Cascades []GB28181CascadeConfig `desc:"上级平台"` //级联的上级平台
+	Webhooks []GB28181WebhookConfig `desc:"事件推送"` //事件推送地址
+	Snapshot GB28181SnapshotConfig  //图像抓拍
 
 }
 
@@ -76,10 +157,18 @@ func (c *GB28181Config) OnEvent(event any) {
 	switch e := event.(type) {
 	case FirstConfig:
 		if c.Port.Sip != "udp:5060" {
-			protocol, ports := util.Conf2Listener(c.Port.Sip)
-			c.SipNetwork = protocol
-			c.SipPort = sip.Port(ports[0])
+			for _, s := range strings.Split(c.Port.Sip, ",") {
+				if protocol, ports := util.Conf2Listener(strings.TrimSpace(s)); len(ports) > 0 {
+					c.sipListeners = append(c.sipListeners, sipListener{strings.ToUpper(protocol), sip.Port(ports[0])})
+				}
+			}
 		}
+		if len(c.sipListeners) == 0 {
+			c.sipListeners = append(c.sipListeners, sipListener{strings.ToUpper(c.SipNetwork), c.SipPort})
+		}
+		// 第一个监听作为默认的信令传输协议
+		c.SipNetwork = c.sipListeners[0].Network
+		c.SipPort = c.sipListeners[0].Port
 		if c.Port.Media != "tcp:58200-59200" {
 			protocol, ports := util.Conf2Listener(c.Port.Media)
 			c.MediaNetwork = protocol
@@ -100,6 +189,12 @@ func (c *GB28181Config) OnEvent(event any) {
 		}
 		os.MkdirAll(c.DumpPath, 0766)
 		c.ReadDevices()
+		if err := Credentials.load(c.Auth.CredentialPath); err != nil {
+			GB28181Plugin.Error("load credentials", zap.Error(err))
+		}
+		// 在恢复设备之后启动，恢复的通道不推送 channel.add
+		c.startWebhooks()
+		c.startSnapshotServer()
 		SipUri = &sip.SipUri{
 			FUser: sip.String{Str: c.Serial},
 			FHost: c.SipIP,
@@ -107,6 +202,7 @@ func (c *GB28181Config) OnEvent(event any) {
 		}
 		go c.initRoutes()
 		c.startServer()
+		c.startCascade()
 	case InvitePublish:
 		if c.InviteMode == INVIDE_MODE_ONSUBSCRIBE {
 			//流可能是回放流，stream path是device/channel/start-end形式
@@ -2,57 +2,11 @@ package gb28181
 
 import (
 	"encoding/xml"
-	"fmt"
 	"strconv"
 	"time"
-)
-
-var (
-	// 获取预置位列表
-	PresentListXML = `
-<?xml version="1.0"?>
-<Query>
-	<CmdType>PresetQuery</CmdType>
-		<SN>%d</SN>
-	<DeviceID>%s</DeviceID>
-</Query>
-`
 
-	// CatalogXML 获取设备列表xml样式
-	CatalogXML = `<?xml version="1.0"?><Query>
-<CmdType>Catalog</CmdType>
-<SN>%d</SN>
-<DeviceID>%s</DeviceID>
-</Query>
-`
-	// RecordInfoXML 获取录像文件列表xml样式
-	RecordInfoXML = `<?xml version="1.0"?>
-<Query>
-<CmdType>RecordInfo</CmdType>
-<SN>%d</SN>
-<DeviceID>%s</DeviceID>
-<StartTime>%s</StartTime>
-<EndTime>%s</EndTime>
-<Secrecy>0</Secrecy>
-<Type>all</Type>
-</Query>
-`
-	// DeviceInfoXML 查询设备详情xml样式
-	DeviceInfoXML = `<?xml version="1.0"?>
-<Query>
-<CmdType>DeviceInfo</CmdType>
-<SN>%d</SN>
-<DeviceID>%s</DeviceID>
-</Query>
-`
-	// DevicePositionXML 订阅设备位置
-	DevicePositionXML = `<?xml version="1.0"?>
-<Query>
-<CmdType>MobilePosition</CmdType>
-<SN>%d</SN>
-<DeviceID>%s</DeviceID>
-<Interval>%d</Interval>
-</Query>`
+	"go.uber.org/zap"
+	"m7s.live/plugin/gb28181/v4/manscdp"
 )
 
 func intTotime(t int64) time.Time {
@@ -66,44 +20,68 @@ func intTotime(t int64) time.Time {
 	return time.Now()
 }
 
+// encodeXML 编码 MANSCDP 消息，消息结构都是确定的，编码失败只记录日志
+func encodeXML(v any) string {
+	body, err := manscdp.Encode(v)
+	if err != nil {
+		GB28181Plugin.Error("encode manscdp", zap.Error(err))
+	}
+	return body
+}
+
 // BuildDeviceInfoXML 获取设备详情指令
 func BuildDeviceInfoXML(sn int, id string) string {
-	return fmt.Sprintf(DeviceInfoXML, sn, id)
+	return encodeXML(&manscdp.DeviceInfoQuery{Header: manscdp.Header{CmdType: manscdp.CmdDeviceInfo, SN: sn, DeviceID: id}})
+}
+
+// BuildDeviceStatusXML 查询设备状态指令
+func BuildDeviceStatusXML(sn int, id string) string {
+	return encodeXML(&manscdp.DeviceStatusQuery{Header: manscdp.Header{CmdType: manscdp.CmdDeviceStatus, SN: sn, DeviceID: id}})
 }
 
 // BuildCatalogXML 获取NVR下设备列表指令
 func BuildCatalogXML(sn int, id string) string {
-	return fmt.Sprintf(CatalogXML, sn, id)
+	return encodeXML(&manscdp.CatalogQuery{Header: manscdp.Header{CmdType: manscdp.CmdCatalog, SN: sn, DeviceID: id}})
 }
 
+// BuildPresetListXML 获取预置位列表指令
 func BuildPresetListXML(sn int, id string) string {
-	return fmt.Sprintf(PresentListXML, sn, id)
-}
-
-// BuildRecordInfoXML 获取录像文件列表指令
-func BuildRecordInfoXML(sn int, id string, start, end int64) string {
-	return fmt.Sprintf(RecordInfoXML, sn, id, intTotime(start).Format("2006-01-02T15:04:05"), intTotime(end).Format("2006-01-02T15:04:05"))
+	return encodeXML(&manscdp.PresetQuery{Header: manscdp.Header{CmdType: manscdp.CmdPresetQuery, SN: sn, DeviceID: id}})
 }
 
 // BuildDevicePositionXML 订阅设备位置
 func BuildDevicePositionXML(sn int, id string, interval int) string {
-	return fmt.Sprintf(DevicePositionXML, sn, id, interval)
+	return encodeXML(&manscdp.MobilePositionQuery{Header: manscdp.Header{CmdType: manscdp.CmdMobilePosition, SN: sn, DeviceID: id}, Interval: interval})
 }
 
-// AlarmResponseXML alarm response xml样式
-var (
-	AlarmResponseXML = `<?xml version="1.0"?>
-<Response>
-<CmdType>Alarm</CmdType>
-<SN>17430</SN>
-<DeviceID>%s</DeviceID>
-</Response>
-`
-)
+// BuildConfigDownloadXML 设备配置查询指令，多个配置类型以 / 分隔
+func BuildConfigDownloadXML(sn int, id string, configType string) string {
+	return encodeXML(&manscdp.ConfigDownloadQuery{Header: manscdp.Header{CmdType: manscdp.CmdConfigDownload, SN: sn, DeviceID: id}, ConfigType: configType})
+}
+
+// BuildKeepaliveXML 向上级平台发送的心跳
+func BuildKeepaliveXML(sn int, id string) string {
+	return encodeXML(&manscdp.Keepalive{Header: manscdp.Header{CmdType: manscdp.CmdKeepalive, SN: sn, DeviceID: id}, Status: manscdp.ResultOK})
+}
+
+// BuildBroadcastXML 语音广播通知，sourceId 为语音输入设备（本服务），targetId 为语音输出设备
+func BuildBroadcastXML(sn int, sourceId, targetId string) string {
+	return encodeXML(&manscdp.Broadcast{CmdType: manscdp.CmdBroadcast, SN: sn, SourceID: sourceId, TargetID: targetId})
+}
+
+// BuildAlarmResponseXML 报警通知的应答，sn 与设备的报警通知保持一致
+func BuildAlarmResponseXML(sn int, id string) string {
+	return encodeXML(&manscdp.ResultResponse{Header: manscdp.Header{CmdType: manscdp.CmdAlarm, SN: sn, DeviceID: id}, Result: manscdp.ResultOK})
+}
 
-// BuildRecordInfoXML 获取录像文件列表指令
-func BuildAlarmResponseXML(id string) string {
-	return fmt.Sprintf(AlarmResponseXML, id)
+// BuildAlarmSubscribeXML 报警订阅，AlarmMethod 为 0 表示全部
+func BuildAlarmSubscribeXML(sn int, id string, startPriority, endPriority, method int) string {
+	return encodeXML(&manscdp.AlarmQuery{
+		Header:             manscdp.Header{CmdType: manscdp.CmdAlarm, SN: sn, DeviceID: id},
+		StartAlarmPriority: startPriority,
+		EndAlarmPriority:   endPriority,
+		AlarmMethod:        method,
+	})
 }
 
 func XmlEncode(v interface{}) (string, error) {
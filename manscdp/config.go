@@ -0,0 +1,263 @@
+package manscdp
+
+import "encoding/xml"
+
+// 设备配置查询的配置类型
+const (
+	ConfigTypeBasicParam          = "BasicParam"          // 基本参数配置
+	ConfigTypeVideoParamOpt       = "VideoParamOpt"       // 视频参数范围
+	ConfigTypeSVACEncodeConfig    = "SVACEncodeConfig"    // SVAC编码配置
+	ConfigTypeSVACDecodeConfig    = "SVACDecodeConfig"    // SVAC解码配置
+	ConfigTypeVideoParamAttribute = "VideoParamAttribute" // 视频参数属性配置，2022
+	ConfigTypeVideoRecordPlan     = "VideoRecordPlan"     // 录像计划配置，2022
+	ConfigTypeVideoAlarmRecord    = "VideoAlarmRecord"    // 报警录像配置，2022
+	ConfigTypePictureMask         = "PictureMask"         // 视频画面遮挡配置，2022
+	ConfigTypeFrameMirror         = "FrameMirror"         // 画面翻转配置，2022
+	ConfigTypeAlarmReport         = "AlarmReport"         // 报警上报开关配置，2022
+	ConfigTypeOSDConfig           = "OSDConfig"           // 前端OSD设置，2022
+	ConfigTypeSnapShot            = "SnapShotConfig"      // 图像抓拍配置，2022
+)
+
+// BasicParam 基本参数配置
+type BasicParam struct {
+	Name              string `xml:",omitempty"` // 设备名称
+	DeviceID          string `xml:",omitempty"`
+	SIPServerID       string `xml:",omitempty"`
+	SIPServerIP       string `xml:",omitempty"`
+	SIPServerPort     int    `xml:",omitempty"`
+	DomainName        string `xml:",omitempty"`
+	Expiration        int    `xml:",omitempty"` // 注册过期时间（秒）
+	Password          string `xml:",omitempty" json:"-"`
+	HeartBeatInterval int    `xml:",omitempty"` // 心跳间隔时间（秒）
+	HeartBeatCount    int    `xml:",omitempty"` // 心跳超时次数
+}
+
+// VideoParamOpt 视频参数范围，多个取值以 / 分隔
+type VideoParamOpt struct {
+	DownloadSpeed string // 下载倍速范围
+	Resolution    string // 摄像机支持的分辨率
+}
+
+type SVACEncodeConfig struct {
+	ROIParam struct {
+		ROIFlag            int
+		ROINumber          int
+		BackGroundQP       int
+		BackGroundSkipFlag int
+		Item               []struct {
+			ROISeq      int
+			TopLeft     int
+			BottomRight int
+			ROIQP       int
+		}
+	}
+	SVCParam struct {
+		SVCFlag            int
+		SVCSTMMode         int
+		SVCSpaceDomainMode int
+		SVCTimeDomainMode  int
+	}
+	SurveillanceParam struct {
+		TimeFlag  int
+		EventFlag int
+		AlertFlag int
+	}
+	EncryptParam struct {
+		EncryptionFlag     int
+		AuthenticationFlag int
+	}
+	AudioParam struct {
+		AudioRecognitionFlag int
+	}
+}
+
+type SVACDecodeConfig struct {
+	SVCParam struct {
+		SVCSTMMode int
+	}
+	SurveillanceParam struct {
+		TimeShowFlag  int
+		EventShowFlag int
+		AlerShowtFlag int
+	}
+}
+
+// VideoParamAttribute 视频参数属性，每路码流一项
+type VideoParamAttribute struct {
+	Item []struct {
+		StreamNumber int    // 码流编号，0为主码流
+		VideoFormat  string // 视频编码格式
+		Resolution   string
+		FrameRate    string
+		BitRateType  string // 码率类型，1为固定码率，2为可变码率
+		VideoBitRate string // 视频码率（kbps）
+	}
+}
+
+type RecordTimeSegment struct {
+	StartHour int
+	StartMin  int
+	StartSec  int
+	StopHour  int
+	StopMin   int
+	StopSec   int
+}
+
+// VideoRecordPlan 录像计划
+type VideoRecordPlan struct {
+	RecordEnable         int // 是否启用录像计划，0为关闭，1为启用
+	RecordScheduleSumNum int
+	RecordSchedule       []struct {
+		WeekDayNum        int // 星期，1-7 表示周一至周日
+		TimeSegmentSumNum int
+		TimeSegment       []RecordTimeSegment
+	}
+	StreamNumber int
+}
+
+// VideoAlarmRecord 报警录像配置
+type VideoAlarmRecord struct {
+	RecordEnable  int
+	RecordTime    int // 录像时长（秒）
+	PreRecordTime int // 预录时长（秒）
+	StreamNumber  int
+}
+
+// PictureMask 画面遮挡
+type PictureMask struct {
+	On         int
+	SumNum     int
+	RegionList []struct {
+		Seq   int
+		Point string // 区域左上角及右下角坐标，以逗号分隔
+	} `xml:"RegionList>Item"`
+}
+
+// AlarmReport 报警上报开关
+type AlarmReport struct {
+	MotionDetection int
+	FieldDetection  int
+}
+
+// OSDConfig 前端OSD设置
+type OSDConfig struct {
+	Length     int // 配置窗口长度像素值
+	Width      int
+	TimeX      int // 时间的左上角横坐标
+	TimeY      int
+	TimeEnable int
+	TimeType   int // 时间显示类型
+	TextEnable int
+	SumNum     int
+	Item       []struct {
+		Text string
+		X    int
+		Y    int
+	}
+}
+
+// SnapShotConfig 图像抓拍配置
+type SnapShotConfig struct {
+	SnapNum   int    // 连拍张数
+	Interval  int    // 单张抓拍间隔时间（秒）
+	UploadURL string // 抓拍图像上传路径
+	SessionID string
+}
+
+// ConfigDownloadResponse 设备配置查询应答，只包含查询的配置类型
+type ConfigDownloadResponse struct {
+	XMLName xml.Name `xml:"Response" json:"-"`
+	Header
+	Result              string
+	BasicParam          *BasicParam          `json:",omitempty"`
+	VideoParamOpt       *VideoParamOpt       `json:",omitempty"`
+	SVACEncodeConfig    *SVACEncodeConfig    `json:",omitempty"`
+	SVACDecodeConfig    *SVACDecodeConfig    `json:",omitempty"`
+	VideoParamAttribute *VideoParamAttribute `json:",omitempty"`
+	VideoRecordPlan     *VideoRecordPlan     `json:",omitempty"`
+	VideoAlarmRecord    *VideoAlarmRecord    `json:",omitempty"`
+	PictureMask         *PictureMask         `json:",omitempty"`
+	FrameMirror         *int                 `json:",omitempty"` // 画面翻转，0为不翻转，1为左右翻转，2为上下翻转，3为中心翻转
+	AlarmReport         *AlarmReport         `json:",omitempty"`
+	OSDConfig           *OSDConfig           `json:",omitempty"`
+	SnapShotConfig      *SnapShotConfig      `json:",omitempty"`
+}
+
+// Failed 部分设备应答中不带 Result，只有 Result 不为空且不是 OK 时才视为失败
+func (r *ConfigDownloadResponse) Failed() bool {
+	return r.Result != "" && r.Result != ResultOK
+}
+
+// Merge 合并同一次查询的多条应答，部分设备会把每种配置分为一条消息返回
+func (r *ConfigDownloadResponse) Merge(o *ConfigDownloadResponse) {
+	if r.Result == "" || o.Failed() {
+		r.Result = o.Result
+	}
+	if o.BasicParam != nil {
+		r.BasicParam = o.BasicParam
+	}
+	if o.VideoParamOpt != nil {
+		r.VideoParamOpt = o.VideoParamOpt
+	}
+	if o.SVACEncodeConfig != nil {
+		r.SVACEncodeConfig = o.SVACEncodeConfig
+	}
+	if o.SVACDecodeConfig != nil {
+		r.SVACDecodeConfig = o.SVACDecodeConfig
+	}
+	if o.VideoParamAttribute != nil {
+		r.VideoParamAttribute = o.VideoParamAttribute
+	}
+	if o.VideoRecordPlan != nil {
+		r.VideoRecordPlan = o.VideoRecordPlan
+	}
+	if o.VideoAlarmRecord != nil {
+		r.VideoAlarmRecord = o.VideoAlarmRecord
+	}
+	if o.PictureMask != nil {
+		r.PictureMask = o.PictureMask
+	}
+	if o.FrameMirror != nil {
+		r.FrameMirror = o.FrameMirror
+	}
+	if o.AlarmReport != nil {
+		r.AlarmReport = o.AlarmReport
+	}
+	if o.OSDConfig != nil {
+		r.OSDConfig = o.OSDConfig
+	}
+	if o.SnapShotConfig != nil {
+		r.SnapShotConfig = o.SnapShotConfig
+	}
+}
+
+// Has 是否包含某种配置
+func (r *ConfigDownloadResponse) Has(configType string) bool {
+	switch configType {
+	case ConfigTypeBasicParam:
+		return r.BasicParam != nil
+	case ConfigTypeVideoParamOpt:
+		return r.VideoParamOpt != nil
+	case ConfigTypeSVACEncodeConfig:
+		return r.SVACEncodeConfig != nil
+	case ConfigTypeSVACDecodeConfig:
+		return r.SVACDecodeConfig != nil
+	case ConfigTypeVideoParamAttribute:
+		return r.VideoParamAttribute != nil
+	case ConfigTypeVideoRecordPlan:
+		return r.VideoRecordPlan != nil
+	case ConfigTypeVideoAlarmRecord:
+		return r.VideoAlarmRecord != nil
+	case ConfigTypePictureMask:
+		return r.PictureMask != nil
+	case ConfigTypeFrameMirror:
+		return r.FrameMirror != nil
+	case ConfigTypeAlarmReport:
+		return r.AlarmReport != nil
+	case ConfigTypeOSDConfig:
+		return r.OSDConfig != nil
+	case ConfigTypeSnapShot:
+		return r.SnapShotConfig != nil
+	}
+	return true
+}
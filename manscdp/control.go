@@ -0,0 +1,79 @@
+package manscdp
+
+import "encoding/xml"
+
+// 设备控制命令取值
+const (
+	TeleBoot   = "Boot"
+	Record     = "Record"
+	StopRecord = "StopRecord"
+	SetGuard   = "SetGuard"
+	ResetGuard = "ResetGuard"
+	ResetAlarm = "ResetAlarm"
+	IFameSend  = "Send"
+)
+
+// DragZoom 拉框放大/缩小，坐标以播放窗口像素为单位
+type DragZoom struct {
+	Length    int // 播放窗口长度像素值
+	Width     int // 播放窗口宽度像素值
+	MidPointX int // 拉框中心的横轴坐标像素值
+	MidPointY int // 拉框中心的纵轴坐标像素值
+	LengthX   int // 拉框长度像素值
+	LengthY   int // 拉框宽度像素值
+}
+
+// HomePosition 看守位控制
+type HomePosition struct {
+	Enabled     int // 1为开启，0为关闭
+	ResetTime   int `xml:",omitempty"` // 自动归位时间（秒）
+	PresetIndex int `xml:",omitempty"` // 看守位使用的预置位
+}
+
+// PTZPreciseCtrl PTZ精准控制，2022
+type PTZPreciseCtrl struct {
+	Pan               float64 // 水平角度，0-360
+	Tilt              float64 // 垂直角度，-30-90
+	Zoom              float64 // 变倍倍数
+	Focus             float64 `xml:",omitempty"`
+	Iris              float64 `xml:",omitempty"`
+	ZoomDirection     int     `xml:",omitempty"`
+	FocusDirection    int     `xml:",omitempty"`
+	HorizontalSpeed   float64 `xml:",omitempty"`
+	VerticalSpeed     float64 `xml:",omitempty"`
+	HorizontalMaxView string  `xml:",omitempty"`
+	VerticalMaxView   string  `xml:",omitempty"`
+}
+
+// AlarmCmdInfo 报警复位的报警方式和类型
+type AlarmCmdInfo struct {
+	AlarmMethod int `xml:",omitempty"`
+	AlarmType   int `xml:",omitempty"`
+}
+
+// DeviceControl 设备控制，每次只设置一种控制命令
+type DeviceControl struct {
+	XMLName xml.Name `xml:"Control"`
+	Header
+	PTZCmd       string        `xml:",omitempty"`
+	TeleBoot     string        `xml:",omitempty"`
+	RecordCmd    string        `xml:",omitempty"`
+	GuardCmd     string        `xml:",omitempty"`
+	AlarmCmd     string        `xml:",omitempty"`
+	IFameCmd     string        `xml:",omitempty"`
+	DragZoomIn   *DragZoom     `xml:",omitempty"`
+	DragZoomOut  *DragZoom     `xml:",omitempty"`
+	HomePosition *HomePosition `xml:",omitempty"`
+	Info         *AlarmCmdInfo `xml:",omitempty"`
+	// 2022 新增
+	PTZPreciseCtrl *PTZPreciseCtrl `xml:",omitempty"`
+	FormatSDCard   int             `xml:",omitempty"` // 格式化存储卡，取值为存储卡编号
+}
+
+// DeviceConfig 设备配置，每次只设置一种配置
+type DeviceConfig struct {
+	XMLName xml.Name `xml:"Control"`
+	Header
+	BasicParam     *BasicParam     `xml:",omitempty"`
+	SnapShotConfig *SnapShotConfig `xml:",omitempty"` // 图像抓拍，2022
+}
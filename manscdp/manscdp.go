@@ -0,0 +1,96 @@
+// Package manscdp 定义 GB28181 中 MANSCDP 协议的消息结构，以及消息的编码和解码
+package manscdp
+
+import (
+	"bytes"
+	"encoding/xml"
+
+	"golang.org/x/net/html/charset"
+	"m7s.live/plugin/gb28181/v4/utils"
+)
+
+// 消息类型，即根元素名称
+const (
+	RootQuery    = "Query"
+	RootControl  = "Control"
+	RootNotify   = "Notify"
+	RootResponse = "Response"
+)
+
+// CmdType 命令类型
+const (
+	CmdCatalog        = "Catalog"
+	CmdDeviceInfo     = "DeviceInfo"
+	CmdDeviceStatus   = "DeviceStatus"
+	CmdRecordInfo     = "RecordInfo"
+	CmdPresetQuery    = "PresetQuery"
+	CmdConfigDownload = "ConfigDownload"
+	CmdMobilePosition = "MobilePosition"
+	CmdAlarm          = "Alarm"
+	CmdKeepalive      = "Keepalive"
+	CmdMediaStatus    = "MediaStatus"
+	CmdBroadcast      = "Broadcast"
+	CmdDeviceControl  = "DeviceControl"
+	CmdDeviceConfig   = "DeviceConfig"
+
+	// GB/T 28181-2022 新增
+	CmdSDCardStatus           = "SDCardStatus"           // 存储卡状态查询
+	CmdHomePositionQuery      = "HomePositionQuery"      // 看守位信息查询
+	CmdPTZPosition            = "PTZPosition"            // PTZ精准状态查询
+	CmdCruiseTrackListQuery   = "CruiseTrackListQuery"   // 巡航轨迹列表查询
+	CmdCruiseTrackQuery       = "CruiseTrackQuery"       // 巡航轨迹查询
+	CmdUploadSnapShotFinished = "UploadSnapShotFinished" // 图像抓拍传输完成通知
+	CmdDeviceUpgradeResult    = "DeviceUpgradeResult"    // 设备软件升级结果通知
+)
+
+// 应答结果
+const (
+	ResultOK    = "OK"
+	ResultError = "ERROR"
+)
+
+// Header 所有消息共有的字段
+type Header struct {
+	CmdType  string
+	SN       int // 命令序列号，用于关联请求和应答
+	DeviceID string
+}
+
+// Message 用于在解码具体消息前判断消息类型，只解析公共字段
+type Message struct {
+	XMLName xml.Name
+	Header
+	SumNum     int    // 分多条返回时的条目总数
+	Result     string // 应答结果
+	NotifyType string // 媒体通知类型
+}
+
+// Root 消息类型，Query、Control、Notify 或 Response
+func (m *Message) Root() string {
+	return m.XMLName.Local
+}
+
+// Encode 将消息编码为 xml，带 xml 声明
+func Encode(v any) (string, error) {
+	data, err := xml.MarshalIndent(v, "", " ")
+	if err != nil {
+		return "", err
+	}
+	return `<?xml version="1.0"?>` + "\n" + string(data) + "\n", nil
+}
+
+// Decode 解码消息，优先按 xml 声明的编码解析，失败后按 GBK 解析
+func Decode(body []byte, v any) error {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.CharsetReader = charset.NewReaderLabel
+	if err := decoder.Decode(v); err != nil {
+		return utils.DecodeGbk(v, body)
+	}
+	return nil
+}
+
+// Peek 解析消息的公共字段
+func Peek(body []byte) (*Message, error) {
+	m := &Message{}
+	return m, Decode(body, m)
+}
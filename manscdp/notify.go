@@ -0,0 +1,92 @@
+package manscdp
+
+import "encoding/xml"
+
+// Keepalive 状态信息报送（心跳）
+type Keepalive struct {
+	XMLName xml.Name `xml:"Notify"`
+	Header
+	Status string // OK / ERROR
+	Info   *struct {
+		DeviceID []string // 故障的通道，2022
+	} `xml:",omitempty"`
+}
+
+// FaultyChannels 心跳中上报的故障通道
+func (k *Keepalive) FaultyChannels() []string {
+	if k.Info == nil {
+		return nil
+	}
+	return k.Info.DeviceID
+}
+
+// AlarmNotify 报警通知，部分设备对数值字段返回空元素，使用字符串避免解码失败
+type AlarmNotify struct {
+	XMLName xml.Name `xml:"Notify"`
+	Header
+	AlarmPriority    string // 报警级别，1-4
+	AlarmMethod      string // 报警方式
+	AlarmTime        string // 报警时间
+	AlarmDescription string `xml:",omitempty"`
+	Longitude        string `xml:",omitempty"`
+	Latitude         string `xml:",omitempty"`
+	Info             *struct {
+		AlarmType      string
+		AlarmTypeParam struct {
+			EventType string
+		}
+	} `xml:",omitempty"`
+}
+
+// MediaStatus 媒体通知
+type MediaStatus struct {
+	XMLName xml.Name `xml:"Notify"`
+	Header
+	NotifyType string // 121 表示历史媒体文件发送结束
+}
+
+// Broadcast 语音广播通知
+type Broadcast struct {
+	XMLName  xml.Name `xml:"Notify"`
+	CmdType  string
+	SN       int
+	SourceID string // 语音输入设备
+	TargetID string // 语音输出设备
+}
+
+// MobilePositionNotify 移动设备位置通知
+type MobilePositionNotify struct {
+	XMLName xml.Name `xml:"Notify"`
+	Header
+	Time      string
+	Longitude string
+	Latitude  string
+	Speed     float64 `xml:",omitempty"`
+	Direction float64 `xml:",omitempty"`
+	Altitude  float64 `xml:",omitempty"`
+}
+
+// UploadSnapShotFinished 图像抓拍传输完成通知，2022
+type UploadSnapShotFinished struct {
+	XMLName xml.Name `xml:"Notify"`
+	Header
+	SessionID    string
+	SnapShotList []string `xml:"SnapShotList>SnapShotFileID"` // 上传成功的图像文件
+}
+
+// PTZPositionNotify PTZ精准状态订阅通知，2022
+type PTZPositionNotify struct {
+	XMLName xml.Name `xml:"Notify"`
+	Header
+	PTZPosition
+}
+
+// DeviceUpgradeResult 设备软件升级结果通知，2022
+type DeviceUpgradeResult struct {
+	XMLName xml.Name `xml:"Notify"`
+	Header
+	SessionID           string
+	Firmware            string
+	Result              string // OK / ERROR
+	UpgradeFailedReason string `xml:",omitempty"`
+}
@@ -0,0 +1,84 @@
+package manscdp
+
+import "encoding/xml"
+
+// CatalogQuery 目录查询，也用于目录订阅
+type CatalogQuery struct {
+	XMLName xml.Name `xml:"Query"`
+	Header
+}
+
+// DeviceInfoQuery 设备信息查询
+type DeviceInfoQuery struct {
+	XMLName xml.Name `xml:"Query"`
+	Header
+}
+
+// DeviceStatusQuery 设备状态查询
+type DeviceStatusQuery struct {
+	XMLName xml.Name `xml:"Query"`
+	Header
+}
+
+// RecordInfoQuery 录像文件检索
+type RecordInfoQuery struct {
+	XMLName xml.Name `xml:"Query"`
+	Header
+	StartTime  string
+	EndTime    string
+	FilePath   string `xml:",omitempty"`
+	Address    string `xml:",omitempty"`
+	Secrecy    int
+	Type       string // 录像产生类型，time、alarm、manual、all
+	RecorderID string `xml:",omitempty"`
+}
+
+// PresetQuery 预置位查询
+type PresetQuery struct {
+	XMLName xml.Name `xml:"Query"`
+	Header
+}
+
+// ConfigDownloadQuery 设备配置查询
+type ConfigDownloadQuery struct {
+	XMLName xml.Name `xml:"Query"`
+	Header
+	ConfigType string // 配置类型，多个以 / 分隔
+}
+
+// MobilePositionQuery 移动设备位置订阅
+type MobilePositionQuery struct {
+	XMLName xml.Name `xml:"Query"`
+	Header
+	Interval int // 上报间隔（秒）
+}
+
+// AlarmQuery 报警订阅
+type AlarmQuery struct {
+	XMLName xml.Name `xml:"Query"`
+	Header
+	StartAlarmPriority int
+	EndAlarmPriority   int
+	AlarmMethod        int
+	StartAlarmTime     string `xml:",omitempty"`
+	EndAlarmTime       string `xml:",omitempty"`
+}
+
+// SDCardStatusQuery 存储卡状态查询，2022
+type SDCardStatusQuery struct {
+	XMLName xml.Name `xml:"Query"`
+	Header
+}
+
+// HomePositionQuery 看守位信息查询，2022
+type HomePositionQuery struct {
+	XMLName xml.Name `xml:"Query"`
+	Header
+}
+
+// PTZPositionQuery PTZ精准状态查询，2022，Interval 不为 0 时用于订阅
+type PTZPositionQuery struct {
+	XMLName xml.Name `xml:"Query"`
+	Header
+	Interval int `xml:",omitempty"` // 订阅时的上报间隔（秒）
+}
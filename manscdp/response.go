@@ -0,0 +1,201 @@
+package manscdp
+
+import "encoding/xml"
+
+// ResultResponse 只携带执行结果的应答，用于设备控制、设备配置、报警通知、语音广播等
+type ResultResponse struct {
+	XMLName xml.Name `xml:"Response" json:"-"`
+	Header
+	Result string
+}
+
+// Failed 部分设备应答中不带 Result，只有 Result 不为空且不是 OK 时才视为失败
+func (r *ResultResponse) Failed() bool {
+	return r.Result != "" && r.Result != ResultOK
+}
+
+// CatalogItem 目录项
+type CatalogItem struct {
+	DeviceID     string
+	Name         string
+	Manufacturer string `xml:",omitempty"`
+	Model        string `xml:",omitempty"`
+	Owner        string `xml:",omitempty"`
+	CivilCode    string `xml:",omitempty"`
+	Block        string `xml:",omitempty"`
+	Address      string `xml:",omitempty"`
+	Parental     int
+	ParentID     string `xml:",omitempty"`
+	SafetyWay    int    `xml:",omitempty"`
+	RegisterWay  int
+	CertNum      string `xml:",omitempty"`
+	Certifiable  int    `xml:",omitempty"`
+	ErrCode      int    `xml:",omitempty"`
+	EndTime      string `xml:",omitempty"`
+	Secrecy      int
+	IPAddress    string `xml:",omitempty"`
+	Port         int    `xml:",omitempty"`
+	Password     string `xml:",omitempty" json:"-"`
+	Status       string
+	Longitude    string `xml:",omitempty"`
+	Latitude     string `xml:",omitempty"`
+	Event        string `xml:",omitempty"` // 目录通知中的状态改变事件
+	// 2022 新增
+	BusinessGroupID   string       `xml:",omitempty"` // 虚拟组织所属的业务分组ID
+	SecurityLevelCode string       `xml:",omitempty"` // 安全防范级别
+	Info              *CatalogInfo `xml:",omitempty" json:",omitempty"`
+}
+
+// CatalogInfo 目录项的扩展信息，2022
+type CatalogInfo struct {
+	PTZType                  int    `xml:",omitempty"` // 摄像机结构类型，1-球机，2-半球，3-固定枪机，4-遥控枪机，5-遥控半球，6-多目设备的全景/拼接通道，7-多目设备的分割通道
+	PhotoelectricImagingType string `xml:",omitempty"` // 摄像机光电成像类型，多个以 / 分隔
+	CapturePositionType      string `xml:",omitempty"` // 采集部位类型
+	RoomType                 int    `xml:",omitempty"` // 1-室外，2-室内
+	SupplyLightType          int    `xml:",omitempty"` // 补光属性
+	DirectionType            int    `xml:",omitempty"` // 监视方位
+	Resolution               string `xml:",omitempty"` // 支持的分辨率，多个以 / 分隔
+	StreamNumberList         string `xml:",omitempty"` // 支持的码流编号列表，以 / 分隔
+	DownloadSpeed            string `xml:",omitempty"` // 支持的下载倍速，以 / 分隔
+	SVCSpaceSupportMode      int    `xml:",omitempty"`
+	SVCTimeSupportMode       int    `xml:",omitempty"`
+	SSVCRatioSupportList     string `xml:",omitempty"`
+	MobileDeviceType         int    `xml:",omitempty"` // 移动采集设备类型
+	HorizontalFieldAngle     string `xml:",omitempty"` // 摄像机水平视场角
+	VerticalFieldAngle       string `xml:",omitempty"` // 摄像机竖直视场角
+	MaxViewDistance          string `xml:",omitempty"` // 摄像机可视距离（米）
+	GrassrootsCode           string `xml:",omitempty"` // 基层组织编码
+	PointType                int    `xml:",omitempty"` // 监控点位类型
+	PointCommonName          string `xml:",omitempty"` // 点位俗称
+	MAC                      string `xml:",omitempty"`
+	FunctionType             string `xml:",omitempty"` // 摄像机卡口功能类型
+	EncodeType               string `xml:",omitempty"` // 摄像机视频编码格式
+	InstallTime              string `xml:",omitempty"`
+	ManagementUnit           string `xml:",omitempty"` // 摄像机所属管理单位名称
+	ContactInfo              string `xml:",omitempty"`
+	RecordSaveDays           int    `xml:",omitempty"` // 录像保存天数
+	IndustrialClassification string `xml:",omitempty"` // 国民经济行业分类代码
+}
+
+// CatalogResponse 目录查询应答，也用于目录通知
+type CatalogResponse struct {
+	XMLName xml.Name `xml:"Response" json:"-"`
+	Header
+	SumNum     int
+	DeviceList struct {
+		Num   int           `xml:"Num,attr"`
+		Items []CatalogItem `xml:"Item"`
+	}
+}
+
+// DeviceInfoResponse 设备信息查询应答
+type DeviceInfoResponse struct {
+	XMLName xml.Name `xml:"Response" json:"-"`
+	Header
+	DeviceName   string
+	Result       string
+	Manufacturer string
+	Model        string
+	Firmware     string
+	Channel      int `xml:",omitempty"` // 视频输入通道数
+}
+
+// AlarmStatusItem 报警设备状态
+type AlarmStatusItem struct {
+	DeviceID   string
+	DutyStatus string // ONDUTY / OFFDUTY / ALARM
+}
+
+// DeviceStatusResponse 设备状态查询应答
+type DeviceStatusResponse struct {
+	XMLName xml.Name `xml:"Response" json:"-"`
+	Header
+	Result      string
+	Online      string            // ONLINE / OFFLINE
+	Status      string            // 是否正常工作，OK / ERROR
+	Reason      string            `xml:",omitempty"` // 不正常工作原因
+	Encode      string            `xml:",omitempty"` // 是否编码，ON / OFF
+	Record      string            `xml:",omitempty"` // 是否录像，ON / OFF
+	DeviceTime  string            `xml:",omitempty"`
+	AlarmStatus []AlarmStatusItem `xml:"Alarmstatus>Item,omitempty"`
+}
+
+// RecordItem 录像文件
+type RecordItem struct {
+	DeviceID   string
+	Name       string
+	FilePath   string
+	Address    string
+	StartTime  string
+	EndTime    string
+	Secrecy    int
+	Type       string
+	RecorderID string `xml:",omitempty"`
+	FileSize   string `xml:",omitempty"`
+}
+
+// RecordInfoResponse 录像文件检索应答，可能分多条返回
+type RecordInfoResponse struct {
+	XMLName xml.Name `xml:"Response" json:"-"`
+	Header
+	Name       string
+	SumNum     int
+	RecordList []RecordItem `xml:"RecordList>Item"`
+}
+
+// PresetItem 预置位
+type PresetItem struct {
+	PresetID   int
+	PresetName string
+}
+
+// PresetQueryResponse 预置位查询应答
+type PresetQueryResponse struct {
+	XMLName xml.Name `xml:"Response" json:"-"`
+	Header
+	SumNum     int          `xml:",omitempty"`
+	PresetList []PresetItem `xml:"PresetList>Item"`
+}
+
+// SDCardItem 存储卡状态
+type SDCardItem struct {
+	ID             int
+	HddName        string
+	Status         string // 状态，formatting、formatted、unformatted 等
+	FormatProgress int    `xml:",omitempty"` // 格式化进度
+	Capacity       int64  // 容量（MB）
+	FreeSpace      int64  // 剩余空间（MB）
+}
+
+// SDCardStatusResponse 存储卡状态查询应答，2022
+type SDCardStatusResponse struct {
+	XMLName xml.Name `xml:"Response" json:"-"`
+	Header
+	SumNum     int
+	SDCardList []SDCardItem `xml:"SDCardList>Item"`
+}
+
+// HomePositionResponse 看守位信息查询应答，2022
+type HomePositionResponse struct {
+	XMLName xml.Name `xml:"Response" json:"-"`
+	Header
+	Result       string        `xml:",omitempty"`
+	HomePosition *HomePosition `xml:",omitempty"`
+}
+
+// PTZPosition PTZ精准状态，部分设备返回空元素，使用字符串避免解码失败
+type PTZPosition struct {
+	Pan                  string // 水平角度
+	Tilt                 string // 垂直角度
+	Zoom                 string // 变倍倍数
+	HorizontalFieldAngle string `xml:",omitempty"` // 水平视场角
+	VerticalFieldAngle   string `xml:",omitempty"` // 垂直视场角
+	MaxViewDistance      string `xml:",omitempty"` // 最大可视距离（米）
+}
+
+// PTZPositionResponse PTZ精准状态查询应答，2022
+type PTZPositionResponse struct {
+	XMLName xml.Name `xml:"Response" json:"-"`
+	Header
+	PTZPosition
+}
@@ -0,0 +1,60 @@
+package gb28181
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var TCP_ACTIVE_DIAL_TIMEOUT = time.Second * 5
+
+// tcpActiveRelay TCP 主动模式下连接设备的媒体端口，并将收到的 RTP 原样转发到本地 PS 接收端口
+// 两端都是 RFC4571 的 TCP 分帧，不需要解析
+type tcpActiveRelay struct {
+	remote net.Conn
+	local  net.Conn
+	once   sync.Once
+}
+
+// dialTCPActive 连接设备的媒体地址，设备可能在发送应答后才开始监听，连接失败时在超时前重试
+func dialTCPActive(remote string, localPort uint16) (*tcpActiveRelay, error) {
+	var rc net.Conn
+	var err error
+	deadline := time.Now().Add(TCP_ACTIVE_DIAL_TIMEOUT)
+	for {
+		if rc, err = net.DialTimeout("tcp", remote, TCP_ACTIVE_DIAL_TIMEOUT); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if err != nil {
+		return nil, err
+	}
+	lc, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", localPort), TCP_ACTIVE_DIAL_TIMEOUT)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	r := &tcpActiveRelay{remote: rc, local: lc}
+	go r.run()
+	return r, nil
+}
+
+func (r *tcpActiveRelay) run() {
+	// 本地接收端关闭连接时同时断开设备
+	go func() {
+		io.Copy(io.Discard, r.local)
+		r.Close()
+	}()
+	io.Copy(r.local, r.remote)
+	r.Close()
+}
+
+func (r *tcpActiveRelay) Close() {
+	r.once.Do(func() {
+		r.remote.Close()
+		r.local.Close()
+	})
+}
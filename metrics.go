@@ -0,0 +1,265 @@
+package gb28181
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// 以 Prometheus 文本格式输出的监控指标，不依赖 Prometheus 客户端库
+
+// metricVec 带标签的计数器
+type metricVec struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]float64 // key 为以 \xff 连接的标签值
+	sync.Mutex
+}
+
+func newCounterVec(name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (m *metricVec) Inc(labelValues ...string) {
+	m.Lock()
+	defer m.Unlock()
+	m.values[strings.Join(labelValues, "\xff")]++
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, strings.Split(k, "\xff")), formatFloat(m.values[k]))
+	}
+}
+
+// histogramVec 带一个标签的直方图
+type histogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+	series  map[string]*histogram
+	sync.Mutex
+}
+
+type histogram struct {
+	counts []uint64 // 每个桶的累计数量
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help, label string, buckets ...float64) *histogramVec {
+	return &histogramVec{name: name, help: help, label: label, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) Observe(labelValue string, v float64) {
+	h.Lock()
+	defer h.Unlock()
+	s, ok := h.series[labelValue]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[labelValue] = s
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels([]string{h.label, "le"}, []string{k, formatFloat(le)}), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels([]string{h.label, "le"}, []string{k, "+Inf"}), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels([]string{h.label}, []string{k}), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels([]string{h.label}, []string{k}), s.count)
+	}
+}
+
+// writeGauge 输出抓取时计算的指标，values 的 key 为唯一标签的取值
+func writeGauge(w io.Writer, name, help, label string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	if label == "" {
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(values[""]))
+		return
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels([]string{label}, []string{k}), formatFloat(values[k]))
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		if i < len(values) {
+			b.WriteString(labelEscaper.Replace(values[i]))
+		}
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// 插件运行期间累计的指标
+var metrics = struct {
+	sipRequests      *metricVec
+	sipResponses     *metricVec
+	sipLatency       *histogramVec
+	invites          *metricVec
+	responseTimeouts *metricVec
+	authFailures     *metricVec
+	registerRejected *metricVec
+}{
+	sipRequests:      newCounterVec("gb28181_sip_requests_total", "SIP requests by direction and method", "direction", "method"),
+	sipResponses:     newCounterVec("gb28181_sip_responses_total", "SIP responses by direction, method and status code", "direction", "method", "code"),
+	sipLatency:       newHistogramVec("gb28181_sip_transaction_duration_seconds", "Duration of outgoing SIP transactions", "method", 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30),
+	invites:          newCounterVec("gb28181_invites_total", "Invites sent to devices by result", "result"),
+	responseTimeouts: newCounterVec("gb28181_response_timeouts_total", "MANSCDP queries whose response did not complete in time, by CmdType", "cmd_type"),
+	authFailures:     newCounterVec("gb28181_auth_failures_total", "REGISTER requests with wrong credentials"),
+	registerRejected: newCounterVec("gb28181_register_rejected_total", "REGISTER requests rejected with 403 by reason", "reason"),
+}
+
+// observeTransaction 记录一次发出的 SIP 请求及其应答
+func observeTransaction(req sip.Request, resp sip.Response, err error, start time.Time) {
+	method := string(req.Method())
+	metrics.sipRequests.Inc("out", method)
+	metrics.sipLatency.Observe(method, time.Since(start).Seconds())
+	code := "error"
+	if err == nil && resp != nil {
+		code = strconv.Itoa(int(resp.StatusCode()))
+	}
+	metrics.sipResponses.Inc("out", method, code)
+}
+
+// metricTransaction 统计本服务对收到的请求发出的应答
+type metricTransaction struct {
+	sip.ServerTransaction
+	method string
+}
+
+func (tx *metricTransaction) Respond(res sip.Response) error {
+	metrics.sipResponses.Inc("in", tx.method, strconv.Itoa(int(res.StatusCode())))
+	return tx.ServerTransaction.Respond(res)
+}
+
+// instrument 统计收到的 SIP 请求
+func instrument(handler gosip.RequestHandler) gosip.RequestHandler {
+	return func(req sip.Request, tx sip.ServerTransaction) {
+		method := string(req.Method())
+		metrics.sipRequests.Inc("in", method)
+		if tx != nil {
+			tx = &metricTransaction{ServerTransaction: tx, method: method}
+		}
+		handler(req, tx)
+	}
+}
+
+func (c *GB28181Config) API_metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	devices := map[string]float64{}
+	channels := map[string]float64{}
+	registered := 0
+	Devices.Range(func(key, value any) bool {
+		d := value.(*Device)
+		registered++
+		devices[string(d.Status)]++
+		d.channelMap.Range(func(key, value any) bool {
+			status := string(value.(*Channel).Status)
+			if status == "" {
+				status = "UNKNOWN"
+			}
+			channels[status]++
+			return true
+		})
+		return true
+	})
+	writeGauge(bw, "gb28181_devices_registered", "Devices currently registered", "", map[string]float64{"": float64(registered)})
+	writeGauge(bw, "gb28181_devices", "Registered devices by status", "status", devices)
+	writeGauge(bw, "gb28181_channels", "Channels by status", "status", channels)
+
+	pulls := 0
+	PullStreams.Range(func(key, value any) bool {
+		pulls++
+		return true
+	})
+	writeGauge(bw, "gb28181_pull_streams", "Active streams pulled from devices", "", map[string]float64{"": float64(pulls)})
+	writeGauge(bw, "gb28181_media_ports_used", "Media ports allocated from the port range", "network", map[string]float64{
+		"tcp": float64(c.tcpPorts.Used()),
+		"udp": float64(c.udpPorts.Used()),
+	})
+	writeGauge(bw, "gb28181_media_ports_total", "Size of the media port range", "network", map[string]float64{
+		"tcp": float64(c.tcpPorts.Size()),
+		"udp": float64(c.udpPorts.Size()),
+	})
+
+	banned := 0
+	DeviceRegisterCount.Range(func(key, value any) bool {
+		if value.(int) > MaxRegisterCount {
+			banned++
+		}
+		return true
+	})
+	writeGauge(bw, "gb28181_banned_devices", "Devices banned after repeated authentication failures", "", map[string]float64{"": float64(banned)})
+
+	metrics.sipRequests.write(bw)
+	metrics.sipResponses.write(bw)
+	metrics.sipLatency.write(bw)
+	metrics.invites.write(bw)
+	metrics.responseTimeouts.write(bw)
+	metrics.authFailures.write(bw)
+	metrics.registerRejected.write(bw)
+}
@@ -28,6 +28,26 @@ func (pm *PortManager) Range() uint16 {
 	return pm.max - pm.pos
 }
 
+// Size 端口范围内的端口总数
+func (pm *PortManager) Size() int {
+	if !pm.Valid {
+		return 0
+	}
+	return int(pm.max) - int(pm.start) + 1
+}
+
+// Used 已分配且未回收的端口数
+func (pm *PortManager) Used() int {
+	if !pm.Valid {
+		return 0
+	}
+	used := int(pm.pos) - int(pm.start) + 1 - len(pm.recycle)
+	if used < 0 {
+		return 0
+	}
+	return used
+}
+
 func (pm *PortManager) Recycle(p uint16) (err error) {
 	select {
 	case pm.recycle <- p:
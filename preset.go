@@ -0,0 +1,119 @@
+package gb28181
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/plugin/gb28181/v4/manscdp"
+)
+
+var PRESET_CACHE_TTL = time.Minute * 10 // 预置位列表缓存时间，设备本地修改预置位时无法感知
+
+// PresetInfo 预置位
+type PresetInfo struct {
+	PresetID   int
+	PresetName string
+}
+
+// PresetListResult 预置位查询结果，Partial 为 true 表示超时前未收齐 SumNum 条目
+type PresetListResult struct {
+	DeviceID   string
+	ChannelID  string
+	SumNum     int
+	Partial    bool
+	Cached     bool `json:",omitempty"`
+	UpdateTime time.Time
+	List       []PresetInfo
+}
+
+// presetCache 新增、删除预置位时失效，version 用于丢弃失效前发出的查询结果
+type presetCache struct {
+	result  *PresetListResult
+	version int
+	sync.Mutex
+}
+
+func (p *presetCache) load() *PresetListResult {
+	p.Lock()
+	defer p.Unlock()
+	if p.result == nil || time.Since(p.result.UpdateTime) > PRESET_CACHE_TTL {
+		return nil
+	}
+	copied := *p.result
+	copied.Cached = true
+	return &copied
+}
+
+func (p *presetCache) current() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.version
+}
+
+func (p *presetCache) store(version int, result *PresetListResult) {
+	p.Lock()
+	defer p.Unlock()
+	if version == p.version {
+		p.result = result
+	}
+}
+
+func (p *presetCache) invalidate() {
+	p.Lock()
+	defer p.Unlock()
+	p.version++
+	p.result = nil
+}
+
+// QueryPresets 查询预置位列表，useCache 为 true 时优先返回缓存的结果
+func (channel *Channel) QueryPresets(useCache bool) (*PresetListResult, error) {
+	if useCache {
+		if res := channel.presets.load(); res != nil {
+			return res, nil
+		}
+	}
+	version := channel.presets.current()
+	parts, err := channel.Device.QueryForResponse(channel.DeviceID, manscdp.CmdPresetQuery, QUERY_RECORD_TIMEOUT, func(sn int) string {
+		return BuildPresetListXML(sn, channel.DeviceID)
+	}, nil)
+	// 超时前只收到部分应答时按 SumNum 标记为 Partial
+	if err != nil && !errors.Is(err, ErrResponsePartial) {
+		return nil, err
+	}
+	res := &PresetListResult{DeviceID: channel.Device.ID, ChannelID: channel.DeviceID, UpdateTime: time.Now(), List: make([]PresetInfo, 0)}
+	seen := make(map[int]struct{})
+	for _, part := range parts {
+		p := part.(*manscdp.PresetQueryResponse)
+		if p.SumNum > res.SumNum {
+			res.SumNum = p.SumNum
+		}
+		for _, item := range p.PresetList {
+			if _, ok := seen[item.PresetID]; !ok {
+				seen[item.PresetID] = struct{}{}
+				res.List = append(res.List, PresetInfo{PresetID: item.PresetID, PresetName: item.PresetName})
+			}
+		}
+	}
+	sort.Slice(res.List, func(i, j int) bool {
+		return res.List[i].PresetID < res.List[j].PresetID
+	})
+	res.Partial = err != nil || len(res.List) < res.SumNum
+	if res.Partial {
+		channel.Warn("preset query partial", zap.Int("sumNum", res.SumNum), zap.Int("received", len(res.List)))
+	} else {
+		channel.presets.store(version, res)
+	}
+	return res, nil
+}
+
+// QueryPresetList 查询预置位列表，不使用缓存
+func (channel *Channel) QueryPresetList() ([]PresetInfo, error) {
+	res, err := channel.QueryPresets(false)
+	if err != nil {
+		return nil, err
+	}
+	return res.List, nil
+}
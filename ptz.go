@@ -4,6 +4,7 @@ import (
 	"encoding/hex"
 	"encoding/xml"
 	"fmt"
+	"strings"
 )
 
 var (
@@ -38,6 +39,43 @@ const (
 	PresetDel  = 0x83
 )
 
+// 巡航、扫描、辅助开关指令，GB/T 28181 附录 A.3.5～A.3.7
+const (
+	CruiseAddPoint = 0x84 // 加入巡航点，字节5为巡航组号，字节6为预置位号
+	CruiseDelPoint = 0x85 // 删除巡航点，预置位号为0时删除整条巡航
+	CruiseSpeed    = 0x86 // 设置巡航速度，字节6为速度低8位，字节7高4位为速度高4位
+	CruiseDwell    = 0x87 // 设置巡航停留时间（秒），编码方式同速度
+	CruiseStart    = 0x88 // 开始巡航
+	ScanStart      = 0x89 // 自动扫描，字节6为0开始扫描，1设置左边界，2设置右边界
+	ScanSpeed      = 0x8A // 设置自动扫描速度
+	AuxOn          = 0x8C // 辅助开关开，字节5为开关编号，如1为雨刷
+	AuxOff         = 0x8D // 辅助开关关
+)
+
+// 自动扫描的字节6
+const (
+	ScanOpStart = 0
+	ScanOpLeft  = 1
+	ScanOpRight = 2
+)
+
+// 聚焦、光圈指令（FI 指令），字节4的低4位，可组合，GB/T 28181 附录 A.3.3
+const (
+	FIStop      = 0x40
+	FIFocusFar  = 0x41
+	FIFocusNear = 0x42
+	FIIrisOpen  = 0x44
+	FIIrisClose = 0x48
+)
+
+var fiName2code = map[string]uint8{
+	"stop":      FIStop,
+	"focusfar":  FIFocusFar,
+	"focusnear": FIFocusNear,
+	"irisopen":  FIIrisOpen,
+	"irisclose": FIIrisClose,
+}
+
 type MessagePtz struct {
 	XMLName  xml.Name `xml:"Control"`
 	CmdType  string   `xml:"CmdType"`
@@ -92,6 +130,11 @@ func getAssembleCode() uint8 {
 }
 
 func Pack(cmd, point byte) string {
+	return packPTZ(cmd, 0, point, 0)
+}
+
+// packPTZ 按附录 A 组装8字节的 PTZ 指令，data3 为字节7的高4位，地址为0
+func packPTZ(cmd, data1, data2, data3 byte) string {
 	buf := make([]byte, 8)
 	buf[0] = PTZFirstByte
 	buf[1] = getAssembleCode()
@@ -99,9 +142,94 @@ func Pack(cmd, point byte) string {
 
 	buf[3] = cmd
 
-	buf[4] = 0
-	buf[5] = point
-	buf[6] = 0
+	buf[4] = data1
+	buf[5] = data2
+	buf[6] = data3 << 4
 	getVerificationCode(buf)
 	return hex.EncodeToString(buf)
 }
+
+// packPTZValue 巡航速度、停留时间、扫描速度为12位，低8位在字节6，高4位在字节7
+func packPTZValue(cmd, group byte, value uint16) (string, error) {
+	if value > 0xFFF {
+		return "", fmt.Errorf("value %d out of range 0-4095", value)
+	}
+	return packPTZ(cmd, group, byte(value), byte(value>>8)), nil
+}
+
+// toFIStr 聚焦、光圈指令，cmd 为 fiName2code 中的名称，多个以逗号分隔时组合，如 focusnear,irisopen
+func toFIStr(cmd string, focusSpeed, irisSpeed uint8) (string, error) {
+	var code uint8 = FIStop
+	for _, name := range strings.Split(cmd, ",") {
+		c, ok := fiName2code[strings.TrimSpace(name)]
+		if !ok {
+			return "", fmt.Errorf("invalid fi cmd %q", name)
+		}
+		code |= c
+	}
+	// 各指令都带 0x40，只比较低4位
+	focus, iris := code&(FIFocusFar|FIFocusNear)&0x0F, code&(FIIrisOpen|FIIrisClose)&0x0F
+	if focus == 0x03 || iris == 0x0C {
+		return "", fmt.Errorf("conflicting fi cmd %q", cmd)
+	}
+	return packPTZ(code, focusSpeed, irisSpeed, 0), nil
+}
+
+// FocusIris 聚焦、光圈控制，cmd 见 toFIStr
+func (channel *Channel) FocusIris(cmd string, focusSpeed, irisSpeed uint8) (int, error) {
+	ptzcmd, err := toFIStr(cmd, focusSpeed, irisSpeed)
+	if err != nil {
+		return 0, err
+	}
+	return channel.Control(ptzcmd), nil
+}
+
+// Cruise 巡航控制，cmd 为 CruiseXXX，value 为预置位号、速度或停留时间
+func (channel *Channel) Cruise(cmd, group byte, value uint16) (int, error) {
+	var ptzcmd string
+	var err error
+	switch cmd {
+	case CruiseAddPoint, CruiseDelPoint:
+		if value > 0xFF {
+			return 0, fmt.Errorf("preset %d out of range 0-255", value)
+		}
+		ptzcmd = packPTZ(cmd, group, byte(value), 0)
+	case CruiseSpeed, CruiseDwell:
+		if ptzcmd, err = packPTZValue(cmd, group, value); err != nil {
+			return 0, err
+		}
+	case CruiseStart:
+		ptzcmd = packPTZ(cmd, group, 0, 0)
+	default:
+		return 0, fmt.Errorf("invalid cruise cmd 0x%02X", cmd)
+	}
+	return channel.Control(ptzcmd), nil
+}
+
+// Scan 自动扫描，op 为 ScanOpXXX
+func (channel *Channel) Scan(group, op byte) int {
+	return channel.Control(packPTZ(ScanStart, group, op, 0))
+}
+
+// SetScanSpeed 设置自动扫描速度
+func (channel *Channel) SetScanSpeed(group byte, speed uint16) (int, error) {
+	ptzcmd, err := packPTZValue(ScanSpeed, group, speed)
+	if err != nil {
+		return 0, err
+	}
+	return channel.Control(ptzcmd), nil
+}
+
+// Aux 辅助开关，如雨刷、灯光
+func (channel *Channel) Aux(number byte, on bool) int {
+	cmd := byte(AuxOff)
+	if on {
+		cmd = AuxOn
+	}
+	return channel.Control(packPTZ(cmd, number, 0, 0))
+}
+
+// PTZStop 停止云台动作，也用于停止巡航和扫描
+func (channel *Channel) PTZStop() int {
+	return channel.Control(packPTZ(0, 0, 0, 0))
+}
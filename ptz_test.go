@@ -0,0 +1,101 @@
+package gb28181
+
+import "testing"
+
+func TestToPtzStr(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		cmd     string
+		h, v, z uint8
+		want    string
+		wantErr bool
+	}{
+		{"right", "right", 0x80, 0, 0, "A50F010180000036", false},
+		{"upleft", "upleft", 0x10, 0x20, 0, "A50F010A102000EF", false},
+		{"zoomin keeps high nibble", "zoomin", 0, 0, 0x5F, "A50F011000005015", false},
+		{"stop", "stop", 0, 0, 0, "A50F0100000000B5", false},
+		{"checksum wraps", "upright", 0xFF, 0xFF, 0xF0, "A50F0109FFFFF0AC", false},
+		{"unknown", "bad", 0, 0, 0, "", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := toPtzStrByCmdName(tt.cmd, tt.h, tt.v, tt.z)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPackPTZ(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"preset call", Pack(PresetCall, 5), "a50f00820005003b"},
+		{"preset set", Pack(PresetSet, 255), "a50f008100ff0034"},
+		{"cruise add point", packPTZ(CruiseAddPoint, 1, 3, 0), "a50f00840103003c"},
+		{"aux on", packPTZ(AuxOn, 1, 0, 0), "a50f008c01000041"},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestPackPTZValue(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		cmd     byte
+		group   byte
+		value   uint16
+		want    string
+		wantErr bool
+	}{
+		{"cruise speed", CruiseSpeed, 1, 0x123, "a50f00860123106e", false},
+		{"cruise dwell max", CruiseDwell, 0, 0xFFF, "a50f008700fff02a", false},
+		{"scan speed", ScanSpeed, 2, 10, "a50f008a020a004a", false},
+		{"out of range", CruiseSpeed, 1, 0x1000, "", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := packPTZValue(tt.cmd, tt.group, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToFIStr(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		cmd     string
+		fs, is  uint8
+		want    string
+		wantErr bool
+	}{
+		{"stop", "stop", 0, 0, "a50f0040000000f4", false},
+		{"focus near", "focusnear", 0x10, 0, "a50f004210000006", false},
+		{"iris close", "irisclose", 0, 0x20, "a50f00480020001c", false},
+		{"combined", "focusnear, irisopen", 0x10, 0x20, "a50f00461020002a", false},
+		{"conflicting focus", "focusfar,focusnear", 1, 1, "", true},
+		{"conflicting iris", "irisopen,irisclose", 1, 1, "", true},
+		{"unknown", "foo", 0, 0, "", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := toFIStr(tt.cmd, tt.fs, tt.is)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package gb28181
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/gb28181/v4/manscdp"
+)
+
+// PTZPosition 通道的 PTZ 精准状态，角度以度为单位，设备未上报的字段为 0
+type PTZPosition struct {
+	Pan                  float64
+	Tilt                 float64
+	Zoom                 float64
+	HorizontalFieldAngle float64 `json:",omitempty"`
+	VerticalFieldAngle   float64 `json:",omitempty"`
+	MaxViewDistance      float64 `json:",omitempty"`
+	UpdateTime           time.Time
+}
+
+// ptzSubscription 通道的 PTZ 精准状态订阅，续订时使用原订阅的 Call-ID、周期和间隔
+type ptzSubscription struct {
+	CallID   string
+	Timeout  time.Time
+	Expires  time.Duration
+	Interval time.Duration
+	sync.Mutex
+}
+
+func parsePTZValue(s string) (float64, error) {
+	if s = strings.TrimSpace(s); s == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// newPTZPosition 将设备上报的字符串转换为数值，Pan、Tilt、Zoom 无法解析时返回错误
+func newPTZPosition(p *manscdp.PTZPosition) (*PTZPosition, error) {
+	pos := &PTZPosition{UpdateTime: time.Now()}
+	for _, f := range []struct {
+		name     string
+		value    string
+		target   *float64
+		optional bool
+	}{
+		{"Pan", p.Pan, &pos.Pan, false},
+		{"Tilt", p.Tilt, &pos.Tilt, false},
+		{"Zoom", p.Zoom, &pos.Zoom, false},
+		{"HorizontalFieldAngle", p.HorizontalFieldAngle, &pos.HorizontalFieldAngle, true},
+		{"VerticalFieldAngle", p.VerticalFieldAngle, &pos.VerticalFieldAngle, true},
+		{"MaxViewDistance", p.MaxViewDistance, &pos.MaxViewDistance, true},
+	} {
+		v, err := parsePTZValue(f.value)
+		if err != nil {
+			if !f.optional {
+				return nil, fmt.Errorf("invalid %s %q", f.name, f.value)
+			}
+			v = 0
+		}
+		*f.target = v
+	}
+	return pos, nil
+}
+
+// updatePTZPosition 更新通道最近一次的 PTZ 精准状态
+func (d *Device) updatePTZPosition(channelId string, p *manscdp.PTZPosition) *PTZPosition {
+	pos, err := newPTZPosition(p)
+	if err != nil {
+		d.Warn("parse ptz position err", zap.String("channel", channelId), zap.Error(err))
+		return nil
+	}
+	if v, ok := d.channelMap.Load(channelId); ok {
+		v.(*Channel).PTZPosition = pos
+	}
+	return pos
+}
+
+// onPTZPosition 收到 PTZ 精准状态查询应答
+func (d *Device) onPTZPosition(body string) {
+	resp := &manscdp.PTZPositionResponse{}
+	if err := manscdp.Decode([]byte(body), resp); err != nil {
+		d.Error("decode ptz position err", zap.Error(err))
+		return
+	}
+	d.updatePTZPosition(resp.DeviceID, &resp.PTZPosition)
+	ResponseBroker.Put(d.ID, resp.DeviceID, manscdp.CmdPTZPosition, resp.SN, 0, 1, resp)
+}
+
+// onPTZPositionNotify 收到 PTZ 精准状态订阅通知
+func (d *Device) onPTZPositionNotify(body string) {
+	n := &manscdp.PTZPositionNotify{}
+	if err := manscdp.Decode([]byte(body), n); err != nil {
+		d.Error("decode ptz position notify err", zap.Error(err))
+		return
+	}
+	d.updatePTZPosition(n.DeviceID, &n.PTZPosition)
+}
+
+// PTZPrecise PTZ精准控制，将通道转动到指定的水平角度、垂直角度和变倍倍数，2022
+func (channel *Channel) PTZPrecise(ctrl *manscdp.PTZPreciseCtrl) (int, error) {
+	return channel.Device.DeviceControl(channel.DeviceID, &manscdp.DeviceControl{PTZPreciseCtrl: ctrl}, true)
+}
+
+// QueryPTZPosition 查询通道的 PTZ 精准状态，2022
+func (channel *Channel) QueryPTZPosition() (*PTZPosition, error) {
+	parts, err := channel.Device.QueryForResponse(channel.DeviceID, manscdp.CmdPTZPosition, QUERY_2022_TIMEOUT, func(sn int) string {
+		return encodeXML(&manscdp.PTZPositionQuery{Header: manscdp.Header{CmdType: manscdp.CmdPTZPosition, SN: sn, DeviceID: channel.DeviceID}})
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newPTZPosition(&parts[0].(*manscdp.PTZPositionResponse).PTZPosition)
+}
+
+// PTZPositionSubscribe 订阅通道的 PTZ 精准状态，expires 为 0 时取消订阅，2022
+func (channel *Channel) PTZPositionSubscribe(expires, interval time.Duration) int {
+	d := channel.Device
+	sub := &channel.ptzSubscriber
+	sub.Lock()
+	defer sub.Unlock()
+	request := d.CreateRequest(sip.SUBSCRIBE)
+	if sub.CallID != "" {
+		// 续订和取消订阅使用原订阅的 Call-ID
+		callId := sip.CallID(sub.CallID)
+		request.ReplaceHeaders(callId.Name(), []sip.Header{&callId})
+	}
+	expiresHeader := sip.Expires(expires / time.Second)
+	contentType := sip.ContentType("Application/MANSCDP+xml")
+	event := sip.GenericHeader{HeaderName: "Event", Contents: "presence"}
+	request.AppendHeader(&contentType)
+	request.AppendHeader(&expiresHeader)
+	request.AppendHeader(&event)
+	request.SetBody(encodeXML(&manscdp.PTZPositionQuery{
+		Header:   manscdp.Header{CmdType: manscdp.CmdPTZPosition, SN: requestSN(request), DeviceID: channel.DeviceID},
+		Interval: int(interval / time.Second),
+	}), true)
+
+	response, err := d.SipRequestForResponse(request)
+	if err == nil && response != nil {
+		if response.StatusCode() == http.StatusOK && expires > 0 {
+			callId, _ := request.CallID()
+			sub.CallID = callId.Value()
+			sub.Timeout = time.Now().Add(expires)
+			sub.Expires, sub.Interval = expires, interval
+		} else {
+			sub.CallID = ""
+		}
+		return int(response.StatusCode())
+	}
+	sub.CallID = ""
+	return http.StatusRequestTimeout
+}
+
+// renewPTZSubscriptions 在订阅即将过期前续订已订阅 PTZ 精准状态的通道
+func (d *Device) renewPTZSubscriptions() {
+	if d.Status == DeviceOfflineStatus {
+		return
+	}
+	d.channelMap.Range(func(key, value any) bool {
+		channel := value.(*Channel)
+		sub := &channel.ptzSubscriber
+		sub.Lock()
+		renew := sub.CallID != "" && time.Until(sub.Timeout) < conf.HeartbeatInterval
+		expires, interval := sub.Expires, sub.Interval
+		sub.Unlock()
+		if renew {
+			channel.Debug("PTZ Position Subscribe", zap.Int("code", channel.PTZPositionSubscribe(expires, interval)))
+		}
+		return true
+	})
+}
+
+func (c *GB28181Config) API_ptz_precise(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	channel := query.Get("channel")
+	ctrl := &manscdp.PTZPreciseCtrl{}
+	for _, p := range []struct {
+		name     string
+		target   *float64
+		required bool
+	}{
+		{"pan", &ctrl.Pan, true},
+		{"tilt", &ctrl.Tilt, true},
+		{"zoom", &ctrl.Zoom, true},
+		{"focus", &ctrl.Focus, false},
+		{"iris", &ctrl.Iris, false},
+		{"horizontalSpeed", &ctrl.HorizontalSpeed, false},
+		{"verticalSpeed", &ctrl.VerticalSpeed, false},
+	} {
+		v := query.Get(p.name)
+		if v == "" && !p.required {
+			continue
+		}
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			util.ReturnError(util.APIErrorQueryParse, p.name+" parameter is invalid", w, r)
+			return
+		}
+		*p.target = n
+	}
+	if ctrl.Pan < 0 || ctrl.Pan > 360 || ctrl.Tilt < -30 || ctrl.Tilt > 90 || ctrl.Zoom < 0 {
+		util.ReturnError(util.APIErrorQueryParse, "pan must be 0-360, tilt must be -30-90 and zoom must not be negative", w, r)
+		return
+	}
+	if c := FindChannel(id, channel); c != nil {
+		if ptzLocked(c, w, r) {
+			return
+		}
+		code, err := c.PTZPrecise(ctrl)
+		returnControlResult(code, err, w, r)
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q channel %q not found", id, channel), w, r)
+	}
+}
+
+func (c *GB28181Config) API_ptz_position(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	channel := query.Get("channel")
+	ch := FindChannel(id, channel)
+	if ch == nil {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q channel %q not found", id, channel), w, r)
+		return
+	}
+	// 订阅后设备定时上报，可以直接返回最近一次的状态
+	if query.Get("cached") != "" {
+		if ch.PTZPosition == nil {
+			util.ReturnError(util.APIErrorNotFound, "no ptz position reported", w, r)
+		} else {
+			util.ReturnValue(ch.PTZPosition, w, r)
+		}
+		return
+	}
+	if pos, err := ch.QueryPTZPosition(); err == nil {
+		util.ReturnValue(pos, w, r)
+	} else {
+		util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+	}
+}
+
+func (c *GB28181Config) API_ptz_position_subscribe(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	channel := query.Get("channel")
+	expires, err := time.ParseDuration(query.Get("expires"))
+	if err != nil {
+		expires = time.Hour
+	}
+	interval, err := time.ParseDuration(query.Get("interval"))
+	if err != nil || interval < time.Second {
+		interval = time.Second * 5
+	}
+	if c := FindChannel(id, channel); c != nil {
+		util.ReturnError(0, fmt.Sprintf("ptz position subscribe code:%d", c.PTZPositionSubscribe(expires, interval)), w, r)
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q channel %q not found", id, channel), w, r)
+	}
+}
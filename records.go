@@ -0,0 +1,315 @@
+package gb28181
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/plugin/gb28181/v4/manscdp"
+)
+
+var (
+	RECORD_CACHE_TTL         = time.Second * 30    // 完整的录像查询结果缓存时间
+	RECORD_MERGE_GAP         = time.Second * 2     // 间隔不超过该值的录像合并为一段
+	RECORD_SPLIT_SPAN        = time.Hour * 24      // 超过该时长的查询按天拆分
+	RECORD_MAX_SPAN          = time.Hour * 24 * 31 // 单次查询的最大时间范围，避免拆分出过多的查询
+	RECORD_QUERY_CONCURRENCY = 3                   // 按天拆分后同时进行的查询数
+	RECORD_QUERY_DEADLINE    = time.Second * 30    // 按天拆分的查询超过该时间后不再开始新的查询
+)
+
+// 录像产生类型
+const (
+	RecordTypeAll    = "all"
+	RecordTypeTime   = "time"
+	RecordTypeAlarm  = "alarm"
+	RecordTypeManual = "manual"
+)
+
+// RecordQuery 录像检索条件，Start、End 为秒或毫秒时间戳
+type RecordQuery struct {
+	Start      int64
+	End        int64
+	Type       string // time、alarm、manual，为空时为 all
+	RecorderID string // 录像触发者 ID
+	FilePath   string // 文件路径名
+	Address    string // 录像地址
+	Secrecy    int    // 保密属性，0 为不涉密
+}
+
+func (q *RecordQuery) cacheKey(deviceId, channelId string) string {
+	return fmt.Sprintf("%s/%s/%d-%d/%s/%s/%s/%s/%d", deviceId, channelId, q.Start, q.End, q.Type, q.RecorderID, q.FilePath, q.Address, q.Secrecy)
+}
+
+// BuildRecordInfoXML 录像文件检索
+func BuildRecordInfoXML(sn int, id string, q *RecordQuery) string {
+	recordType := q.Type
+	if recordType == "" {
+		recordType = RecordTypeAll
+	}
+	return encodeXML(&manscdp.RecordInfoQuery{
+		Header:     manscdp.Header{CmdType: manscdp.CmdRecordInfo, SN: sn, DeviceID: id},
+		StartTime:  intTotime(q.Start).Format(TIME_LAYOUT),
+		EndTime:    intTotime(q.End).Format(TIME_LAYOUT),
+		FilePath:   q.FilePath,
+		Address:    q.Address,
+		Secrecy:    q.Secrecy,
+		Type:       recordType,
+		RecorderID: q.RecorderID,
+	})
+}
+
+// recordInfoPart 设备返回的一条录像检索应答
+type recordInfoPart struct {
+	SumNum int
+	List   []*Record
+}
+
+func (r *Record) key() string {
+	return strings.Join([]string{r.DeviceID, r.StartTime, r.EndTime, r.FilePath, r.Type, r.RecorderID}, "|")
+}
+
+// RecordSegment 合并后的连续录像时间段
+type RecordSegment struct {
+	StartTime string
+	EndTime   string
+	Count     int // 合并的录像文件数
+}
+
+// RecordQueryResult 录像查询结果，Partial 为 true 表示超时前未收齐 SumNum 条目
+type RecordQueryResult struct {
+	DeviceID  string
+	ChannelID string
+	SumNum    int
+	Partial   bool
+	Cached    bool `json:",omitempty"`
+	List      []*Record
+	Timeline  []*RecordSegment `json:",omitempty"`
+}
+
+type recordCacheEntry struct {
+	expire time.Time
+	result *RecordQueryResult
+}
+
+var recordCache sync.Map
+
+func loadRecordCache(key string) *RecordQueryResult {
+	if v, ok := recordCache.Load(key); ok {
+		if e := v.(*recordCacheEntry); time.Now().Before(e.expire) {
+			return e.result
+		}
+		recordCache.Delete(key)
+	}
+	return nil
+}
+
+func storeRecordCache(key string, result *RecordQueryResult) {
+	now := time.Now()
+	recordCache.Range(func(k, v any) bool {
+		if now.After(v.(*recordCacheEntry).expire) {
+			recordCache.Delete(k)
+		}
+		return true
+	})
+	recordCache.Store(key, &recordCacheEntry{expire: now.Add(RECORD_CACHE_TTL), result: result})
+}
+
+// queryRecordOnce 发送一次录像检索，去掉重复的条目；收齐 SumNum 个不重复条目，或收到的条目数（含重复）达到 SumNum 时完成
+func (channel *Channel) queryRecordOnce(q *RecordQuery, useCache bool) (*RecordQueryResult, error) {
+	key := q.cacheKey(channel.Device.ID, channel.DeviceID)
+	if useCache {
+		if res := loadRecordCache(key); res != nil {
+			copied := *res
+			copied.Cached = true
+			return &copied, nil
+		}
+	}
+	parts, err := channel.Device.QueryForResponse(channel.DeviceID, manscdp.CmdRecordInfo, QUERY_RECORD_TIMEOUT, func(sn int) string {
+		return BuildRecordInfoXML(sn, channel.DeviceID, q)
+	}, func(parts []any) bool {
+		sum, total := 0, 0
+		seen := make(map[string]struct{})
+		for _, part := range parts {
+			p := part.(*recordInfoPart)
+			if p.SumNum > sum {
+				sum = p.SumNum
+			}
+			total += len(p.List)
+			for _, r := range p.List {
+				seen[r.key()] = struct{}{}
+			}
+		}
+		// 设备按含重复的数量填写 SumNum 时，收到的条目数达到 SumNum 也视为完成
+		return len(seen) >= sum || total >= sum
+	})
+	if err != nil && !errors.Is(err, ErrResponsePartial) {
+		return nil, err
+	}
+	res := &RecordQueryResult{DeviceID: channel.Device.ID, ChannelID: channel.DeviceID, List: make([]*Record, 0)}
+	seen := make(map[string]struct{})
+	for _, part := range parts {
+		p := part.(*recordInfoPart)
+		if p.SumNum > res.SumNum {
+			res.SumNum = p.SumNum
+		}
+		for _, r := range p.List {
+			if _, ok := seen[r.key()]; !ok {
+				seen[r.key()] = struct{}{}
+				res.List = append(res.List, r)
+			}
+		}
+	}
+	// 超时前未满足完成条件时只返回已收到的部分，不缓存
+	res.Partial = err != nil
+	if res.Partial {
+		channel.Warn("record query partial", zap.Int("sumNum", res.SumNum), zap.Int("received", len(res.List)))
+	} else {
+		storeRecordCache(key, res)
+	}
+	return res, nil
+}
+
+// checkSpan 时间范围超过 RECORD_MAX_SPAN 时返回错误
+func (q *RecordQuery) checkSpan() error {
+	if span := intTotime(q.End).Sub(intTotime(q.Start)); span > RECORD_MAX_SPAN {
+		return fmt.Errorf("time range %s exceeds %s", span, RECORD_MAX_SPAN)
+	}
+	return nil
+}
+
+// splitRecordQuery 超过一天的查询按自然日拆分
+func splitRecordQuery(q *RecordQuery) []*RecordQuery {
+	start, end := intTotime(q.Start), intTotime(q.End)
+	if end.Sub(start) <= RECORD_SPLIT_SPAN {
+		return []*RecordQuery{q}
+	}
+	var list []*RecordQuery
+	for s := start; s.Before(end); {
+		y, m, d := s.Date()
+		e := time.Date(y, m, d+1, 0, 0, 0, 0, s.Location())
+		if e.After(end) {
+			e = end
+		}
+		part := *q
+		part.Start, part.End = s.Unix(), e.Unix()
+		list = append(list, &part)
+		s = e
+	}
+	return list
+}
+
+// QueryRecords 检索录像，多天的查询按天并发查询后合并，某一天失败或超过 RECORD_QUERY_DEADLINE 未开始查询时返回其他天的结果并标记为 Partial
+func (channel *Channel) QueryRecords(q *RecordQuery, useCache bool) (*RecordQueryResult, error) {
+	if err := q.checkSpan(); err != nil {
+		return nil, err
+	}
+	queries := splitRecordQuery(q)
+	if len(queries) == 1 {
+		return channel.queryRecordOnce(q, useCache)
+	}
+	results := make([]*RecordQueryResult, len(queries))
+	errs := make([]error, len(queries))
+	deadline := time.Now().Add(RECORD_QUERY_DEADLINE)
+	sem := make(chan struct{}, RECORD_QUERY_CONCURRENCY)
+	var wg sync.WaitGroup
+	for i, part := range queries {
+		sem <- struct{}{}
+		if time.Now().After(deadline) {
+			<-sem
+			errs[i] = fmt.Errorf("record query deadline %s exceeded", RECORD_QUERY_DEADLINE)
+			continue
+		}
+		wg.Add(1)
+		go func(i int, part *RecordQuery) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i], errs[i] = channel.queryRecordOnce(part, useCache)
+		}(i, part)
+	}
+	wg.Wait()
+	res := &RecordQueryResult{DeviceID: channel.Device.ID, ChannelID: channel.DeviceID, List: make([]*Record, 0), Cached: true}
+	seen := make(map[string]struct{})
+	var lastErr error
+	failed := 0
+	for i, r := range results {
+		if errs[i] != nil {
+			channel.Warn("record query failed", zap.Time("start", intTotime(queries[i].Start)), zap.Error(errs[i]))
+			lastErr = errs[i]
+			failed++
+			res.Partial = true
+			continue
+		}
+		// SumNum 为设备上报的各天数量之和，跨天的录像会被计入两次，因此 List 可能少于 SumNum
+		res.SumNum += r.SumNum
+		res.Partial = res.Partial || r.Partial
+		res.Cached = res.Cached && r.Cached
+		for _, record := range r.List {
+			// 跨天的录像在相邻两天的结果中都会出现
+			if _, ok := seen[record.key()]; !ok {
+				seen[record.key()] = struct{}{}
+				res.List = append(res.List, record)
+			}
+		}
+	}
+	if failed == len(queries) {
+		return nil, lastErr
+	}
+	return res, nil
+}
+
+// QueryRecord 检索所有类型的录像
+func (channel *Channel) QueryRecord(startTime, endTime string) ([]*Record, error) {
+	start, _ := strconv.ParseInt(startTime, 10, 0)
+	end, _ := strconv.ParseInt(endTime, 10, 0)
+	res, err := channel.QueryRecords(&RecordQuery{Start: start, End: end}, false)
+	if err != nil {
+		return nil, err
+	}
+	return res.List, nil
+}
+
+func parseRecordTime(s string) (time.Time, error) {
+	// 部分设备使用空格分隔日期和时间
+	return time.ParseInLocation(TIME_LAYOUT, strings.Replace(strings.TrimSpace(s), " ", "T", 1), time.Local)
+}
+
+// MergeRecords 将重叠或间隔不超过 gap 的录像合并为连续的时间段
+func MergeRecords(list []*Record, gap time.Duration) []*RecordSegment {
+	type span struct{ start, end time.Time }
+	spans := make([]span, 0, len(list))
+	for _, r := range list {
+		start, err1 := parseRecordTime(r.StartTime)
+		end, err2 := parseRecordTime(r.EndTime)
+		if err1 != nil || err2 != nil || end.Before(start) {
+			continue
+		}
+		spans = append(spans, span{start, end})
+	}
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].start.Before(spans[j].start)
+	})
+	var segments []*RecordSegment
+	var cur *RecordSegment
+	var curEnd time.Time
+	for _, s := range spans {
+		if cur != nil && !s.start.After(curEnd.Add(gap)) {
+			cur.Count++
+			if s.end.After(curEnd) {
+				curEnd = s.end
+				cur.EndTime = curEnd.Format(TIME_LAYOUT)
+			}
+			continue
+		}
+		cur = &RecordSegment{StartTime: s.start.Format(TIME_LAYOUT), EndTime: s.end.Format(TIME_LAYOUT), Count: 1}
+		curEnd = s.end
+		segments = append(segments, cur)
+	}
+	return segments
+}
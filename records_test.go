@@ -0,0 +1,117 @@
+package gb28181
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSplitRecordQuery(t *testing.T) {
+	at := func(day, hour int) int64 {
+		return time.Date(2024, 1, day, hour, 0, 0, 0, time.Local).Unix()
+	}
+	for _, tt := range []struct {
+		name       string
+		start, end int64
+		want       [][2]int64
+	}{
+		{"within a day", at(1, 10), at(1, 20), [][2]int64{{at(1, 10), at(1, 20)}}},
+		{"exactly 24h", at(1, 10), at(2, 10), [][2]int64{{at(1, 10), at(2, 10)}}},
+		{"split at midnight", at(1, 10), at(3, 5), [][2]int64{{at(1, 10), at(2, 0)}, {at(2, 0), at(3, 0)}, {at(3, 0), at(3, 5)}}},
+		{"ends at midnight", at(1, 0), at(3, 0), [][2]int64{{at(1, 0), at(2, 0)}, {at(2, 0), at(3, 0)}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &RecordQuery{Start: tt.start, End: tt.end, Type: "time"}
+			parts := splitRecordQuery(q)
+			if len(parts) != len(tt.want) {
+				t.Fatalf("got %d parts, want %d", len(parts), len(tt.want))
+			}
+			for i, p := range parts {
+				if p.Start != tt.want[i][0] || p.End != tt.want[i][1] {
+					t.Errorf("part %d = %s - %s, want %s - %s", i, intTotime(p.Start), intTotime(p.End), intTotime(tt.want[i][0]), intTotime(tt.want[i][1]))
+				}
+				if p.Type != q.Type {
+					t.Errorf("part %d lost Type %q", i, p.Type)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordQueryCheckSpan(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	for _, tt := range []struct {
+		span    time.Duration
+		wantErr bool
+	}{
+		{time.Hour, false},
+		{RECORD_MAX_SPAN, false},
+		{RECORD_MAX_SPAN + time.Hour*24, true},
+	} {
+		q := &RecordQuery{Start: start.Unix(), End: start.Add(tt.span).Unix()}
+		if err := q.checkSpan(); (err != nil) != tt.wantErr {
+			t.Errorf("span %s: checkSpan() = %v, wantErr %v", tt.span, err, tt.wantErr)
+		}
+	}
+}
+
+func TestMergeRecords(t *testing.T) {
+	rec := func(start, end string) *Record {
+		return &Record{StartTime: start, EndTime: end}
+	}
+	for _, tt := range []struct {
+		name string
+		list []*Record
+		gap  time.Duration
+		want []RecordSegment
+	}{
+		{"empty", nil, time.Second, nil},
+		{
+			"adjacent within gap",
+			[]*Record{rec("2024-01-01T10:00:00", "2024-01-01T10:30:00"), rec("2024-01-01T10:30:01", "2024-01-01T11:00:00")},
+			time.Second,
+			[]RecordSegment{{"2024-01-01T10:00:00", "2024-01-01T11:00:00", 2}},
+		},
+		{
+			"gap too large",
+			[]*Record{rec("2024-01-01T10:00:00", "2024-01-01T10:30:00"), rec("2024-01-01T10:30:05", "2024-01-01T11:00:00")},
+			time.Second,
+			[]RecordSegment{{"2024-01-01T10:00:00", "2024-01-01T10:30:00", 1}, {"2024-01-01T10:30:05", "2024-01-01T11:00:00", 1}},
+		},
+		{
+			"overlapping and contained",
+			[]*Record{rec("2024-01-01T10:00:00", "2024-01-01T11:00:00"), rec("2024-01-01T10:10:00", "2024-01-01T10:20:00"), rec("2024-01-01T10:50:00", "2024-01-01T11:10:00")},
+			0,
+			[]RecordSegment{{"2024-01-01T10:00:00", "2024-01-01T11:10:00", 3}},
+		},
+		{
+			"unsorted input",
+			[]*Record{rec("2024-01-01T12:00:00", "2024-01-01T13:00:00"), rec("2024-01-01T10:00:00", "2024-01-01T11:00:00"), rec("2024-01-01T11:00:00", "2024-01-01T11:30:00")},
+			0,
+			[]RecordSegment{{"2024-01-01T10:00:00", "2024-01-01T11:30:00", 2}, {"2024-01-01T12:00:00", "2024-01-01T13:00:00", 1}},
+		},
+		{
+			"space separated time",
+			[]*Record{rec("2024-01-01 10:00:00", "2024-01-01 10:30:00")},
+			0,
+			[]RecordSegment{{"2024-01-01T10:00:00", "2024-01-01T10:30:00", 1}},
+		},
+		{
+			"invalid skipped",
+			[]*Record{rec("bad", "2024-01-01T10:30:00"), rec("2024-01-01T11:00:00", "2024-01-01T10:00:00"), rec("2024-01-01T12:00:00", "2024-01-01T12:30:00")},
+			0,
+			[]RecordSegment{{"2024-01-01T12:00:00", "2024-01-01T12:30:00", 1}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := MergeRecords(tt.list, tt.gap)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d segments, want %d", len(got), len(tt.want))
+			}
+			for i, s := range got {
+				if *s != tt.want[i] {
+					t.Errorf("segment %d = %+v, want %+v", i, *s, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package gb28181
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -40,9 +41,38 @@ func (c *GB28181Config) API_records(w http.ResponseWriter, r *http.Request) {
 		startTime = trange[0]
 		endTime = trange[1]
 	}
+	q := &RecordQuery{
+		Type:       query.Get("type"),
+		RecorderID: query.Get("recorderId"),
+		FilePath:   query.Get("filePath"),
+		Address:    query.Get("address"),
+	}
+	q.Start, _ = strconv.ParseInt(startTime, 10, 0)
+	q.End, _ = strconv.ParseInt(endTime, 10, 0)
+	q.Secrecy, _ = strconv.Atoi(query.Get("secrecy"))
+	switch q.Type {
+	case "", RecordTypeAll, RecordTypeTime, RecordTypeAlarm, RecordTypeManual:
+	default:
+		util.ReturnError(util.APIErrorQueryParse, fmt.Sprintf("unknown record type %q", q.Type), w, r)
+		return
+	}
+	if err := q.checkSpan(); err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+		return
+	}
 	if c := FindChannel(id, channel); c != nil {
-		res, err := c.QueryRecord(startTime, endTime)
+		res, err := c.QueryRecords(q, query.Get("nocache") == "")
 		if err == nil {
+			// 默认与之前一样只返回录像列表，detail 或 merge 不为空时返回完整的查询结果
+			if query.Get("detail") == "" && query.Get("merge") == "" {
+				util.ReturnValue(res.List, w, r)
+				return
+			}
+			if query.Get("merge") != "" {
+				copied := *res
+				copied.Timeline = MergeRecords(res.List, RECORD_MERGE_GAP)
+				res = &copied
+			}
 			util.ReturnValue(res, w, r)
 		} else {
 			util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
@@ -57,6 +87,9 @@ func (c *GB28181Config) API_control(w http.ResponseWriter, r *http.Request) {
 	channel := r.URL.Query().Get("channel")
 	ptzcmd := r.URL.Query().Get("ptzcmd")
 	if c := FindChannel(id, channel); c != nil {
+		if ptzLocked(c, w, r) {
+			return
+		}
 		util.ReturnError(0, fmt.Sprintf("control code:%d", c.Control(ptzcmd)), w, r)
 	} else {
 		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q channel %q not found", id, channel), w, r)
@@ -94,6 +127,9 @@ func (c *GB28181Config) API_ptz(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if c := FindChannel(id, channel); c != nil {
+		if ptzLocked(c, w, r) {
+			return
+		}
 		code := c.Control(ptzcmd)
 		util.ReturnError(code, "device received", w, r)
 	} else {
@@ -101,16 +137,181 @@ func (c *GB28181Config) API_ptz(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// uintParam 解析无符号整数参数，为空时返回 def
+func uintParam(q url.Values, name string, def uint64, bitSize int) (uint64, error) {
+	v := q.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(v, 10, bitSize)
+	if err != nil {
+		return 0, fmt.Errorf("%s parameter is invalid", name)
+	}
+	return n, nil
+}
+
+// returnPTZResult 与 API_ptz 一致，以设备返回的状态码作为 code
+func returnPTZResult(code int, err error, w http.ResponseWriter, r *http.Request) {
+	if err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+	} else {
+		util.ReturnError(code, "device received", w, r)
+	}
+}
+
+// API_ptz_fi 聚焦、光圈控制
+func (c *GB28181Config) API_ptz_fi(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id := q.Get("id")
+	channel := q.Get("channel")
+	fs, err := uintParam(q, "focusSpeed", 0x80, 8)
+	if err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+		return
+	}
+	is, err := uintParam(q, "irisSpeed", 0x80, 8)
+	if err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+		return
+	}
+	if c := FindChannel(id, channel); c != nil {
+		if ptzLocked(c, w, r) {
+			return
+		}
+		code, err := c.FocusIris(q.Get("cmd"), uint8(fs), uint8(is))
+		returnPTZResult(code, err, w, r)
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q channel %q not found", id, channel), w, r)
+	}
+}
+
+var cruiseName2code = map[string]byte{
+	"add":   CruiseAddPoint,
+	"del":   CruiseDelPoint,
+	"speed": CruiseSpeed,
+	"dwell": CruiseDwell,
+	"start": CruiseStart,
+}
+
+// API_ptz_cruise 巡航控制，cmd 为 add、del、speed、dwell、start、stop
+func (c *GB28181Config) API_ptz_cruise(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id := q.Get("id")
+	channel := q.Get("channel")
+	cmd := q.Get("cmd")
+	group, err := uintParam(q, "group", 1, 8)
+	if err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+		return
+	}
+	// add、del 为预置位号，speed 为速度，dwell 为停留时间（秒）
+	value, err := uintParam(q, "value", 0, 16)
+	if err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+		return
+	}
+	code, ok := cruiseName2code[cmd]
+	if !ok && cmd != "stop" {
+		util.ReturnError(util.APIErrorQueryParse, fmt.Sprintf("invalid cruise cmd %q", cmd), w, r)
+		return
+	}
+	if c := FindChannel(id, channel); c != nil {
+		if ptzLocked(c, w, r) {
+			return
+		}
+		if cmd == "stop" {
+			returnPTZResult(c.PTZStop(), nil, w, r)
+			return
+		}
+		result, err := c.Cruise(code, byte(group), uint16(value))
+		returnPTZResult(result, err, w, r)
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q channel %q not found", id, channel), w, r)
+	}
+}
+
+// API_ptz_scan 自动扫描，cmd 为 start、left、right、speed、stop
+func (c *GB28181Config) API_ptz_scan(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id := q.Get("id")
+	channel := q.Get("channel")
+	cmd := q.Get("cmd")
+	group, err := uintParam(q, "group", 1, 8)
+	if err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+		return
+	}
+	speed, err := uintParam(q, "speed", 0, 16)
+	if err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+		return
+	}
+	ch := FindChannel(id, channel)
+	if ch == nil {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q channel %q not found", id, channel), w, r)
+		return
+	}
+	if ptzLocked(ch, w, r) {
+		return
+	}
+	switch cmd {
+	case "start":
+		returnPTZResult(ch.Scan(byte(group), ScanOpStart), nil, w, r)
+	case "left":
+		returnPTZResult(ch.Scan(byte(group), ScanOpLeft), nil, w, r)
+	case "right":
+		returnPTZResult(ch.Scan(byte(group), ScanOpRight), nil, w, r)
+	case "speed":
+		code, err := ch.SetScanSpeed(byte(group), uint16(speed))
+		returnPTZResult(code, err, w, r)
+	case "stop":
+		returnPTZResult(ch.PTZStop(), nil, w, r)
+	default:
+		util.ReturnError(util.APIErrorQueryParse, fmt.Sprintf("invalid scan cmd %q", cmd), w, r)
+	}
+}
+
+// API_ptz_aux 辅助开关，cmd 为 on、off
+func (c *GB28181Config) API_ptz_aux(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id := q.Get("id")
+	channel := q.Get("channel")
+	cmd := q.Get("cmd")
+	number, err := uintParam(q, "number", 1, 8)
+	if err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+		return
+	}
+	if cmd != "on" && cmd != "off" {
+		util.ReturnError(util.APIErrorQueryParse, fmt.Sprintf("invalid aux cmd %q", cmd), w, r)
+		return
+	}
+	if c := FindChannel(id, channel); c != nil {
+		if ptzLocked(c, w, r) {
+			return
+		}
+		returnPTZResult(c.Aux(byte(number), cmd == "on"), nil, w, r)
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q channel %q not found", id, channel), w, r)
+	}
+}
+
 func (c *GB28181Config) API_invite(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
 	id := query.Get("id")
 	channel := query.Get("channel")
 	streamPath := query.Get("streamPath")
 	port, _ := strconv.Atoi(query.Get("mediaPort"))
+	transport, err := ParseMediaTransport(query.Get("transport"))
+	if err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+		return
+	}
 	opt := InviteOptions{
 		dump:       query.Get("dump"),
 		MediaPort:  uint16(port),
 		StreamPath: streamPath,
+		Transport:  transport,
 	}
 	startTime := query.Get("startTime")
 	endTime := query.Get("endTime")
@@ -237,7 +438,7 @@ func (c *GB28181Config) API_preset_list(w http.ResponseWriter, r *http.Request)
 	//获取通道
 	channel := query.Get("channel")
 	if c := FindChannel(id, channel); c != nil {
-		res, err := c.QueryPresetList()
+		res, err := c.QueryPresets(query.Get("nocache") == "")
 		if err == nil {
 			util.ReturnValue(res, w, r)
 		} else {
@@ -249,6 +450,19 @@ func (c *GB28181Config) API_preset_list(w http.ResponseWriter, r *http.Request)
 
 }
 
+func (c *GB28181Config) API_device_info(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if v, ok := Devices.Load(id); ok {
+		if info, err := v.(*Device).DeviceInfo(); err == nil {
+			util.ReturnValue(info, w, r)
+		} else {
+			util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+		}
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q  not found", id), w, r)
+	}
+}
+
 func (c *GB28181Config) API_preset_control(w http.ResponseWriter, r *http.Request) {
 	//CORS(w, r)
 	query := r.URL.Query()
@@ -262,6 +476,9 @@ func (c *GB28181Config) API_preset_control(w http.ResponseWriter, r *http.Reques
 	point := query.Get("point")
 
 	if c := FindChannel(id, channel); c != nil {
+		if ptzLocked(c, w, r) {
+			return
+		}
 		_ptzCmd, _ := strconv.ParseInt(ptzCmd, 10, 16)
 		_point, _ := strconv.ParseInt(point, 10, 8)
 		code := c.PresetControl(int(_ptzCmd), byte(_point))
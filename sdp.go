@@ -0,0 +1,93 @@
+package gb28181
+
+import (
+	"strconv"
+	"strings"
+)
+
+// SDPInfo 国标 SDP 中关心的字段
+type SDPInfo struct {
+	Owner       string // o= 中的用户名，一般为设备或平台 ID
+	SessionName string // s=Play/Playback/Download/Talk
+	URI         string // u=
+	IP          string // c=IN IP4 x.x.x.x
+	MediaType   string // m= 的媒体类型，video/audio
+	MediaPort   uint16
+	TCP         bool   // m= 的传输协议是否为 TCP/RTP/AVP
+	Setup       string // a=setup:active/passive
+	Direction   string // a=sendonly/recvonly/sendrecv
+	PayloadType []string
+	Rtpmap      map[string]string
+	Start       int64
+	End         int64
+	SSRC        string // y=
+	F           string // f=
+	// 下载专用
+	DownloadSpeed int
+	FileSize      int64
+}
+
+func ParseSDP(body string) *SDPInfo {
+	info := &SDPInfo{Rtpmap: make(map[string]string)}
+	for _, line := range strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) < 2 || line[1] != '=' {
+			continue
+		}
+		v := line[2:]
+		switch line[0] {
+		case 'o':
+			if fs := strings.Fields(v); len(fs) > 0 {
+				info.Owner = fs[0]
+			}
+		case 's':
+			info.SessionName = v
+		case 'u':
+			info.URI = v
+		case 'c':
+			if fs := strings.Fields(v); len(fs) == 3 {
+				info.IP = fs[2]
+			}
+		case 't':
+			if fs := strings.Fields(v); len(fs) == 2 {
+				info.Start, _ = strconv.ParseInt(fs[0], 10, 64)
+				info.End, _ = strconv.ParseInt(fs[1], 10, 64)
+			}
+		case 'm':
+			if fs := strings.Fields(v); len(fs) >= 3 {
+				info.MediaType = fs[0]
+				port, _ := strconv.ParseUint(fs[1], 10, 16)
+				info.MediaPort = uint16(port)
+				info.TCP = strings.HasPrefix(strings.ToUpper(fs[2]), "TCP")
+				info.PayloadType = fs[3:]
+			}
+		case 'a':
+			name, value, _ := strings.Cut(v, ":")
+			switch name {
+			case "setup":
+				info.Setup = value
+			case "sendonly", "recvonly", "sendrecv":
+				info.Direction = name
+			case "rtpmap":
+				if pt, codec, ok := strings.Cut(value, " "); ok {
+					info.Rtpmap[pt] = codec
+				}
+			case "downloadspeed":
+				info.DownloadSpeed, _ = strconv.Atoi(value)
+			case "filesize":
+				info.FileSize, _ = strconv.ParseInt(value, 10, 64)
+			}
+		case 'y':
+			info.SSRC = v
+		case 'f':
+			info.F = v
+		}
+	}
+	return info
+}
+
+// SSRCValue 将 y= 字段转为数值
+func (s *SDPInfo) SSRCValue() uint32 {
+	ssrc, _ := strconv.ParseUint(s.SSRC, 10, 32)
+	return uint32(ssrc)
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/ghettovoice/gosip"
 	"github.com/ghettovoice/gosip/log"
 	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/transport"
 	"github.com/logrusorgru/aurora/v4"
 	"go.uber.org/zap"
 	. "m7s.live/engine/v4"
@@ -44,6 +45,32 @@ func GetSipServer(transport string) gosip.Server {
 	return srv
 }
 
+// sipListener sip 服务的一个监听，同一个服务可以同时监听 UDP、TCP 和 TLS
+type sipListener struct {
+	Network string // UDP、TCP、TLS
+	Port    sip.Port
+}
+
+// sipPort 返回指定传输协议监听的端口，没有监听该协议时返回默认端口
+func (c *GB28181Config) sipPort(network string) sip.Port {
+	for _, l := range c.sipListeners {
+		if strings.EqualFold(l.Network, network) {
+			return l.Port
+		}
+	}
+	return c.SipPort
+}
+
+// hasSipNetwork 是否监听了指定的传输协议
+func (c *GB28181Config) hasSipNetwork(network string) bool {
+	for _, l := range c.sipListeners {
+		if strings.EqualFold(l.Network, network) {
+			return true
+		}
+	}
+	return false
+}
+
 var sn = 0
 
 func CreateRequest(exposedId string, Method sip.RequestMethod, recipient *sip.Address, netAddr string) (req sip.Request) {
@@ -56,7 +83,7 @@ func CreateRequest(exposedId string, Method sip.RequestMethod, recipient *sip.Ad
 		SeqNo:      uint32(sn),
 		MethodName: Method,
 	}
-	port := sip.Port(conf.SipPort)
+	port := conf.sipPort(conf.SipNetwork)
 	serverAddr := sip.Address{
 		//DisplayName: sip.String{Str: d.config.Serial},
 		Uri: &sip.SipUri{
@@ -110,14 +137,38 @@ func CreateRequest(exposedId string, Method sip.RequestMethod, recipient *sip.Ad
 	// }
 	return
 }
+
+// CreateByeRequest 作为被叫方挂断会话，inviteReq 为对方发来的 INVITE，inviteResp 为本方的应答
+func CreateByeRequest(inviteReq sip.Request, inviteResp sip.Response, seq uint32) (req sip.Request) {
+	from, _ := inviteResp.To()
+	to, _ := inviteResp.From()
+	callID, _ := inviteResp.CallID()
+	cseq := sip.CSeq{SeqNo: seq, MethodName: sip.BYE}
+	userAgent := sip.UserAgentHeader("Monibuca")
+	recipient := to.Address
+	if contacts := inviteReq.GetHeaders("Contact"); len(contacts) > 0 {
+		if contact, ok := contacts[0].(*sip.ContactHeader); ok {
+			recipient = contact.Address
+		}
+	}
+	req = sip.NewRequest("", sip.BYE, recipient, "SIP/2.0", []sip.Header{
+		&sip.FromHeader{DisplayName: from.DisplayName, Address: from.Address, Params: from.Params},
+		&sip.ToHeader{DisplayName: to.DisplayName, Address: to.Address, Params: to.Params},
+		callID,
+		&userAgent,
+		&cseq,
+	}, "", nil)
+	req.SetTransport(inviteReq.Transport())
+	req.SetDestination(inviteReq.Source())
+	return
+}
+
 func RequestForResponse(transport string, request sip.Request,
 	options ...gosip.RequestWithContextOption) (sip.Response, error) {
 	return (GetSipServer(transport)).RequestWithContext(context.Background(), request, options...)
 }
 
 func (c *GB28181Config) startServer() {
-	addr := c.ListenAddr + ":" + strconv.Itoa(int(c.SipPort))
-
 	logger := utils.NewZapLogger(GB28181Plugin.Logger, "GB SIP Server", nil)
 	logger.SetLevel(uint32(levelMap[EngineConfig.LogLevel]))
 	// logger := log.NewDefaultLogrusLogger().WithPrefix("GB SIP Server")
@@ -126,22 +177,28 @@ func (c *GB28181Config) startServer() {
 		srvConf.Host = c.SipIP
 	}
 	srv = gosip.NewServer(srvConf, nil, nil, logger)
-	srv.OnRequest(sip.REGISTER, c.OnRegister)
-	srv.OnRequest(sip.MESSAGE, c.OnMessage)
-	srv.OnRequest(sip.NOTIFY, c.OnNotify)
-	srv.OnRequest(sip.BYE, c.OnBye)
-	err := srv.Listen(strings.ToLower(c.SipNetwork), addr)
-	if err != nil {
-		GB28181Plugin.Logger.Error("gb28181 server listen", zap.Error(err))
-	} else {
-		GB28181Plugin.Info(fmt.Sprint(aurora.Green("Server gb28181 start at"), aurora.BrightBlue(addr)))
+	srv.OnRequest(sip.REGISTER, instrument(c.OnRegister))
+	srv.OnRequest(sip.MESSAGE, instrument(c.OnMessage))
+	srv.OnRequest(sip.NOTIFY, instrument(c.OnNotify))
+	srv.OnRequest(sip.BYE, instrument(c.OnBye))
+	srv.OnRequest(sip.INVITE, instrument(c.OnInvite))
+	srv.OnRequest(sip.ACK, instrument(c.OnAck))
+	for _, l := range c.sipListeners {
+		addr := c.ListenAddr + ":" + strconv.Itoa(int(l.Port))
+		var options []transport.ListenOption
+		if l.Network == "TLS" {
+			options = append(options, transport.TLSConfig{Cert: c.SipTLS.Cert, Key: c.SipTLS.Key})
+		}
+		if err := srv.Listen(strings.ToLower(l.Network), addr, options...); err != nil {
+			GB28181Plugin.Logger.Error("gb28181 server listen", zap.String("network", l.Network), zap.String("addr", addr), zap.Error(err))
+		} else {
+			GB28181Plugin.Info(fmt.Sprint(aurora.Green("Server gb28181 start at"), aurora.BrightBlue(strings.ToLower(l.Network)+":"+addr)))
+		}
 	}
 
-	if c.MediaNetwork == "tcp" {
-		c.tcpPorts.Init(c.MediaPortMin, c.MediaPortMax)
-	} else {
-		c.udpPorts.Init(c.MediaPortMin, c.MediaPortMax)
-	}
+	// 每次邀请可以选择不同的媒体传输方式，TCP 和 UDP 端口分别分配
+	c.tcpPorts.Init(c.MediaPortMin, c.MediaPortMax)
+	c.udpPorts.Init(c.MediaPortMin, c.MediaPortMax)
 	go c.startJob()
 }
 
@@ -164,18 +221,15 @@ func (c *GB28181Config) startServer() {
 func (c *GB28181Config) startJob() {
 	statusTick := time.NewTicker(c.HeartbeatInterval / 2)
 	banTick := time.NewTicker(c.RemoveBanInterval)
-	linkTick := time.NewTicker(time.Millisecond * 100)
 	GB28181Plugin.Debug("start job")
 	for {
 		select {
 		case <-banTick.C:
-			if c.Username != "" || c.Password != "" {
-				c.removeBanDevice()
-			}
+			// 设备账号可能来自认证器或 API，不再根据全局账号判断是否需要认证
+			c.removeBanDevice()
 		case <-statusTick.C:
 			c.statusCheck()
-		case <-linkTick.C:
-			RecordQueryLink.cleanTimeout()
+			cleanDownloadJobs()
 		}
 	}
 }
@@ -198,19 +252,26 @@ func (c *GB28181Config) statusCheck() {
 		d := value.(*Device)
 		if time.Since(d.UpdateTime) > c.RegisterValidity {
 			Devices.Delete(key)
+			saver.markDeleted(d.ID)
+			d.hook(WebhookDeviceUnregister, "expired")
 			GB28181Plugin.Info("Device register timeout",
 				zap.String("id", d.ID),
 				zap.Time("registerTime", d.RegisterTime),
 				zap.Time("updateTime", d.UpdateTime),
 			)
 		} else if time.Since(d.UpdateTime) > c.HeartbeatInterval*3 {
+			if d.Status == DeviceOfflineStatus {
+				return true
+			}
 			d.Status = DeviceOfflineStatus
 			d.channelMap.Range(func(key, value any) bool {
-				ch := value.(*Channel)
-				ch.Status = ChannelOffStatus
+				value.(*Channel).setStatus(ChannelOffStatus)
 				return true
 			})
 			GB28181Plugin.Info("Device offline", zap.String("id", d.ID), zap.Time("updateTime", d.UpdateTime))
+			d.hook(WebhookDeviceOffline, "")
+		} else {
+			d.pollStatus()
 		}
 		return true
 	})
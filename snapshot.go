@@ -0,0 +1,337 @@
+package gb28181
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/gb28181/v4/manscdp"
+	"m7s.live/plugin/gb28181/v4/utils"
+)
+
+var (
+	SNAPSHOT_MAX_SIZE int64 = 10 << 20 // 单张图像的最大字节数
+	SNAPSHOT_MAX_NUM        = 10       // 一次抓拍的最大张数
+)
+
+var ErrSnapshotSessionNotFound = errors.New("snapshot session not found")
+
+// SnapshotSession 一次抓拍，设备将图像上传到带 token 的地址，token 只在 SessionExpires 内有效
+type SnapshotSession struct {
+	SessionID  string
+	DeviceID   string
+	ChannelID  string
+	SnapNum    int
+	Interval   int
+	StartTime  time.Time
+	FinishTime time.Time `json:",omitempty"` // 收到设备的图像抓拍传输完成通知的时间
+	Received   int       // 已上传的图像数
+	token      string
+	dir        string
+	sync.Mutex
+}
+
+// SnapshotImage 抓拍的图像文件
+type SnapshotImage struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	URL     string // 通过 API 读取图像的地址
+}
+
+// snapshotSessions 以 SessionID 为 key，snapshotTokens 以 token 为 key
+var snapshotSessions, snapshotTokens sync.Map
+
+func newSnapshotToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return utils.RandString(32)
+	}
+	return hex.EncodeToString(b)
+}
+
+// snapshotUploadURL 下发给设备的上传地址
+func (c *GB28181Config) snapshotUploadURL(d *Device, token string) string {
+	if c.Snapshot.PublicURL != "" {
+		return strings.TrimSuffix(c.Snapshot.PublicURL, "/") + "/snapshot/" + token
+	}
+	_, port, _ := net.SplitHostPort(c.Snapshot.ListenAddr)
+	return fmt.Sprintf("http://%s/snapshot/%s", net.JoinHostPort(d.MediaIP, port), token)
+}
+
+// SnapShot 通知通道抓拍 num 张图像，每张间隔 interval 秒，设备抓拍后上传到本服务，2022
+func (channel *Channel) SnapShot(num, interval int) (*SnapshotSession, error) {
+	if conf.Snapshot.ListenAddr == "" {
+		return nil, errors.New("snapshot upload server disabled")
+	}
+	if num < 1 || num > SNAPSHOT_MAX_NUM {
+		return nil, fmt.Errorf("snap num must be between 1 and %d", SNAPSHOT_MAX_NUM)
+	}
+	d := channel.Device
+	s := &SnapshotSession{
+		SessionID: utils.RandNumString(32),
+		DeviceID:  d.ID,
+		ChannelID: channel.DeviceID,
+		SnapNum:   num,
+		Interval:  interval,
+		StartTime: time.Now(),
+		token:     newSnapshotToken(),
+	}
+	s.dir = filepath.Join(conf.Snapshot.Path, d.ID, channel.DeviceID, s.SessionID)
+	snapshotSessions.Store(s.SessionID, s)
+	snapshotTokens.Store(s.token, s)
+	time.AfterFunc(conf.Snapshot.SessionExpires, func() {
+		snapshotTokens.Delete(s.token)
+	})
+	_, err := d.ChannelConfig(channel.DeviceID, &manscdp.DeviceConfig{SnapShotConfig: &manscdp.SnapShotConfig{
+		SnapNum:   num,
+		Interval:  interval,
+		UploadURL: conf.snapshotUploadURL(d, s.token),
+		SessionID: s.SessionID,
+	}})
+	if err != nil {
+		snapshotTokens.Delete(s.token)
+		snapshotSessions.Delete(s.SessionID)
+		return nil, err
+	}
+	return s, nil
+}
+
+// save 保存一张上传的图像，超过抓拍张数的上传被拒绝
+func (s *SnapshotSession) save(r io.Reader) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.Received >= s.SnapNum {
+		return errors.New("too many images")
+	}
+	if err := os.MkdirAll(s.dir, 0766); err != nil {
+		return err
+	}
+	name := filepath.Join(s.dir, fmt.Sprintf("%d.jpg", s.Received+1))
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, SNAPSHOT_MAX_SIZE+1))
+	f.Close()
+	if err == nil && n > SNAPSHOT_MAX_SIZE {
+		err = errors.New("image too large")
+	}
+	if err != nil {
+		os.Remove(name)
+		return err
+	}
+	s.Received++
+	return nil
+}
+
+func (s *SnapshotSession) finish() {
+	s.Lock()
+	defer s.Unlock()
+	s.FinishTime = time.Now()
+	snapshotTokens.Delete(s.token)
+}
+
+// serveSnapshotUpload 接收设备上传的图像，支持直接以请求体上传和 multipart/form-data 上传
+func serveSnapshotUpload(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/snapshot/")
+	v, ok := snapshotTokens.Load(token)
+	if !ok {
+		http.Error(w, "invalid token", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s := v.(*SnapshotSession)
+	var err error
+	if mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		var part *multipart.Part
+		for err == nil {
+			if part, err = mr.NextPart(); err == nil {
+				if part.FileName() != "" || strings.HasPrefix(part.Header.Get("Content-Type"), "image/") {
+					err = s.save(part)
+				}
+				part.Close()
+			}
+		}
+		if err == io.EOF {
+			err = nil
+		}
+	} else {
+		err = s.save(r.Body)
+	}
+	if err != nil {
+		GB28181Plugin.Warn("snapshot upload", zap.String("session", s.SessionID), zap.String("remote", r.RemoteAddr), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	GB28181Plugin.Debug("snapshot uploaded", zap.String("session", s.SessionID), zap.String("remote", r.RemoteAddr))
+}
+
+// startSnapshotServer 启动供设备上传图像的 HTTP 服务，并定时删除超过保存期限的图像
+func (c *GB28181Config) startSnapshotServer() {
+	if c.Snapshot.ListenAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/snapshot/", serveSnapshotUpload)
+	server := &http.Server{Addr: c.Snapshot.ListenAddr, Handler: mux, ReadTimeout: time.Minute}
+	go func() {
+		GB28181Plugin.Info("snapshot upload server", zap.String("addr", c.Snapshot.ListenAddr))
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			GB28181Plugin.Error("snapshot upload server", zap.Error(err))
+		}
+	}()
+	go func() {
+		t := time.NewTicker(time.Hour)
+		defer t.Stop()
+		for {
+			c.removeExpiredSnapshots()
+			select {
+			case <-GB28181Plugin.Done():
+				server.Close()
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// removeExpiredSnapshots 删除修改时间超过 Retention 的抓拍目录
+func (c *GB28181Config) removeExpiredSnapshots() {
+	if c.Snapshot.Retention <= 0 {
+		return
+	}
+	dirs, _ := filepath.Glob(filepath.Join(c.Snapshot.Path, "*", "*", "*"))
+	for _, dir := range dirs {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() && time.Since(info.ModTime()) > c.Snapshot.Retention {
+			if err = os.RemoveAll(dir); err != nil {
+				GB28181Plugin.Warn("remove snapshot", zap.String("dir", dir), zap.Error(err))
+			}
+			snapshotSessions.Delete(filepath.Base(dir))
+		}
+	}
+	// 设备没有上传图像的会话
+	snapshotSessions.Range(func(key, value any) bool {
+		if time.Since(value.(*SnapshotSession).StartTime) > c.Snapshot.Retention {
+			snapshotSessions.Delete(key)
+		}
+		return true
+	})
+}
+
+// onSnapShotDone 设备图像抓拍传输完成，SessionID 不是本服务下发的忽略
+func onSnapShotDone(sessionId string) {
+	if v, ok := snapshotSessions.Load(sessionId); ok {
+		v.(*SnapshotSession).finish()
+	}
+}
+
+// findSnapshotDir 服务重启后会话信息丢失，按目录查找
+func findSnapshotDir(sessionId string) (string, error) {
+	if v, ok := snapshotSessions.Load(sessionId); ok {
+		return v.(*SnapshotSession).dir, nil
+	}
+	if sessionId == "" || strings.ContainsAny(sessionId, `/\.*?[`) {
+		return "", ErrSnapshotSessionNotFound
+	}
+	if dirs, _ := filepath.Glob(filepath.Join(conf.Snapshot.Path, "*", "*", sessionId)); len(dirs) > 0 {
+		return dirs[0], nil
+	}
+	return "", ErrSnapshotSessionNotFound
+}
+
+// SnapshotImages 抓拍会话中已上传的图像
+func SnapshotImages(sessionId string) ([]*SnapshotImage, error) {
+	dir, err := findSnapshotDir(sessionId)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	list := make([]*SnapshotImage, 0, len(entries))
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && !e.IsDir() {
+			list = append(list, &SnapshotImage{
+				Name:    e.Name(),
+				Size:    info.Size(),
+				ModTime: info.ModTime(),
+				URL:     fmt.Sprintf("/gb28181/api/snapshot/image?session=%s&name=%s", sessionId, e.Name()),
+			})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, _ := strconv.Atoi(strings.TrimSuffix(list[i].Name, ".jpg"))
+		b, _ := strconv.Atoi(strings.TrimSuffix(list[j].Name, ".jpg"))
+		return a < b
+	})
+	return list, nil
+}
+
+func (c *GB28181Config) API_snapshot(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	channel := query.Get("channel")
+	num := 1
+	if n := query.Get("num"); n != "" {
+		num, _ = strconv.Atoi(n)
+	}
+	interval, _ := strconv.Atoi(query.Get("interval"))
+	if c := FindChannel(id, channel); c != nil {
+		if s, err := c.SnapShot(num, interval); err == nil {
+			util.ReturnValue(s, w, r)
+		} else {
+			util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+		}
+	} else {
+		util.ReturnError(util.APIErrorNotFound, fmt.Sprintf("device %q channel %q not found", id, channel), w, r)
+	}
+}
+
+func (c *GB28181Config) API_snapshot_images(w http.ResponseWriter, r *http.Request) {
+	session := r.URL.Query().Get("session")
+	if list, err := SnapshotImages(session); err == nil {
+		util.ReturnValue(list, w, r)
+	} else if err == ErrSnapshotSessionNotFound {
+		util.ReturnError(util.APIErrorNotFound, err.Error(), w, r)
+	} else {
+		util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+	}
+}
+
+func (c *GB28181Config) API_snapshot_image(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name := query.Get("name")
+	dir, err := findSnapshotDir(query.Get("session"))
+	if err != nil {
+		util.ReturnError(util.APIErrorNotFound, err.Error(), w, r)
+		return
+	}
+	// 只允许 save 生成的 N.jpg，避免 . 或 .. 列出目录中其他会话
+	if n, err := strconv.Atoi(strings.TrimSuffix(name, ".jpg")); err != nil || n < 1 || name != fmt.Sprintf("%d.jpg", n) {
+		util.ReturnError(util.APIErrorQueryParse, fmt.Sprintf("wrong name %q", name), w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeFile(w, r, filepath.Join(dir, name))
+}
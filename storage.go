@@ -0,0 +1,323 @@
+package gb28181
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// 设备存储类型
+const (
+	StorageTypeJSON = "json" // 所有设备保存在一个 JSON 文件中，每次整体替换
+	StorageTypeBolt = "bolt" // 设备和通道分别保存在 bbolt 数据库中，只写入变化的设备
+	StorageTypeNone = "none" // 不保存
+)
+
+// DeviceStorage 设备注册信息的持久化存储，服务重启后据此恢复设备和通道
+type DeviceStorage interface {
+	Load() ([]*StoredDevice, error)
+	// Save 保存发生变化的设备及其通道，并删除已移除的设备
+	Save(changed []*Device, deleted []string) error
+	Close() error
+}
+
+// StoredDevice 持久化的设备信息，通道只保存目录信息
+type StoredDevice struct {
+	*Device
+	Channels []ChannelInfo
+}
+
+// deviceData 设备本身的字段，不包含通道
+func deviceData(d *Device) ([]byte, error) {
+	type Alias Device
+	return json.Marshal((*Alias)(d))
+}
+
+func deviceChannels(d *Device) (list []ChannelInfo) {
+	d.channelMap.Range(func(key, value any) bool {
+		list = append(list, value.(*Channel).ChannelInfo)
+		return true
+	})
+	return
+}
+
+func newDeviceStorage(storageType, path string) (DeviceStorage, error) {
+	switch storageType {
+	case StorageTypeNone:
+		return nil, nil
+	case StorageTypeBolt:
+		return openBoltStorage(path)
+	default:
+		return &jsonStorage{path: path}, nil
+	}
+}
+
+// jsonStorage 将所有设备写入临时文件后原子替换，避免写入过程中崩溃导致文件损坏
+type jsonStorage struct {
+	path string
+}
+
+func (s *jsonStorage) Load() (items []*StoredDevice, err error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&items)
+	return
+}
+
+func (s *jsonStorage) Save(changed []*Device, deleted []string) error {
+	// 设备本身的字段与通道列表在同一层，与 Load 时解析的 StoredDevice 一致
+	type alias Device
+	type storedDevice struct {
+		*alias
+		Channels []ChannelInfo
+	}
+	items := make([]*storedDevice, 0)
+	Devices.Range(func(key, value any) bool {
+		d := value.(*Device)
+		items = append(items, &storedDevice{alias: (*alias)(d), Channels: deviceChannels(d)})
+		return true
+	})
+	data, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+func (s *jsonStorage) Close() error {
+	return nil
+}
+
+// writeFileAtomic 先写入同目录下的临时文件并落盘，再重命名替换目标文件
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+var (
+	boltDeviceBucket  = []byte("devices")
+	boltChannelBucket = []byte("channels")
+)
+
+// boltStorage 设备和通道分别保存，通道的 key 为 设备ID/通道ID，内容未变化的通道不会重复写入
+type boltStorage struct {
+	db *bbolt.DB
+}
+
+func openBoltStorage(path string) (*boltStorage, error) {
+	db, err := bbolt.Open(path, 0644, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltDeviceBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltChannelBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStorage{db: db}, nil
+}
+
+func (s *boltStorage) Load() (items []*StoredDevice, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		channels := tx.Bucket(boltChannelBucket).Cursor()
+		return tx.Bucket(boltDeviceBucket).ForEach(func(k, v []byte) error {
+			item := &StoredDevice{Device: &Device{}}
+			if err := json.Unmarshal(v, item.Device); err != nil {
+				return err
+			}
+			prefix := append(append([]byte{}, k...), '/')
+			for ck, cv := channels.Seek(prefix); ck != nil && bytes.HasPrefix(ck, prefix); ck, cv = channels.Next() {
+				var info ChannelInfo
+				if json.Unmarshal(cv, &info) == nil {
+					item.Channels = append(item.Channels, info)
+				}
+			}
+			items = append(items, item)
+			return nil
+		})
+	})
+	return
+}
+
+func (s *boltStorage) Save(changed []*Device, deleted []string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		devices := tx.Bucket(boltDeviceBucket)
+		channels := tx.Bucket(boltChannelBucket)
+		for _, id := range deleted {
+			if err := devices.Delete([]byte(id)); err != nil {
+				return err
+			}
+			if err := deleteChannels(channels, id, nil); err != nil {
+				return err
+			}
+		}
+		for _, d := range changed {
+			data, err := deviceData(d)
+			if err != nil {
+				return err
+			}
+			if err = devices.Put([]byte(d.ID), data); err != nil {
+				return err
+			}
+			current := make(map[string]struct{})
+			for _, info := range deviceChannels(d) {
+				key := []byte(d.ID + "/" + info.DeviceID)
+				current[string(key)] = struct{}{}
+				value, err := json.Marshal(info)
+				if err != nil {
+					return err
+				}
+				if bytes.Equal(channels.Get(key), value) {
+					continue
+				}
+				if err = channels.Put(key, value); err != nil {
+					return err
+				}
+			}
+			if err = deleteChannels(channels, d.ID, current); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// deleteChannels 删除设备下不在 keep 中的通道
+func deleteChannels(channels *bbolt.Bucket, deviceId string, keep map[string]struct{}) error {
+	prefix := []byte(deviceId + "/")
+	var keys [][]byte
+	c := channels.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if _, ok := keep[string(k)]; !ok {
+			keys = append(keys, append([]byte{}, k...))
+		}
+	}
+	for _, k := range keys {
+		if err := channels.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltStorage) Close() error {
+	return s.db.Close()
+}
+
+// deviceSaver 合并一段时间内的设备变化后批量写入存储
+type deviceSaver struct {
+	storage DeviceStorage
+	delay   time.Duration
+	changed map[string]struct{}
+	deleted map[string]struct{}
+	timer   *time.Timer
+	sync.Mutex
+}
+
+var saver deviceSaver
+
+func (s *deviceSaver) schedule() {
+	if s.timer == nil {
+		s.timer = time.AfterFunc(s.delay, s.flush)
+	}
+}
+
+// markChanged 设备或其通道发生变化
+func (s *deviceSaver) markChanged(id string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.storage == nil {
+		return
+	}
+	s.changed[id] = struct{}{}
+	delete(s.deleted, id)
+	s.schedule()
+}
+
+// markDeleted 设备已移除
+func (s *deviceSaver) markDeleted(id string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.storage == nil {
+		return
+	}
+	s.deleted[id] = struct{}{}
+	delete(s.changed, id)
+	s.schedule()
+}
+
+func (s *deviceSaver) flush() {
+	s.Lock()
+	defer s.Unlock()
+	s.timer = nil
+	if s.storage == nil || len(s.changed) == 0 && len(s.deleted) == 0 {
+		return
+	}
+	var changed []*Device
+	var deleted []string
+	for id := range s.changed {
+		if v, ok := Devices.Load(id); ok {
+			changed = append(changed, v.(*Device))
+		}
+	}
+	for id := range s.deleted {
+		deleted = append(deleted, id)
+	}
+	if err := s.storage.Save(changed, deleted); err != nil {
+		GB28181Plugin.Error("save devices", zap.Error(err))
+		// 保留未写入的变化，稍后重试
+		s.schedule()
+		return
+	}
+	s.changed = make(map[string]struct{})
+	s.deleted = make(map[string]struct{})
+}
+
+// close 写入剩余的变化并关闭存储
+func (s *deviceSaver) close() {
+	s.flush()
+	s.Lock()
+	defer s.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if s.storage != nil {
+		s.storage.Close()
+		s.storage = nil
+	}
+}
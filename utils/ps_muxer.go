@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"encoding/binary"
+)
+
+// PS 流中的 stream_type，参见 GB/T 28181 附录 C
+const (
+	PSStreamTypeH264  = 0x1B
+	PSStreamTypeH265  = 0x24
+	PSStreamTypeAAC   = 0x0F
+	PSStreamTypeG711A = 0x90
+	PSStreamTypeG711U = 0x91
+)
+
+const (
+	psVideoStreamID = 0xE0
+	psAudioStreamID = 0xC0
+	// 单个 PES 包能承载的最大负载，PES_packet_length 为 16 位
+	psMaxPESPayload = 0xFFFF - 3 - 10
+)
+
+// PSMuxer 将音视频帧封装为 MPEG-PS，用于向上级平台转发或向设备推送音频
+// VideoType/AudioType 为 0 表示没有对应的流
+type PSMuxer struct {
+	VideoType byte
+	AudioType byte
+	buf       []byte
+}
+
+// MuxVideo 封装一帧视频，annexB 为带起始码的 NALU 数据，pts/dts 为 90kHz 时间戳
+func (m *PSMuxer) MuxVideo(annexB []byte, keyFrame bool, pts, dts uint32) []byte {
+	m.buf = m.buf[:0]
+	m.writePackHeader(dts)
+	if keyFrame {
+		m.writeSystemHeader()
+		m.writePSM()
+	}
+	m.writePES(psVideoStreamID, annexB, pts, dts)
+	return m.buf
+}
+
+// MuxAudio 封装一帧音频，pts 为 90kHz 时间戳
+func (m *PSMuxer) MuxAudio(frame []byte, pts uint32, withPSM bool) []byte {
+	m.buf = m.buf[:0]
+	m.writePackHeader(pts)
+	if withPSM {
+		m.writeSystemHeader()
+		m.writePSM()
+	}
+	m.writePES(psAudioStreamID, frame, pts, pts)
+	return m.buf
+}
+
+func (m *PSMuxer) writePackHeader(ts uint32) {
+	scr := uint64(ts)
+	muxRate := uint32(6106)
+	m.buf = append(m.buf,
+		0x00, 0x00, 0x01, 0xBA,
+		0x44|byte((scr>>27)&0x38)|byte((scr>>28)&0x03),
+		byte(scr>>20),
+		byte((scr>>12)&0xF8)|0x04|byte((scr>>13)&0x03),
+		byte(scr>>5),
+		byte((scr<<3)&0xF8)|0x04,
+		0x01,
+		byte(muxRate>>14),
+		byte(muxRate>>6),
+		byte((muxRate<<2)&0xFC)|0x03,
+		0xF8,
+	)
+}
+
+func (m *PSMuxer) writeSystemHeader() {
+	var streams []byte
+	var audioBound, videoBound byte
+	if m.VideoType != 0 {
+		videoBound = 1
+		streams = append(streams, psVideoStreamID, 0xE0|0x20|0x08, 0x00)
+	}
+	if m.AudioType != 0 {
+		audioBound = 1
+		streams = append(streams, psAudioStreamID, 0xC0, 0x20)
+	}
+	rateBound := uint32(26234)
+	length := 6 + len(streams)
+	m.buf = append(m.buf,
+		0x00, 0x00, 0x01, 0xBB,
+		byte(length>>8), byte(length),
+		0x80|byte(rateBound>>15),
+		byte(rateBound>>7),
+		byte(rateBound<<1)|0x01,
+		audioBound<<2,
+		0xE0|videoBound,
+		0x7F,
+	)
+	m.buf = append(m.buf, streams...)
+}
+
+func (m *PSMuxer) writePSM() {
+	var esMap []byte
+	if m.VideoType != 0 {
+		esMap = append(esMap, m.VideoType, psVideoStreamID, 0x00, 0x00)
+	}
+	if m.AudioType != 0 {
+		esMap = append(esMap, m.AudioType, psAudioStreamID, 0x00, 0x00)
+	}
+	start := len(m.buf)
+	length := 6 + len(esMap) + 4
+	m.buf = append(m.buf,
+		0x00, 0x00, 0x01, 0xBC,
+		byte(length>>8), byte(length),
+		0xE0, 0xFF,
+		0x00, 0x00,
+		byte(len(esMap)>>8), byte(len(esMap)),
+	)
+	m.buf = append(m.buf, esMap...)
+	m.buf = binary.BigEndian.AppendUint32(m.buf, crc32MPEG2(m.buf[start:]))
+}
+
+func (m *PSMuxer) writePES(streamID byte, payload []byte, pts, dts uint32) {
+	first := true
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > psMaxPESPayload {
+			n = psMaxPESPayload
+		}
+		var header []byte
+		if first {
+			if pts != dts {
+				header = append(header, 0x80, 0xC0, 10)
+				header = appendTimestamp(header, 0x30, pts)
+				header = appendTimestamp(header, 0x10, dts)
+			} else {
+				header = append(header, 0x80, 0x80, 5)
+				header = appendTimestamp(header, 0x20, pts)
+			}
+			first = false
+		} else {
+			header = append(header, 0x80, 0x00, 0)
+		}
+		length := len(header) + n
+		m.buf = append(m.buf, 0x00, 0x00, 0x01, streamID, byte(length>>8), byte(length))
+		m.buf = append(m.buf, header...)
+		m.buf = append(m.buf, payload[:n]...)
+		payload = payload[n:]
+	}
+}
+
+func appendTimestamp(b []byte, flag byte, ts uint32) []byte {
+	t := uint64(ts)
+	return append(b,
+		flag|byte((t>>29)&0x0E)|0x01,
+		byte(t>>22),
+		byte((t>>14)&0xFE)|0x01,
+		byte(t>>7),
+		byte((t<<1)&0xFE)|0x01,
+	)
+}
+
+func crc32MPEG2(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = (crc << 1) ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
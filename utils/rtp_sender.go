@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/pion/rtp"
+)
+
+const rtpMaxPayload = 1400
+
+// RTPSender 将 PS 数据按 RTP 打包发送，TCP 方式按 RFC 4571 增加 2 字节长度头
+type RTPSender struct {
+	net.Conn
+	TCP         bool
+	SSRC        uint32
+	PayloadType uint8
+	seq         uint16
+	buf         []byte
+}
+
+func NewRTPSender(conn net.Conn, tcp bool, ssrc uint32, payloadType uint8) *RTPSender {
+	return &RTPSender{
+		Conn:        conn,
+		TCP:         tcp,
+		SSRC:        ssrc,
+		PayloadType: payloadType,
+	}
+}
+
+// Send 发送一帧数据，超过 MTU 时拆分为多个 RTP 包，最后一个包置 marker
+func (s *RTPSender) Send(payload []byte, timestamp uint32) error {
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > rtpMaxPayload {
+			n = rtpMaxPayload
+		}
+		s.seq++
+		packet := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         n == len(payload),
+				PayloadType:    s.PayloadType,
+				SequenceNumber: s.seq,
+				Timestamp:      timestamp,
+				SSRC:           s.SSRC,
+			},
+			Payload: payload[:n],
+		}
+		raw, err := packet.Marshal()
+		if err != nil {
+			return err
+		}
+		if s.TCP {
+			s.buf = binary.BigEndian.AppendUint16(s.buf[:0], uint16(len(raw)))
+			s.buf = append(s.buf, raw...)
+			raw = s.buf
+		}
+		if _, err = s.Write(raw); err != nil {
+			return err
+		}
+		payload = payload[n:]
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package gb28181
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"go.uber.org/zap"
+)
+
+// 推送给业务系统的事件类型
+const (
+	WebhookDeviceRegister   = "device.register"
+	WebhookDeviceUnregister = "device.unregister"
+	WebhookDeviceOnline     = "device.online"
+	WebhookDeviceOffline    = "device.offline"
+	WebhookChannelAdd       = "channel.add"
+	WebhookChannelDelete    = "channel.delete"
+	WebhookChannelStatus    = "channel.status"
+	WebhookChannelUpdate    = "channel.update"
+	WebhookChannelPosition  = "channel.position"
+	WebhookDevicePosition   = "device.position"
+	WebhookAlarm            = "alarm"
+	WebhookInviteSuccess    = "invite.success"
+	WebhookInviteFailure    = "invite.failure"
+	WebhookStreamBye        = "stream.bye"
+)
+
+// 签名头，值为 sha256=HMAC-SHA256(Secret, 请求体) 的十六进制
+const HeaderWebhookSignature = "X-GB28181-Signature"
+
+var (
+	WEBHOOK_QUEUE_SIZE  = 1024
+	WEBHOOK_MAX_BACKOFF = time.Minute
+)
+
+// WebhookEvent 推送的请求体
+type WebhookEvent struct {
+	Event     string
+	Time      time.Time
+	DeviceID  string
+	ChannelID string `json:",omitempty"`
+	Data      any    `json:",omitempty"`
+}
+
+// webhookDevice 设备事件中的设备信息，不包含通道列表
+type webhookDevice struct {
+	ID           string
+	Name         string
+	Manufacturer string
+	Model        string
+	Status       DeviceStatus
+	NetAddr      string
+	Transport    string
+	GBVersion    string
+	Reason       string `json:",omitempty"` // 注销原因，unregister 为设备注销，expired 为注册过期
+}
+
+// webhookInvite 点播事件的信息
+type webhookInvite struct {
+	StreamPath string
+	Transport  string
+	Code       int
+	Error      string `json:",omitempty"`
+}
+
+type webhookEndpoint struct {
+	GB28181WebhookConfig
+	queue chan []byte
+}
+
+var webhooks []*webhookEndpoint
+
+// startWebhooks 每个推送地址一个发送队列，按事件产生的顺序依次发送
+func (c *GB28181Config) startWebhooks() {
+	for _, cfg := range c.Webhooks {
+		if cfg.URL == "" {
+			continue
+		}
+		if cfg.Timeout == 0 {
+			cfg.Timeout = time.Second * 5
+		}
+		if cfg.RetryInterval == 0 {
+			cfg.RetryInterval = time.Second
+		}
+		w := &webhookEndpoint{GB28181WebhookConfig: cfg, queue: make(chan []byte, WEBHOOK_QUEUE_SIZE)}
+		webhooks = append(webhooks, w)
+		go w.run()
+	}
+}
+
+// matchEvent 按事件类型过滤，filters 为空时匹配所有事件，支持 * 和 device.* 这样的前缀匹配
+func matchEvent(filters []string, event string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	for _, e := range filters {
+		if e == event || e == "*" || strings.HasSuffix(e, ".*") && strings.HasPrefix(event, e[:len(e)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *webhookEndpoint) run() {
+	for {
+		select {
+		case <-GB28181Plugin.Done():
+			return
+		case body := <-w.queue:
+			w.deliver(body)
+		}
+	}
+}
+
+// deliver 发送失败或返回非 2xx 时按 RetryInterval 指数退避重试
+func (w *webhookEndpoint) deliver(body []byte) {
+	backoff := w.RetryInterval
+	for i := 0; ; i++ {
+		err := w.post(body)
+		if err == nil {
+			return
+		}
+		if i >= w.Retry {
+			GB28181Plugin.Error("webhook failed", zap.String("url", w.URL), zap.Int("retry", i), zap.Error(err))
+			return
+		}
+		GB28181Plugin.Debug("webhook retry", zap.String("url", w.URL), zap.Duration("after", backoff), zap.Error(err))
+		select {
+		case <-GB28181Plugin.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > WEBHOOK_MAX_BACKOFF {
+			backoff = WEBHOOK_MAX_BACKOFF
+		}
+	}
+}
+
+func (w *webhookEndpoint) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.Header {
+		req.Header.Set(k, v)
+	}
+	if w.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.Secret))
+		mac.Write(body)
+		req.Header.Set(HeaderWebhookSignature, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status=%d", resp.StatusCode)
+	}
+	return nil
+}
+
+// hook 将事件放入订阅了该事件的推送队列和实时事件流，队列满时丢弃
+func hook(event, deviceId, channelId string, data any) {
+	if len(webhooks) == 0 && !liveFeed.active() {
+		return
+	}
+	e := &WebhookEvent{Event: event, Time: time.Now(), DeviceID: deviceId, ChannelID: channelId, Data: data}
+	body, err := json.Marshal(e)
+	if err != nil {
+		GB28181Plugin.Error("webhook marshal", zap.String("event", event), zap.Error(err))
+		return
+	}
+	liveFeed.publish(e, body)
+	for _, w := range webhooks {
+		if !matchEvent(w.Events, event) {
+			continue
+		}
+		select {
+		case w.queue <- body:
+		default:
+			GB28181Plugin.Warn("webhook queue full, drop event", zap.String("url", w.URL), zap.String("event", event))
+		}
+	}
+}
+
+func (d *Device) hook(event, reason string) {
+	hook(event, d.ID, "", &webhookDevice{
+		ID:           d.ID,
+		Name:         d.Name,
+		Manufacturer: d.Manufacturer,
+		Model:        d.Model,
+		Status:       d.Status,
+		NetAddr:      d.NetAddr,
+		Transport:    d.Transport,
+		GBVersion:    d.GBVersion,
+		Reason:       reason,
+	})
+}
+
+func (channel *Channel) hook(event string) {
+	hook(event, channel.Device.ID, channel.DeviceID, channel)
+}
+
+// setStatus 通道状态变化时推送 channel.status
+func (channel *Channel) setStatus(status ChannelStatus) {
+	if channel.Status != status {
+		channel.Status = status
+		channel.hook(WebhookChannelStatus)
+	}
+}
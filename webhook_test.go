@@ -0,0 +1,27 @@
+package gb28181
+
+import "testing"
+
+func TestMatchEvent(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		filters []string
+		event   string
+		want    bool
+	}{
+		{"no filter", nil, WebhookDeviceOnline, true},
+		{"exact", []string{WebhookDeviceOnline}, WebhookDeviceOnline, true},
+		{"exact mismatch", []string{WebhookDeviceOnline}, WebhookDeviceOffline, false},
+		{"wildcard", []string{"*"}, WebhookChannelAdd, true},
+		{"prefix", []string{"device.*"}, WebhookDeviceRegister, true},
+		{"prefix mismatch", []string{"device.*"}, WebhookChannelAdd, false},
+		{"prefix needs dot", []string{"device.*"}, "devices.online", false},
+		{"any of filters", []string{WebhookDeviceOffline, "channel.*"}, WebhookChannelStatus, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchEvent(tt.filters, tt.event); got != tt.want {
+				t.Errorf("matchEvent(%v, %q) = %v, want %v", tt.filters, tt.event, got, tt.want)
+			}
+		})
+	}
+}